@@ -6,11 +6,10 @@ module github.com/zosopentools/wharf
 go 1.18
 
 require (
+	github.com/mattn/go-isatty v0.0.18
+	golang.org/x/mod v0.9.0
 	golang.org/x/tools v0.7.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/mattn/go-isatty v0.0.18 // indirect
-	golang.org/x/sys v0.6.0 // indirect
-)
+require golang.org/x/sys v0.6.0 // indirect
@@ -28,12 +28,30 @@ Options:
 -p
 	REQUIRES -q
 	Automatically create and save patch files (diffs)
+-borrow <n>
+	Most missing names declarations are borrowed for from a donor platform's file instead of retagging whole files (default 2)
 -config
 	Path to config for additional code edits
 -d
 	Filesystem pat to store imported modules
 -f
 	Force apply changes
+-golangx
+	Port golang.org/x modules like any other dependency instead of only pinning them (the output warns about each one)
+-j <n>
+	Number of packages to type check in parallel (defaults to the number of CPUs)
+-json
+	Print the planned changes as JSON (progress and messages go to stderr)
+-mem <MiB>
+	Memory budget, past it syntax trees that are no longer needed are released and parsed again if needed
+-nocache
+	Don't reuse or store type data of unchanged packages and metadata of unchanged files between runs
+-pin <search>
+	How the version of a module that needs porting is picked: update (latest, the default) or minimal
+-strategies <list>
+	Comma separated porting strategies to try in order (borrow, assemble, retag, exports)
+-target <goos/goarch>
+	Platform to port to (defaults to the Go environment, e.g. GOOS=zos)
 -version
 	Display version information
 `
@@ -7,31 +7,103 @@ package base
 import (
 	"fmt"
 	"go/build"
+	"go/token"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 
 	"github.com/zosopentools/wharf/internal/util"
 )
 
-func init() {
-	initInlines()
-	initGoEnv()
+// Ways to pick the version of a module that needs porting
+const (
+	// Try the latest version, then fall back to the one MVS selected
+	PinUpdate = "update"
+
+	// Bisect the versions after the one MVS selected for the lowest that type checks
+	PinMinimal = "minimal"
+)
+
+// State of a single port: the Go environment, the options and the config directives
+//
+// Nothing is shared between sessions, so several ports can run in the same process.
+type Session struct {
+	goenv map[string]string
+
+	// Directory and environment variables every go command runs with
+	Env util.Env
+
+	BuildTags map[string]bool
+
+	ImportDir string
+	Cache     string
+
+	// Directory type data of error free packages and the metadata of files are persisted to (empty to disable)
+	TypeCache string
+
+	// Number of packages that are type checked at the same time
+	Jobs int
+
+	// Heap size (in bytes) past which syntax trees that are no longer needed get released (0 for no limit)
+	MemoryLimit uint64
+
+	// Most names a package can be missing for the borrow strategy to copy declarations
+	// (past it retagging whole files is likely the better option)
+	BorrowLimit int
+
+	// Porting strategies to try (in order), empty for the default ones
+	Strategies []string
+
+	// How the version of a module that needs porting is picked (PinUpdate or PinMinimal, empty for PinUpdate)
+	PinSearch string
+
+	// Limits on the versions modules get pinned to
+	Policy Policy
+
+	// Port golang.org/x modules like any other dependency instead of only pinning them
+	PortGolangX bool
+
+	// Directives of the default config and any config loaded on top of it (keyed by import path)
+	Inlines map[string]*PackageInline
+
+	// Options for specific modules (keyed by module path)
+	Modules map[string]*ModuleConfig
+
+	// File set shared by every parsed file (safe for concurrent use, packages are type checked in parallel)
+	FileSet *token.FileSet
 }
 
-func initGoEnv() {
-	var err error
-	goenv, err = util.GoEnv()
+// Start a session with the default options for the Go environment go commands see with env
+//
+// The workspace is the one env's directory belongs to, env's variables (e.g. GOOS, GOARCH) apply to every go command.
+func NewSession(env util.Env) (*Session, error) {
+	goenv, err := util.GoEnv(env)
 	if err != nil {
-		panic(fmt.Sprintf("unable to inspect Go environment (cannot execute 'go env'): %v", err))
+		return nil, fmt.Errorf("unable to inspect Go environment (cannot execute 'go env'): %w", err)
 	}
+	sess := SessionFromEnv(goenv)
+	sess.Env = env
+	return sess, nil
+}
+
+// Start a session with the default options for the given Go environment (as reported by go env)
+func SessionFromEnv(goenv map[string]string) *Session {
+	sess := &Session{
+		goenv:       goenv,
+		BuildTags:   make(map[string]bool),
+		Jobs:        runtime.NumCPU(),
+		BorrowLimit: 2,
+		FileSet:     token.NewFileSet(),
+	}
+	sess.Inlines, sess.Modules = defaultInlines()
 
 	// Set tags that Go figures out from the environment, such as GOARCH, CGO, and GOVERSION
-	BuildTags[goenv["GOARCH"]] = true
-	BuildTags[build.Default.Compiler] = true
+	sess.BuildTags[goenv["GOARCH"]] = true
+	sess.BuildTags[build.Default.Compiler] = true
 	if goenv["CGO_ENABLED"] == "1" {
-		BuildTags["cgo"] = true
+		sess.BuildTags["cgo"] = true
 	}
 
 	var vnum int
@@ -47,37 +119,37 @@ func initGoEnv() {
 	}
 
 	for vnum >= 0 {
-		BuildTags[fmt.Sprintf("go1.%v", vnum)] = true
+		sess.BuildTags[fmt.Sprintf("go1.%v", vnum)] = true
 		vnum -= 1
 	}
 
 	// Initialize some variables here to default values (can be overwritten)
-	goWorkDir := filepath.Dir(GOWORK())
-	Cache = filepath.Join(goWorkDir, ".wharf_cache") // TODO: move this to TMPDIR
+	goWorkDir := filepath.Dir(sess.GOWORK())
+	sess.Cache = filepath.Join(goWorkDir, ".wharf_cache") // TODO: move this to TMPDIR
 
-	// TODO: make this relative to the position of the GOWORK folder
-	// so that `go work use` uses a relative position instead of absolute
-	ImportDir = filepath.Join(goWorkDir, "wharf_port")
-}
+	// Imported modules are added to the workspace relative to the go.work directory
+	sess.ImportDir = filepath.Join(goWorkDir, "wharf_port")
 
-var goenv = make(map[string]string)
-var BuildTags = make(map[string]bool)
+	// Type data is kept between runs, caching is simply disabled if there is no place for it
+	if dir, err := os.UserCacheDir(); err == nil {
+		sess.TypeCache = filepath.Join(dir, "wharf", "types")
+	}
 
-var ImportDir string
-var Cache string
+	return sess
+}
 
-func GOOS() string {
-	return goenv["GOOS"]
+func (sess *Session) GOOS() string {
+	return sess.goenv["GOOS"]
 }
 
-func GOARCH() string {
-	return goenv["GOARCH"]
+func (sess *Session) GOARCH() string {
+	return sess.goenv["GOARCH"]
 }
 
-func GOWORK() string {
-	return goenv["GOWORK"]
+func (sess *Session) GOWORK() string {
+	return sess.goenv["GOWORK"]
 }
 
-func GoEnv(key string) string {
-	return goenv[key]
+func (sess *Session) GoEnv(key string) string {
+	return sess.goenv[key]
 }
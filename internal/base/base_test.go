@@ -0,0 +1,120 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package base
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testEnv = map[string]string{
+	"GOOS":      "zos",
+	"GOARCH":    "s390x",
+	"GOVERSION": "go1.20",
+	"GOWORK":    "/work/go.work",
+}
+
+func TestSessionFromEnv(t *testing.T) {
+	sess := SessionFromEnv(testEnv)
+
+	for _, tag := range []string{"s390x", "go1.20", "go1.1"} {
+		if !sess.BuildTags[tag] {
+			t.Errorf("missing build tag %v", tag)
+		}
+	}
+	if sess.BuildTags["go1.21"] {
+		t.Errorf("build tag go1.21 set for go1.20")
+	}
+	if want := filepath.Join("/work", "wharf_port"); sess.ImportDir != want {
+		t.Errorf("import dir is %v, want %v", sess.ImportDir, want)
+	}
+}
+
+func TestSessionsDoNotShareConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(config, []byte("example.com/p:\n  exports:\n    Open:\n      type: CONST\n      replace: \"nil\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := SessionFromEnv(testEnv)
+	if err := loaded.LoadInlines(config); err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+	loaded.BuildTags["netgo"] = true
+
+	other := SessionFromEnv(testEnv)
+	if loaded.Inlines["example.com/p"] == nil {
+		t.Errorf("config was not loaded into the session")
+	}
+	if other.Inlines["example.com/p"] != nil || other.BuildTags["netgo"] {
+		t.Errorf("changes to one session are visible in another")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.yaml"), filepath.Join(dir, "second.yaml")
+	if err := os.WriteFile(first, []byte("policy:\n  upgrade: patch\n  deny: [example.com/denied/...]\n  go: \"1.20\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("policy:\n  upgrade: minor\n  allow: [example.com/denied/a, example.com/b]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sess := SessionFromEnv(testEnv)
+	for _, config := range []string{first, second} {
+		if err := sess.LoadInlines(config); err != nil {
+			t.Fatalf("unable to load config: %v", err)
+		}
+	}
+
+	if sess.Policy.Upgrade != UpgradeMinor || sess.Policy.Go != "1.20" || !sess.Policy.AllowsPseudo() {
+		t.Errorf("policies were not merged: %+v", sess.Policy)
+	}
+	for modpath, want := range map[string]bool{
+		"example.com/b":         true,
+		"example.com/denied/a":  false,
+		"example.com/c":         false,
+		"example.com/denied":    false,
+		"example.com/deniedish": false,
+	} {
+		if got := sess.Policy.Pinnable(modpath); got != want {
+			t.Errorf("Pinnable(%v) = %v, want %v", modpath, got, want)
+		}
+	}
+
+	if err := os.WriteFile(first, []byte("policy:\n  upgrade: major\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.LoadInlines(first); err == nil {
+		t.Errorf("expected unknown upgrade level to be reported")
+	}
+}
+
+func TestLoadModulePort(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("modules:\n  golang.org/x/sys:\n    port: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sess := SessionFromEnv(testEnv)
+	if err := sess.LoadInlines(config); err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+	if !sess.PortsGolangX("golang.org/x/sys") {
+		t.Errorf("golang.org/x/sys is not ported")
+	}
+
+	// Other modules are ported anyway, the option is a mistake
+	if err := os.WriteFile(config, []byte("modules:\n  example.com/m:\n    port: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SessionFromEnv(testEnv).LoadInlines(config); err == nil || !strings.Contains(err.Error(), "example.com/m") {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -6,16 +6,20 @@ package base
 
 import (
 	_ "embed"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Path prefix of the modules of the Go project (golang.org/x), they are only pinned unless opted in
+const GOLANGX_PATH_PREFIX = "golang.org/x/"
+
 //go:embed inlines.yaml
 var _DEFAULT_INLINES_EMBED []byte
 
-var Inlines map[string]*PackageInline
-
 const (
 	// Explicit file handler types
 	InlineDiffSym = "DIFF"
@@ -23,6 +27,15 @@ const (
 	// Explicit exported symbol handler types
 	InlineExportSym = "EXPORT"
 	InlineConstSym  = "CONST"
+
+	// Explicit handler type rewriting calls to an exported function
+	// (placeholders $0, $1, ... are replaced by the arguments of the call)
+	InlineTemplateSym = "TEMPLATE"
+
+	// Explicit handler types for members of exported types
+	// (the directive is keyed by "Type.Member" and replaces the member's name)
+	InlineFieldSym  = "FIELD"
+	InlineMethodSym = "METHOD"
 )
 
 // Directive description for editting a specific file
@@ -40,46 +53,249 @@ type FileInline struct {
 type ExportInline struct {
 	Type    string
 	Replace string
+
+	// Import path required by a template (added to files the template is applied to)
+	//
+	// The package is loaded as a dependency of every package importing the one the directive is for
+	Import string `yaml:",omitempty"`
 }
 
 // Directives related to a given package
 type PackageInline struct {
-	Files   map[string]FileInline
-	Exports map[string]ExportInline
+	Files   map[string]FileInline   `yaml:",omitempty"`
+	Exports map[string]ExportInline `yaml:",omitempty"`
+}
+
+// Options that change how the packages of a module are ported
+type ModuleConfig struct {
+	// Repair integer type mismatches at syscall boundaries using explicit conversions
+	Convert bool `yaml:",omitempty"`
+
+	// Porting strategies to try (in order) instead of the ones of the run
+	Strategies []string `yaml:",omitempty"`
+
+	// How the version of the module is picked instead of the run's (PinUpdate or PinMinimal)
+	Pin string `yaml:",omitempty"`
+
+	// Port the golang.org/x module like any other dependency (they are only pinned by default),
+	// only allowed for golang.org/x modules
+	Port bool `yaml:",omitempty"`
+}
+
+// Upgrade levels of a version policy
+const (
+	UpgradeAny   = "any"
+	UpgradeMinor = "minor"
+	UpgradePatch = "patch"
+)
+
+// Limits on the versions modules get pinned to
+//
+// A pin that breaks the policy is reported as an error instead of being written to the workspace.
+type Policy struct {
+	// Largest upgrade from the version selected by MVS (UpgradePatch, UpgradeMinor or UpgradeAny, empty for UpgradeAny)
+	Upgrade string `yaml:",omitempty"`
+
+	// Modules that may be pinned, every module if empty (a path ending in /... matches the modules under it)
+	Allow []string `yaml:",omitempty"`
+
+	// Modules that are never pinned, they are ported at the version selected by MVS
+	Deny []string `yaml:",omitempty"`
+
+	// Pin to pseudo-versions
+	Pseudo *bool `yaml:",omitempty"`
+
+	// Highest go directive the version pinned to may have (e.g. 1.20)
+	Go string `yaml:",omitempty"`
+}
+
+// Report whether the module may be pinned to another version
+func (policy Policy) Pinnable(modpath string) bool {
+	if matchModule(policy.Deny, modpath) {
+		return false
+	}
+	return len(policy.Allow) == 0 || matchModule(policy.Allow, modpath)
+}
+
+func (policy Policy) AllowsPseudo() bool {
+	return policy.Pseudo == nil || *policy.Pseudo
+}
+
+func matchModule(patterns []string, modpath string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/...") {
+			prefix := strings.TrimSuffix(pattern, "/...")
+			if modpath == prefix || strings.HasPrefix(modpath, prefix+"/") {
+				return true
+			}
+		} else if pattern == modpath {
+			return true
+		}
+	}
+	return false
+}
+
+// Layout of a config file
+//
+// Package directives are kept at the top level (keyed by import path) next to the module options
+type configFile struct {
+	Modules  map[string]*ModuleConfig  `yaml:",omitempty"`
+	Policy   *Policy                   `yaml:",omitempty"`
+	Packages map[string]*PackageInline `yaml:",inline"`
+}
+
+// Proposed export directive for a symbol that is missing from an imported package
+type InlineSuggestion struct {
+	Package    string
+	Symbol     string
+	Directive  ExportInline
+	Confidence float64
+	Reason     string
+}
+
+// Format the suggestion as a config entry that can be pasted into a config file
+func (sug InlineSuggestion) YAML() string {
+	var out strings.Builder
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	err := enc.Encode(map[string]*PackageInline{
+		sug.Package: {
+			Exports: map[string]ExportInline{
+				sug.Symbol: sug.Directive,
+			},
+		},
+	})
+	if err != nil {
+		panic(fmt.Sprintf("unable to format suggestion: %v", err))
+	}
+	return out.String()
 }
 
-// Load the defaults on package init
-func initInlines() {
-	if err := yaml.Unmarshal(_DEFAULT_INLINES_EMBED, &Inlines); err != nil {
+// Parse the default config (every session gets its own copy, as loading a config modifies it)
+func defaultInlines() (map[string]*PackageInline, map[string]*ModuleConfig) {
+	var config configFile
+	if err := yaml.Unmarshal(_DEFAULT_INLINES_EMBED, &config); err != nil {
 		panic("default explicits configuration file is formatted incorrectly")
 	}
+
+	if config.Packages == nil {
+		config.Packages = make(map[string]*PackageInline)
+	}
+	if config.Modules == nil {
+		config.Modules = make(map[string]*ModuleConfig)
+	}
+	return config.Packages, config.Modules
 }
 
-// Parse a given spec from source
-func LoadInlines(file string) error {
-	spec := make(map[string]*PackageInline)
+// Parse a given spec from source and add it to the directives of the session
+func (sess *Session) LoadInlines(file string) error {
+	var spec configFile
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(data, &Inlines)
+	err = yaml.Unmarshal(data, &spec)
 	if err != nil {
 		return err
 	}
 
-	for pkgname, pkgSpec := range spec {
-		if defPkgSpec := Inlines[pkgname]; defPkgSpec != nil {
+	for pkgname, pkgSpec := range spec.Packages {
+		if pkgSpec == nil {
+			continue
+		}
+		if defPkgSpec := sess.Inlines[pkgname]; defPkgSpec != nil {
+			if defPkgSpec.Files == nil {
+				defPkgSpec.Files = make(map[string]FileInline)
+			}
 			for file, fileSpec := range pkgSpec.Files {
 				defPkgSpec.Files[file] = fileSpec
 			}
+			if defPkgSpec.Exports == nil {
+				defPkgSpec.Exports = make(map[string]ExportInline)
+			}
 			for export, expSpec := range pkgSpec.Exports {
 				defPkgSpec.Exports[export] = expSpec
 			}
 		} else {
-			Inlines[pkgname] = pkgSpec
+			sess.Inlines[pkgname] = pkgSpec
+		}
+	}
+
+	modpaths := make([]string, 0, len(spec.Modules))
+	for modpath := range spec.Modules {
+		modpaths = append(modpaths, modpath)
+	}
+	sort.Strings(modpaths)
+
+	for _, modpath := range modpaths {
+		// Other modules are ported anyway, the option would only mislead
+		if modSpec := spec.Modules[modpath]; modSpec != nil && modSpec.Port && !strings.HasPrefix(modpath, GOLANGX_PATH_PREFIX) {
+			return fmt.Errorf("modules: %v: port only applies to %v modules (every other module is ported when needed)", modpath, GOLANGX_PATH_PREFIX)
+		}
+	}
+	for modpath, modSpec := range spec.Modules {
+		if modSpec != nil {
+			sess.Modules[modpath] = modSpec
+		}
+	}
+
+	if policy := spec.Policy; policy != nil {
+		switch policy.Upgrade {
+		case "", UpgradeAny, UpgradeMinor, UpgradePatch:
+		default:
+			return fmt.Errorf("policy: unknown upgrade level %q (available: %v, %v, %v)", policy.Upgrade, UpgradePatch, UpgradeMinor, UpgradeAny)
+		}
+
+		// Settings of a later config replace the ones it sets
+		if policy.Upgrade != "" {
+			sess.Policy.Upgrade = policy.Upgrade
+		}
+		if policy.Allow != nil {
+			sess.Policy.Allow = policy.Allow
+		}
+		if policy.Deny != nil {
+			sess.Policy.Deny = policy.Deny
+		}
+		if policy.Pseudo != nil {
+			sess.Policy.Pseudo = policy.Pseudo
+		}
+		if policy.Go != "" {
+			sess.Policy.Go = policy.Go
 		}
 	}
 
 	return nil
 }
+
+// Import paths the templates of the package's directives add to the files they are applied to (sorted)
+func (sess *Session) TemplateImports(ipath string) []string {
+	directives := sess.Inlines[ipath]
+	if directives == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var imports []string
+	for _, ed := range directives.Exports {
+		if ed.Type == InlineTemplateSym && ed.Import != "" && ed.Import != ipath && !seen[ed.Import] {
+			seen[ed.Import] = true
+			imports = append(imports, ed.Import)
+		}
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// Report whether the golang.org/x module is ported like any other dependency (opted in for the run or the module)
+func (sess *Session) PortsGolangX(modpath string) bool {
+	return sess.PortGolangX || sess.ModuleOptions(modpath).Port
+}
+
+// Options for the given module (the zero value if it has none)
+func (sess *Session) ModuleOptions(modpath string) ModuleConfig {
+	if opts := sess.Modules[modpath]; opts != nil {
+		return *opts
+	}
+	return ModuleConfig{}
+}
@@ -7,21 +7,51 @@ package base
 import "go/ast"
 
 type Output struct {
-	Modules  []ModulePin
-	Packages []PackagePatch
+	Modules     []ModulePin
+	Packages    []PackagePatch
+	Suggestions []InlineSuggestion `json:",omitempty"`
+
+	// Changes that need attention before they are used (such as golang.org/x modules that were ported)
+	Warnings []string `json:",omitempty"`
+
+	// Modules of the build list whose version changed because of the pins (sorted by path)
+	BuildList []BuildChange `json:",omitempty"`
 
 	Errors string `json:",omitempty"`
 
+	// Platform the packages were ported to
+	GOOS string `json:",omitempty"`
+
 	GoWorkBackup string `json:",omitempty"`
 	ImportDir    string `json:",omitempty"`
 }
 
+// Version of a module in the build list before and after the pins were written to the workspace
+type BuildChange struct {
+	Path string
+
+	// Empty if the module was not in the build list before (a new requirement)
+	Before string `json:",omitempty"`
+
+	// Empty if the module dropped out of the build list
+	After string `json:",omitempty"`
+
+	// The module was pinned by Wharf rather than moved as a side effect
+	Pinned bool `json:",omitempty"`
+}
+
 type ModulePin struct {
 	Path     string
 	Version  string
 	Pinned   string
 	Imported bool   `json:",omitempty"`
 	Dir      string `json:",omitempty"`
+
+	// Module path or local directory the workspace already replaced the module with (Pinned is its version)
+	Replace string `json:",omitempty"`
+
+	// The replacement is a local directory (Dir), packages are patched in place instead of being imported
+	Local bool `json:",omitempty"`
 }
 
 type PackagePatch struct {
@@ -42,9 +72,26 @@ type FilePatch struct {
 	Build    bool
 	BaseFile string       `json:",omitempty"`
 	Symbols  []SymbolRepl `json:",omitempty"`
+	Borrowed []string     `json:",omitempty"`
+	Cleanups []Cleanup    `json:",omitempty"`
 	Lines    []LineDiff   `json:",omitempty"`
 }
 
+const (
+	// Kinds of cleanups made to files
+	CleanupImport   = "import"
+	CleanupVariable = "variable"
+)
+
+// Unused import or variable that has to be dealt with for the file to compile
+type Cleanup struct {
+	Kind   string
+	Name   string
+	Path   string `json:",omitempty"`
+	Line   int
+	Column int
+}
+
 type SymbolRepl struct {
 	Original string
 	New      string
@@ -14,6 +14,11 @@ import (
 // undeclared name: [symbol]
 // [v].[symbol] undefined (type [type] has no field or method [symbol])
 // [v].[symbol] undefined (type [type] has no field or method [symbol], but does have [other])
+// cannot use [expr] ([kind] of type [type]) as [type] value in [context]
+// [symbol] redeclared in this block
+// method [type].[symbol] already declared at [pos]
+// "[path]" imported and not used
+// declared and not used: [symbol]
 var (
 	// Go 1.20 matchers and older
 	//
@@ -35,6 +40,28 @@ var (
 
 	_NOT_DECLARED_BY_PACKAGE_ERR_MATCHER = regexp.MustCompile(`(\w+) not declared by package (\w+)`)
 	// EBADF not declared by package syscall
+
+	_CANNOT_USE_AS_TYPE_ERR_MATCHER = regexp.MustCompile(`cannot use (.+) \([^()]*?of (?:type ([\w.]+)|(\w+) type [\w.]+)\) as ([\w.]+) value in`)
+	// cannot use st.Mode (variable of type uint32) as uint16 value in assignment
+	// cannot use m (variable of uint32 type Mode) as uint16 value in argument to f
+
+	_REDECLARED_ERR_MATCHER = regexp.MustCompile(`^(\w+) redeclared in this block`)
+	// Stat redeclared in this block
+
+	_OTHER_DECLARATION_ERR_MATCHER = regexp.MustCompile(`^\tother declaration of (\w+)`)
+	// 	other declaration of Stat (reported right after the redeclaration)
+
+	_METHOD_REDECLARED_ERR_MATCHER = regexp.MustCompile(`^method (\w+)\.(\w+) already declared`)
+	// method File.Close already declared at file_unix.go:20:17
+
+	_UNUSED_IMPORT_ERR_MATCHER = regexp.MustCompile(`^"([^"]+)" imported(?: as (\w+))? and not used`)
+	// "strings" imported as str and not used
+
+	_UNUSED_VAR_ERR_MATCHER_NEW = regexp.MustCompile(`^declared and not used: (\w+)`)
+	// declared and not used: x
+
+	_UNUSED_VAR_ERR_MATCHER = regexp.MustCompile(`^(\w+) declared (?:and|but) not used`)
+	// x declared but not used
 )
 
 type TypeErrId interface {
@@ -65,10 +92,92 @@ type TCBadImportName struct {
 
 func (TCBadImportName) teid() {}
 
+// Value used where a value of a different type is expected
+type TCBadAssign struct {
+	Expr string
+	From string // Underlying type of the value if it is a named type
+	To   string
+}
+
+func (TCBadAssign) teid() {}
+
+// Name declared by more than one file of the config (methods are "Type.Method")
+type TCRedeclared struct {
+	Name string
+}
+
+func (TCRedeclared) teid() {}
+
+// Import that no code in the file uses
+type TCUnusedImport struct {
+	Path string
+	Name string // Only set if the import is renamed
+}
+
+func (TCUnusedImport) teid() {}
+
+// Local variable that is never used
+type TCUnusedVar struct {
+	Name string
+}
+
+func (TCUnusedVar) teid() {}
+
 type TCBadOther struct{}
 
 func (TCBadOther) teid() {}
 
+// Error of a kind recognized by a registered classifier
+//
+// Classifiers define their own kinds by embedding it, so strategies can tell them apart by type
+// (see ClassifiedId). The name of the kind is what reports show.
+type TCClassified struct {
+	Kind  string
+	Match []string // Details the classifier extracted from the error (such as the submatches of its pattern)
+}
+
+func (TCClassified) teid() {}
+
+func (reason TCClassified) Classified() TCClassified {
+	return reason
+}
+
+// Kind of an error recognized by a classifier, TCClassified or a type embedding it
+type ClassifiedId interface {
+	TypeErrId
+	Classified() TCClassified
+}
+
+// Recognizes an additional shape of type errors, so strategies can act on errors that would otherwise be fatal
+type Classifier interface {
+	// Returns false if the error is not of the classifier's kind
+	Classify(err types.Error) (ClassifiedId, bool)
+}
+
+// Classifier matching the message of errors against a pattern
+type PatternClassifier struct {
+	Kind    string
+	Pattern *regexp.Regexp
+}
+
+func (cl PatternClassifier) Classify(err types.Error) (ClassifiedId, bool) {
+	match := cl.Pattern.FindStringSubmatch(err.Msg)
+	if match == nil {
+		return nil, false
+	}
+	return TCClassified{Kind: cl.Kind, Match: match[1:]}, true
+}
+
+// Classify the error using the given classifiers first (in order), then the built in error shapes
+func ClassifyTypeError(err types.Error, classifiers []Classifier) TypeError {
+	for _, cl := range classifiers {
+		if reason, ok := cl.Classify(err); ok {
+			return TypeError{Err: err, Reason: reason}
+		}
+	}
+	return NewTypeCheckError(err)
+}
+
 func NewTypeCheckError(err types.Error) (err2 TypeError) {
 	err2.Err = err
 	if match := _UNDEFINED_PACKAGE_ERR_MATCHER_NEW.FindStringSubmatch(err.Msg); match != nil {
@@ -106,6 +215,41 @@ func NewTypeCheckError(err types.Error) (err2 TypeError) {
 			},
 			PkgName: match[2],
 		}
+	} else if match := _REDECLARED_ERR_MATCHER.FindStringSubmatch(err.Msg); match != nil {
+		err2.Reason = TCRedeclared{
+			Name: match[1],
+		}
+	} else if match := _OTHER_DECLARATION_ERR_MATCHER.FindStringSubmatch(err.Msg); match != nil {
+		err2.Reason = TCRedeclared{
+			Name: match[1],
+		}
+	} else if match := _METHOD_REDECLARED_ERR_MATCHER.FindStringSubmatch(err.Msg); match != nil {
+		err2.Reason = TCRedeclared{
+			Name: match[1] + "." + match[2],
+		}
+	} else if match := _UNUSED_IMPORT_ERR_MATCHER.FindStringSubmatch(err.Msg); match != nil {
+		err2.Reason = TCUnusedImport{
+			Path: match[1],
+			Name: match[2],
+		}
+	} else if match := _UNUSED_VAR_ERR_MATCHER_NEW.FindStringSubmatch(err.Msg); match != nil {
+		err2.Reason = TCUnusedVar{
+			Name: match[1],
+		}
+	} else if match := _UNUSED_VAR_ERR_MATCHER.FindStringSubmatch(err.Msg); match != nil {
+		err2.Reason = TCUnusedVar{
+			Name: match[1],
+		}
+	} else if match := _CANNOT_USE_AS_TYPE_ERR_MATCHER.FindStringSubmatch(err.Msg); match != nil {
+		from := match[2]
+		if len(from) == 0 {
+			from = match[3]
+		}
+		err2.Reason = TCBadAssign{
+			Expr: match[1],
+			From: from,
+			To:   match[4],
+		}
 	} else {
 		err2.Reason = TCBadOther{}
 	}
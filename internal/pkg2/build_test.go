@@ -0,0 +1,77 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package pkg2
+
+import (
+	"go/types"
+	"regexp"
+	"testing"
+)
+
+func TestTypeCheckErrorBadAssign(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want TCBadAssign
+	}{
+		{
+			"cannot use st.Mode (variable of type uint32) as uint16 value in assignment",
+			TCBadAssign{Expr: "st.Mode", From: "uint32", To: "uint16"},
+		},
+		{
+			"cannot use m (variable of uint32 type Mode) as syscall.Signal value in argument to syscall.Kill",
+			TCBadAssign{Expr: "m", From: "uint32", To: "syscall.Signal"},
+		},
+		{
+			"cannot use -1 (untyped int constant) as uint value in variable declaration",
+			TCBadAssign{},
+		},
+	}
+
+	for _, test := range tests {
+		err := NewTypeCheckError(types.Error{Msg: test.msg})
+		reason, ok := err.Reason.(TCBadAssign)
+		if test.want == (TCBadAssign{}) {
+			if ok {
+				t.Errorf("%q should not be classified as a bad assignment: %+v", test.msg, reason)
+			}
+			continue
+		}
+		if !ok || reason != test.want {
+			t.Errorf("%q classified as %#v, want %+v", test.msg, err.Reason, test.want)
+		}
+	}
+}
+
+func TestTypeCheckErrorRedeclared(t *testing.T) {
+	tests := map[string]string{
+		"Helper redeclared in this block":                 "Helper",
+		"\tother declaration of Helper":                   "Helper",
+		"method File.Close already declared at a.go:3:10": "File.Close",
+	}
+
+	for msg, want := range tests {
+		err := NewTypeCheckError(types.Error{Msg: msg})
+		if reason, ok := err.Reason.(TCRedeclared); !ok || reason.Name != want {
+			t.Errorf("%q classified as %#v, want %v", msg, err.Reason, want)
+		}
+	}
+}
+
+func TestClassifyTypeError(t *testing.T) {
+	classifiers := []Classifier{
+		PatternClassifier{Kind: "syscall-args", Pattern: regexp.MustCompile(`not enough arguments in call to syscall\.(\w+)`)},
+	}
+
+	err := ClassifyTypeError(types.Error{Msg: "not enough arguments in call to syscall.Syscall6"}, classifiers)
+	if reason, ok := err.Reason.(TCClassified); !ok || reason.Kind != "syscall-args" || len(reason.Match) != 1 || reason.Match[0] != "Syscall6" {
+		t.Errorf("classified as %#v", err.Reason)
+	}
+
+	// Errors the classifiers don't recognize keep their built in kind
+	err = ClassifyTypeError(types.Error{Msg: "undefined: syscall.EBADF"}, classifiers)
+	if _, ok := err.Reason.(TCBadImportName); !ok {
+		t.Errorf("classified as %#v, want TCBadImportName", err.Reason)
+	}
+}
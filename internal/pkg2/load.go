@@ -5,12 +5,15 @@
 package pkg2
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"go/parser"
-	"go/token"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/zosopentools/wharf/internal/base"
@@ -18,22 +21,105 @@ import (
 	"github.com/zosopentools/wharf/internal/util"
 )
 
-var debugPath string
-
-func lpanic(msg string) {
-	panic(fmt.Sprintf("%v: %v", debugPath, msg))
+// Panic about the package (or file) at path while loading it
+func lpanic(path string, msg string) {
+	panic(fmt.Sprintf("%v: %v", path, msg))
 }
 
-var cache map[string]*Package = make(map[string]*Package, 50)
-
 // Use go-list to load all packages and build the initial tree
 //
 // We load as many packages as we can at once - and pick up any "unimported" packages
 // (packages that were imported by source files not marked for build under the present system)
 // Any unimported packages we then go and load ourselves (and continue this process until all packages are loaded)
-func List(paths []string) (ImportTree, error) {
+func List(sess *base.Session, paths []string) (*ImportTree, error) {
+	tree := &ImportTree{
+		sess:         sess,
+		cache:        make(map[string]*Package, 50),
+		backupLookup: make(map[string]*Package),
+	}
+
+	matching, err := tree.list(paths, false)
+	if err != nil {
+		return nil, err
+	}
+	tree.from = matching
+	return tree, nil
+}
+
+// Reload the packages of modules whose version changed, instead of listing the whole tree again
+//
+// Only the packages of the modules that are imported from outside of them are listed again
+// (along with their dependencies), everything else keeps what it loaded. Packages that changed
+// get marked dirty as usual, the tree has to be resolved again afterwards.
+func (tree *ImportTree) Reload(modules []string) error {
+	changed := make(map[string]bool, len(modules))
+	for _, mod := range modules {
+		changed[mod] = true
+	}
+
+	moduleOf := func(pkg *Package) string {
+		if pkg.Meta.Module == nil {
+			return ""
+		}
+		return pkg.Meta.Module.Path
+	}
+
+	entries := make(map[string]bool)
+	for _, group := range tree.groups {
+		for _, pkg := range group {
+			// Reset as if the package was listed again without changes
+			pkg.FirstLoad = false
+			pkg.Dirty = false
+			pkg.DepDirty = false
+			pkg.Modified = pkg.modified
+			pkg.modified = false
+
+			for _, ipkg := range pkg.Imports {
+				if mod := moduleOf(ipkg); changed[mod] && mod != moduleOf(pkg) {
+					entries[ipkg.Meta.ImportPath] = true
+				}
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	_, err := tree.list(paths, true)
+	tree.resolved = false
+	return err
+}
+
+// List every package of the tree again (when it is unknown which modules changed)
+//
+// Packages keep their state, only the ones whose directory changed are loaded again.
+func (tree *ImportTree) ReloadAll() error {
+	paths := make([]string, 0, len(tree.from))
+	for _, pkg := range tree.from {
+		paths = append(paths, pkg.Meta.ImportPath)
+	}
+
+	matching, err := tree.list(paths, false)
+	if err != nil {
+		return err
+	}
+	tree.from = matching
+	tree.resolved = false
+	return nil
+}
+
+// Load the packages (and their dependencies) using go-list, returns the packages that were matched directly
+//
+// When reloading the packages have been loaded before, so they are never treated as targets
+func (tree *ImportTree) list(paths []string, reload bool) ([]*Package, error) {
 	// fmt.Fprintf(os.Stderr, "\n#### LOAD #### \n\n")
-	found := make(map[string]*Package, len(cache))
+	found := make(map[string]*Package, len(tree.cache))
 	seeking := make(map[string]bool, 10)
 
 	next := paths
@@ -41,19 +127,19 @@ func List(paths []string) (ImportTree, error) {
 	matching := make([]*Package, 0, len(paths))
 
 	identify := func(path string) *Package {
-		pkg := cache[path]
+		pkg := tree.cache[path]
 		if pkg == nil {
 			// fmt.Fprintln(os.Stderr, path)
-			pkg = &Package{}
-			cache[path] = pkg
+			pkg = &Package{tree: tree}
+			tree.cache[path] = pkg
 		}
 		return pkg
 	}
 
 	for len(next) > 0 {
-		listout, err := util.GoList(next)
+		listout, err := util.GoList(tree.sess.Env, next)
 		if err != nil {
-			return ImportTree{}, err
+			return nil, err
 		}
 
 		var metaPkgs []*MetaPackage
@@ -68,17 +154,16 @@ func List(paths []string) (ImportTree, error) {
 		}
 
 		if len(metaPkgs) == 0 {
-			return ImportTree{}, fmt.Errorf("no packages found in the workspace")
+			return nil, fmt.Errorf("no packages found in the workspace")
 		}
 
 		for _, meta := range metaPkgs {
-			debugPath = meta.ImportPath
 			if seeking[meta.ImportPath] {
 				delete(seeking, meta.ImportPath)
 			}
 			if found[meta.ImportPath] != nil {
 				if !meta.DepOnly {
-					lpanic("loaded a package more than once in the same pass")
+					lpanic(meta.ImportPath, "loaded a package more than once in the same pass")
 				}
 				continue
 			}
@@ -88,14 +173,19 @@ func List(paths []string) (ImportTree, error) {
 			doLoad := pkg.FirstLoad || pkg.Meta.Dir != meta.Dir
 			pkg.Dirty = doLoad
 			pkg.Meta = meta
-			pkg.Included = firstLoad
+			if reload {
+				// New dependencies of the reloaded packages are part of the build too
+				pkg.Included = pkg.Included || (firstLoad && pkg.FirstLoad)
+			} else {
+				pkg.Included = firstLoad
+			}
 			pkg.Modified = pkg.modified
 			pkg.modified = false
 			pkg.DepDirty = false
 
-			if firstLoad && !meta.DepOnly {
+			if firstLoad && !reload && !meta.DepOnly {
 				if meta.Module == nil || !meta.Module.Main {
-					return ImportTree{}, fmt.Errorf("%v: target package must be included in Main module", meta.ImportPath)
+					return nil, fmt.Errorf("%v: target package must be included in Main module", meta.ImportPath)
 				}
 				matching = append(matching, pkg)
 			}
@@ -110,7 +200,7 @@ func List(paths []string) (ImportTree, error) {
 						meta.Name = tags.FindPackageName(meta.Dir, meta.IgnoredGoFiles)
 					}
 				} else {
-					return ImportTree{}, fmt.Errorf("unable to load %v: %v", meta.ImportPath, meta.Error.Err)
+					return nil, fmt.Errorf("unable to load %v: %v", meta.ImportPath, meta.Error.Err)
 				}
 			}
 
@@ -118,8 +208,8 @@ func List(paths []string) (ImportTree, error) {
 			// Go uses different directories for different module versions
 			if doLoad {
 				// fmt.Fprintf(os.Stderr, "\n# %v\n", pkg.Meta.ImportPath)
-				if err = loadPkg(pkg); err != nil {
-					return ImportTree{}, err
+				if err = tree.loadPkg(pkg); err != nil {
+					return nil, err
 				}
 
 				// Register all imported packages (and do sanity check on packages that go-list reported)
@@ -170,12 +260,12 @@ func List(paths []string) (ImportTree, error) {
 				}
 
 				if iCount != len(pkg.Meta.Imports) {
-					lpanic(fmt.Sprintf("parsed imports and go-list imports length mismatch: found %v wanted %v", iCount, len(pkg.Meta.Imports)))
+					lpanic(meta.ImportPath, fmt.Sprintf("parsed imports and go-list imports length mismatch: found %v wanted %v", iCount, len(pkg.Meta.Imports)))
 				}
 
 				for _, iPath := range pkg.Meta.Imports {
 					if !touchedIPaths[iPath] {
-						lpanic(fmt.Sprintf("parsed imports list missing go-list entry: %v", iPath))
+						lpanic(meta.ImportPath, fmt.Sprintf("parsed imports list missing go-list entry: %v", iPath))
 					}
 				}
 			}
@@ -189,6 +279,13 @@ func List(paths []string) (ImportTree, error) {
 					seeking[iPath] = true
 				}
 			}
+
+			// Packages templates may add to its files are loaded with it, so they are ready once it gets patched
+			for _, iPath := range tree.templateImports(pkg) {
+				if found[iPath] == nil {
+					seeking[iPath] = true
+				}
+			}
 		}
 
 		firstLoad = false
@@ -198,20 +295,50 @@ func List(paths []string) (ImportTree, error) {
 		}
 	}
 
-	return ImportTree{from: matching}, nil
+	return matching, nil
+}
+
+// Find compiler export data for frozen packages that need their types (re)loaded
+//
+// Packages that fail to compile (or if go list fails altogether) are left without export data,
+// they are type checked from source instead.
+func (tree *ImportTree) LoadExports() {
+	paths := make([]string, 0, 64)
+	pkgs := make(map[string]*Package, 64)
+	for _, group := range tree.Groups() {
+		for _, pkg := range group {
+			if IsFrozenPkg(pkg) && (pkg.Dirty || pkg.DepDirty) && pkg.Meta.Export == "" {
+				paths = append(paths, pkg.Meta.ImportPath)
+				pkgs[pkg.Meta.ImportPath] = pkg
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	exports, err := util.GoListExport(tree.sess.Env, paths)
+	if err != nil {
+		return
+	}
+	for path, file := range exports {
+		if pkg := pkgs[path]; pkg != nil {
+			pkg.Meta.Export = file
+		}
+	}
 }
 
-func loadPkg(pkg *Package) error {
+func (tree *ImportTree) loadPkg(pkg *Package) error {
 	var debugFile string
 	fpanic := func(msg string) {
-		lpanic(fmt.Sprintf("%v: %v", debugFile, msg))
+		lpanic(pkg.Meta.ImportPath, fmt.Sprintf("%v: %v", debugFile, msg))
 	}
 	pkg.Builds = make([]BuildConfig, 0, 2)
 	pkg.Files = make(map[string]*GoFile, len(pkg.Meta.GoFiles)+len(pkg.Meta.CgoFiles)+len(pkg.Meta.IgnoredGoFiles))
 	pkg.Imports = make(map[string]*Package, len(pkg.Meta.Imports))
 
-	if b := backupLookupMap[pkg.Meta.Name]; b == nil {
-		backupLookupMap[pkg.Meta.Name] = pkg
+	if b := tree.backupLookup[pkg.Meta.Name]; b == nil {
+		tree.backupLookup[pkg.Meta.Name] = pkg
 	}
 
 	// TODO: return errors from loading new files and invalidate the build configs
@@ -220,33 +347,40 @@ func loadPkg(pkg *Package) error {
 
 	platforms := make(
 		map[string]*struct {
-			hash  uint64
+			mask  fileMask
 			files []*GoFile
 		},
 		len(tags.UNIX_PLATFORM_RANKING),
 	)
 
-	// Collapse configs down using hashes and register new ones
-	hashes := make(map[uint64]int, len(tags.UNIX_PLATFORM_RANKING)+1)
-	nextHash := uint64(1)
-	hashCheck := 0
-
-	getHash := func() uint64 {
-		hashCheck += 1
-		if hashCheck >= 64 {
-			lpanic("too many hashes")
+	// Collapse configs down using the set of platform specific files each one builds
+	configs := make(map[string]int, len(tags.UNIX_PLATFORM_RANKING)+1)
+	nextFile := 0
+
+	addPlatformFile := func(file *GoFile, cnstr tags.Platforms) int {
+		idx := nextFile
+		nextFile++
+		for tag := range cnstr {
+			if platforms[tag] == nil {
+				platforms[tag] = new(struct {
+					mask  fileMask
+					files []*GoFile
+				})
+			}
+			platforms[tag].files = append(platforms[tag].files, file)
+			platforms[tag].mask.add(idx)
 		}
-
-		hash := nextHash
-		nextHash = nextHash << 1
-
-		return hash
+		return idx
 	}
 
 	pkg.Builds = append(pkg.Builds, BuildConfig{})
-	defaultHash := uint64(0)
+	var defaultMask fileMask
 
+	// Files are only parsed fully once they get type checked, which never happens for packages
+	// whose types are found in the type cache (files that didn't change aren't even read, see dirMeta)
 	isStd := IsStdlibPkg(pkg)
+	meta := tree.loadDirMeta(pkg.Meta.Dir)
+	defer meta.store()
 
 	// Read normal go files that are built
 	for _, fname := range pkg.Meta.GoFiles {
@@ -257,7 +391,7 @@ func loadPkg(pkg *Package) error {
 			Default: true,
 		}
 		pkg.Files[fname] = file
-		if err := loadGoFile(file, FileSet, true, isStd); err != nil {
+		if err := loadGoFile(tree.sess, file, isStd, meta); err != nil {
 			return err
 		}
 
@@ -266,7 +400,6 @@ func loadPkg(pkg *Package) error {
 		}
 
 		pkg.Builds[0].Files = append(pkg.Builds[0].Files, file)
-		pkg.Builds[0].Syntax = append(pkg.Builds[0].Syntax, file.Syntax)
 
 		// Don't check tags for GOROOT packages (see https://github.com/ZOSOpenTools/wharf/issues/7)
 		if isStd {
@@ -280,18 +413,7 @@ func loadPkg(pkg *Package) error {
 		case tags.Supported:
 			alwaysBuild = append(alwaysBuild, file)
 		case tags.Platforms:
-			hash := getHash()
-			defaultHash += hash
-			for tag := range cnstr {
-				if platforms[tag] == nil {
-					platforms[tag] = new(struct {
-						hash  uint64
-						files []*GoFile
-					})
-				}
-				platforms[tag].files = append(platforms[tag].files, file)
-				platforms[tag].hash += hash
-			}
+			defaultMask.add(addPlatformFile(file, cnstr))
 		case tags.Ignored:
 			fpanic("build never constraint found for actively built go file")
 		default:
@@ -308,7 +430,7 @@ func loadPkg(pkg *Package) error {
 			Default: true,
 		}
 		pkg.Files[fname] = file
-		if err := loadGoFile(file, FileSet, true, isStd); err != nil {
+		if err := loadGoFile(tree.sess, file, isStd, meta); err != nil {
 			return err
 		}
 
@@ -317,7 +439,6 @@ func loadPkg(pkg *Package) error {
 		}
 
 		pkg.Builds[0].Files = append(pkg.Builds[0].Files, file)
-		pkg.Builds[0].Syntax = append(pkg.Builds[0].Syntax, file.Syntax)
 
 		// Don't check tags for GOROOT packages (see https://github.com/ZOSOpenTools/wharf/issues/7)
 		if isStd {
@@ -331,18 +452,7 @@ func loadPkg(pkg *Package) error {
 		case tags.Supported:
 			alwaysBuild = append(alwaysBuild, file)
 		case tags.Platforms:
-			hash := getHash()
-			defaultHash += hash
-			for tag := range cnstr {
-				if platforms[tag] == nil {
-					platforms[tag] = new(struct {
-						hash  uint64
-						files []*GoFile
-					})
-				}
-				platforms[tag].files = append(platforms[tag].files, file)
-				platforms[tag].hash += hash
-			}
+			defaultMask.add(addPlatformFile(file, cnstr))
 		case tags.Ignored:
 			fpanic("build never constraint found for actively built cgo file")
 		default:
@@ -358,7 +468,7 @@ func loadPkg(pkg *Package) error {
 				Path: filepath.Join(pkg.Meta.Dir, fname),
 			}
 			pkg.Files[fname] = file
-			if err := loadGoFile(file, FileSet, false, false); err != nil {
+			if err := loadGoFile(tree.sess, file, false, meta); err != nil {
 				return err
 			}
 
@@ -368,17 +478,7 @@ func loadPkg(pkg *Package) error {
 			case tags.Supported:
 				fpanic("build for GOOS constraint found for ignored file")
 			case tags.Platforms:
-				hash := getHash()
-				for tag := range cnstr {
-					if platforms[tag] == nil {
-						platforms[tag] = new(struct {
-							hash  uint64
-							files []*GoFile
-						})
-					}
-					platforms[tag].files = append(platforms[tag].files, file)
-					platforms[tag].hash += hash
-				}
+				addPlatformFile(file, cnstr)
 			case tags.Ignored:
 				continue
 			default:
@@ -387,20 +487,21 @@ func loadPkg(pkg *Package) error {
 		}
 
 		// Build the actual builds list
-		hashes[defaultHash] = 0
+		configs[defaultMask.key()] = 0
 		for _, pltf := range tags.UNIX_PLATFORM_RANKING {
 			if platforms[pltf] == nil {
 				continue
 			}
 
-			cfgidx, ok := hashes[platforms[pltf].hash]
+			key := platforms[pltf].mask.key()
+			cfgidx, ok := configs[key]
 			if !ok {
 				pkg.Builds = append(pkg.Builds, BuildConfig{
 					Platforms: []string{pltf},
 					Files:     append(platforms[pltf].files, alwaysBuild...),
 				})
 
-				hashes[platforms[pltf].hash] = len(pkg.Builds) - 1
+				configs[key] = len(pkg.Builds) - 1
 			} else {
 				pkg.Builds[cfgidx].Platforms = append(pkg.Builds[cfgidx].Platforms, pltf)
 			}
@@ -408,34 +509,68 @@ func loadPkg(pkg *Package) error {
 
 	}
 
+	pkg.PlatformBuilds = len(pkg.Builds)
 	return nil
 }
 
-func loadGoFile(file *GoFile, fset *token.FileSet, syntax bool, forceLoad bool) error {
+// Mask of platform specific files (identified by the order they were loaded in)
+//
+// Used to detect platforms that would build the exact same set of files,
+// there is no limit on the number of files a set can hold
+type fileMask []uint64
+
+func (set *fileMask) add(idx int) {
+	word := idx / 64
+	for len(*set) <= word {
+		*set = append(*set, 0)
+	}
+	(*set)[word] |= 1 << (idx % 64)
+}
+
+// Key that uniquely identifies the set of files, identical sets produce identical keys
+func (set fileMask) key() string {
+	// Trailing empty words do not change membership, so drop them
+	for len(set) > 0 && set[len(set)-1] == 0 {
+		set = set[:len(set)-1]
+	}
+
+	var sb strings.Builder
+	for _, word := range set {
+		sb.WriteString(strconv.FormatUint(word, 16))
+		sb.WriteByte('.')
+	}
+	return sb.String()
+}
+
+// Load the build constraint, digest and imports of a file (ignored files only have their imports loaded if forced)
+//
+// Only the imports are parsed, the full syntax is loaded when it is needed (see GoFile.LoadSyntax)
+func loadGoFile(sess *base.Session, file *GoFile, forceLoad bool, meta *dirMeta) error {
+	file.Fset = sess.FileSet
+	info, _ := os.Stat(file.Path)
+	if meta.fill(file, info, forceLoad) {
+		return nil
+	}
+
 	src, err := os.ReadFile(file.Path)
 	if err != nil {
 		return err
 	}
 
-	file.Tags = tags.Parse(file.Name, src, base.GOOS(), base.BuildTags)
+	sum := sha256.Sum256(src)
+	file.digest = hex.EncodeToString(sum[:])
+
+	file.Tags = tags.Parse(file.Name, src, sess.GOOS(), sess.BuildTags)
 	if _, ok := file.Tags.(tags.Ignored); ok && !forceLoad {
+		meta.record(file, info)
 		return nil
 	}
 
-	mode := (parser.Mode)(0)
-	if !syntax {
-		mode = parser.ImportsOnly
-	}
-
-	parsed, err := parser.ParseFile(fset, file.Name, src, mode)
+	parsed, err := parser.ParseFile(sess.FileSet, file.Name, src, parser.ImportsOnly)
 	if err != nil {
 		return err
 	}
 
-	if syntax {
-		file.Syntax = parsed
-	}
-
 	altNames := make(map[string]string)
 	file.Imports = make(map[string]string, len(parsed.Imports))
 	for _, isyn := range parsed.Imports {
@@ -471,10 +606,11 @@ func loadGoFile(file *GoFile, fset *token.FileSet, syntax bool, forceLoad bool)
 			}
 		}
 		if file.Imports[name] != "" {
-			lpanic(fmt.Sprintf("%v: duplicate import name %v: (%v, %v)", file.Name, name, file.Imports[name], ipath))
+			lpanic(file.Path, fmt.Sprintf("duplicate import name %v: (%v, %v)", name, file.Imports[name], ipath))
 		}
 		file.Imports[name] = ipath
 	}
 
+	meta.record(file, info)
 	return nil
 }
@@ -0,0 +1,53 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package pkg2
+
+import (
+	"testing"
+)
+
+func TestFileMaskManyFiles(t *testing.T) {
+	var left, right fileMask
+
+	// Well past the 64 files a single word can track
+	for idx := 0; idx < 500; idx += 3 {
+		left.add(idx)
+	}
+	for idx := 498; idx >= 0; idx -= 3 {
+		right.add(idx)
+	}
+
+	if left.key() != right.key() {
+		t.Errorf("identical file masks produced different keys: %v != %v", left.key(), right.key())
+		return
+	}
+
+	right.add(499)
+	if left.key() == right.key() {
+		t.Errorf("different file masks produced the same key: %v", left.key())
+		return
+	}
+}
+
+func TestFileMaskTrailingWords(t *testing.T) {
+	var left, right fileMask
+
+	left.add(3)
+	right.add(3)
+
+	// Grow the set without adding any new members past the first word
+	right = append(right, 0, 0)
+
+	if left.key() != right.key() {
+		t.Errorf("empty trailing words changed the key: %v != %v", left.key(), right.key())
+		return
+	}
+
+	var empty fileMask
+	if empty.key() != (fileMask{0, 0}).key() {
+		t.Errorf("empty file masks produced different keys")
+		return
+	}
+}
@@ -0,0 +1,201 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package pkg2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/zosopentools/wharf/internal/tags"
+)
+
+// Bump whenever the key or the stored format changes
+const metaCacheVersion = "wharf-meta-1"
+
+// Entries are only marked as used once per interval (the type cache is trimmed by how long ago they were used)
+const metaUsedInterval = time.Hour
+
+// What loading a file found out about it, persisted between runs
+//
+// An entry is only used again while the size and modification time of the file are the same
+type fileMeta struct {
+	Size    int64
+	ModTime int64
+	Digest  string
+
+	// Build constraint of the file (all, supported, ignored or platforms)
+	Tags      string
+	Platforms map[string]bool `json:",omitempty"`
+
+	// Whether the imports were parsed, they are not for ignored files unless they are built anyway
+	Parsed      bool
+	Imports     map[string]string `json:",omitempty"`
+	AnonImports []string          `json:",omitempty"`
+	Cgo         bool              `json:",omitempty"`
+}
+
+// Metadata of the files of a package directory, stored in the type cache directory (see base.Session.TypeCache)
+//
+// The key covers the toolchain, the target platform and build tags (the constraints of files depend on them)
+// and the directory, files are told apart by name. A nil dirMeta caches nothing.
+type dirMeta struct {
+	path  string
+	files map[string]*fileMeta
+	dirty bool
+}
+
+// Load the metadata stored for the files of the directory (nil if the type cache is disabled)
+func (tree *ImportTree) loadDirMeta(dir string) *dirMeta {
+	sess := tree.sess
+	if sess == nil || sess.TypeCache == "" {
+		return nil
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\n%v %v\n", metaCacheVersion, sess.GoEnv("GOVERSION"), sess.GoEnv("GOROOT"))
+	fmt.Fprintf(h, "%v/%v\n", sess.GOOS(), sess.GOARCH())
+
+	btags := make([]string, 0, len(sess.BuildTags))
+	for tag, set := range sess.BuildTags {
+		if set {
+			btags = append(btags, tag)
+		}
+	}
+	sort.Strings(btags)
+	fmt.Fprintf(h, "tags=%v\n", btags)
+	fmt.Fprintf(h, "dir %v\n", dir)
+
+	key := hex.EncodeToString(h.Sum(nil))
+	meta := &dirMeta{
+		path:  filepath.Join(sess.TypeCache, key[:2], key),
+		files: make(map[string]*fileMeta),
+	}
+
+	data, err := os.ReadFile(meta.path)
+	if err != nil {
+		return meta
+	}
+	if err := json.Unmarshal(data, &meta.files); err != nil {
+		meta.files = make(map[string]*fileMeta)
+		return meta
+	}
+
+	// Keep entries that are still in use from being trimmed
+	if info, err := os.Stat(meta.path); err == nil && time.Since(info.ModTime()) > metaUsedInterval {
+		now := time.Now()
+		os.Chtimes(meta.path, now, now)
+	}
+	return meta
+}
+
+// Fill in the file from its stored metadata, returns false if there is none or the file changed since
+//
+// Ignored files have their imports parsed only if force is set
+func (meta *dirMeta) fill(file *GoFile, info os.FileInfo, force bool) bool {
+	if meta == nil || info == nil {
+		return false
+	}
+
+	fm := meta.files[file.Name]
+	if fm == nil || fm.Size != info.Size() || fm.ModTime != info.ModTime().UnixNano() {
+		return false
+	}
+
+	var cnstr tags.Constraint
+	switch fm.Tags {
+	case "all":
+		cnstr = tags.All{}
+	case "supported":
+		cnstr = tags.Supported{}
+	case "ignored":
+		cnstr = tags.Ignored{}
+	case "platforms":
+		cnstr = tags.Platforms(fm.Platforms)
+	default:
+		return false
+	}
+	if !fm.Parsed && (force || fm.Tags != "ignored") {
+		return false
+	}
+
+	file.digest = fm.Digest
+	file.Tags = cnstr
+	file.Imports = fm.Imports
+	file.AnonImports = fm.AnonImports
+	file.Cgo = fm.Cgo
+	if fm.Parsed && file.Imports == nil {
+		file.Imports = make(map[string]string)
+	}
+	return true
+}
+
+// Record the metadata of a file that was loaded from its source
+func (meta *dirMeta) record(file *GoFile, info os.FileInfo) {
+	if meta == nil || info == nil {
+		return
+	}
+
+	fm := &fileMeta{
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+		Digest:      file.digest,
+		Parsed:      file.Imports != nil,
+		Imports:     file.Imports,
+		AnonImports: file.AnonImports,
+		Cgo:         file.Cgo,
+	}
+	switch cnstr := file.Tags.(type) {
+	case tags.All:
+		fm.Tags = "all"
+	case tags.Supported:
+		fm.Tags = "supported"
+	case tags.Ignored:
+		fm.Tags = "ignored"
+	case tags.Platforms:
+		fm.Tags, fm.Platforms = "platforms", cnstr
+	default:
+		return
+	}
+
+	meta.files[file.Name] = fm
+	meta.dirty = true
+}
+
+// Store the metadata if anything was recorded, failures only mean the files are read again next time
+func (meta *dirMeta) store() {
+	if meta == nil || !meta.dirty {
+		return
+	}
+
+	data, err := json.Marshal(meta.files)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(meta.path), 0755); err != nil {
+		return
+	}
+
+	// Write to a temporary file first so concurrent runs never see partial data
+	tmp, err := os.CreateTemp(filepath.Dir(meta.path), filepath.Base(meta.path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	os.Rename(tmp.Name(), meta.path)
+}
@@ -0,0 +1,83 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package pkg2
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zosopentools/wharf/internal/tags"
+)
+
+func TestDirMetaReusedUntilFileChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a_linux.go")
+	if err := os.WriteFile(path, []byte("package a\n\nimport \"os\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ignored := filepath.Join(dir, "b.go")
+	if err := os.WriteFile(ignored, []byte("//go:build ignore\n\npackage a\n\nimport \"io\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sess := testSession(t)
+	sess.TypeCache = t.TempDir()
+	load := func(name string, force bool) *GoFile {
+		// Every load starts with a fresh tree, like a new invocation of wharf
+		meta := (&ImportTree{sess: sess}).loadDirMeta(dir)
+		defer meta.store()
+
+		file := &GoFile{Name: name, Path: filepath.Join(dir, name)}
+		if err := loadGoFile(sess, file, force, meta); err != nil {
+			t.Fatalf("unable to load %v: %v", name, err)
+		}
+		return file
+	}
+
+	first := load("a_linux.go", false)
+	if first.Imports["os"] != "os" || first.digest == "" {
+		t.Fatalf("got imports %v and digest %q", first.Imports, first.digest)
+	}
+	if _, ok := first.Tags.(tags.Platforms); !ok {
+		t.Errorf("got constraint %#v", first.Tags)
+	}
+
+	// Contents that change without changing the size or modification time are not noticed,
+	// so this only passes if the file is not read again
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("package a\n\nimport \"io\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if cached := load("a_linux.go", false); cached.Imports["os"] != "os" || cached.digest != first.digest || cached.Fset != sess.FileSet {
+		t.Errorf("metadata was not reused: imports %v, digest %q", cached.Imports, cached.digest)
+	}
+
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if changed := load("a_linux.go", false); changed.Imports["io"] != "io" || changed.digest == first.digest {
+		t.Errorf("changed file was not read again: imports %v", changed.Imports)
+	}
+
+	// The imports of ignored files are only loaded when forced, even if the file was seen before
+	if skipped := load("b.go", false); skipped.Imports != nil {
+		t.Errorf("imports of an ignored file were loaded: %v", skipped.Imports)
+	}
+	if forced := load("b.go", true); forced.Imports["io"] != "io" {
+		t.Errorf("forced load of an ignored file got imports %v", forced.Imports)
+	}
+	if again := load("b.go", true); again.Imports["io"] != "io" {
+		t.Errorf("forced load of an ignored file from the cache got imports %v", again.Imports)
+	}
+}
@@ -5,46 +5,60 @@
 package pkg2
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"go/ast"
 	"go/parser"
 	"go/token"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/zosopentools/wharf/internal/base"
 	"github.com/zosopentools/wharf/internal/tags"
 )
 
 const CGO_PACKAGE_NAME = "C"
 const UNSAFE_PACKAGE_NAME = "unsafe"
-const GOLANGX_PATH_PREFIX = "golang.org/x/"
-
-var FileSet = token.NewFileSet()
-
-var backupLookupMap = make(map[string]*Package)
+const GOLANGX_PATH_PREFIX = base.GOLANGX_PATH_PREFIX
 
 // Go list error for when no files in a package are built
 var _BUILD_CONSTRAINTS_EXCLUDE_ALL_FILE = regexp.MustCompile(`build constraints exclude all Go files in ([a-zA-Z0-9_/@.]+)`)
 
 // Package is a golang.org/x/... package
 func IsGolangXPkg(pkg *Package) bool {
-	return pkg.Meta.Module != nil && strings.HasPrefix(pkg.Meta.Module.Path, "golang.org/x/")
+	return pkg.Meta.Module != nil && strings.HasPrefix(pkg.Meta.Module.Path, GOLANGX_PATH_PREFIX)
+}
+
+// Package is a golang.org/x/... package that is only pinned, not ported (unless the session opts in)
+func isPinOnlyPkg(pkg *Package) bool {
+	return IsGolangXPkg(pkg) && (pkg.tree == nil || !pkg.tree.sess.PortsGolangX(pkg.Meta.Module.Path))
 }
 
 func IsStdlibPkg(pkg *Package) bool {
-	return pkg.Meta.Goroot || pkg.Meta.Standard || IsGolangXPkg(pkg)
+	return pkg.Meta.Goroot || pkg.Meta.Standard || isPinOnlyPkg(pkg)
+}
+
+// Package is never ported (GOROOT and pinned golang.org/x/... packages)
+func IsFrozenPkg(pkg *Package) bool {
+	return pkg.Meta.Goroot || pkg.Meta.Standard || (isPinOnlyPkg(pkg) && pkg.Meta.Module.Replace != nil)
 }
 
 func IsExcludeGoListError(errMessage string) bool {
 	return _BUILD_CONSTRAINTS_EXCLUDE_ALL_FILE.MatchString(errMessage)
 }
 
-func BackupNameLookup(name string) *Package {
-	return backupLookupMap[name]
+// Package loaded into the same tree that goes by the given name (the first one loaded wins)
+func (pkg *Package) BackupNameLookup(name string) *Package {
+	if pkg.tree == nil {
+		return nil
+	}
+	return pkg.tree.backupLookup[name]
 }
 
 func ImportPathToAssumedName(importPath string) (string, string) {
@@ -74,9 +88,16 @@ func notIdentifier(ch rune) bool {
 }
 
 type ImportTree struct {
+	sess     *base.Session
 	resolved bool
 	from     []*Package
 	groups   [][]*Package
+
+	// Every package loaded into the tree (keyed by import path)
+	cache map[string]*Package
+
+	// First package loaded for each package name
+	backupLookup map[string]*Package
 }
 
 func (tree *ImportTree) Groups() [][]*Package {
@@ -95,14 +116,24 @@ func (tree *ImportTree) Groups() [][]*Package {
 func (tree *ImportTree) Resolve() error {
 	layers := make([][]*Package, 0, 30)
 	layers = append(layers, make([]*Package, 0))
-	visited := make(map[string]bool, len(cache))
+	visited := make(map[string]bool, len(tree.cache))
 
-	var visit func(pkg *Package) (int, error)
-	visit = func(pkg *Package) (int, error) {
+	// Packages on the path of the search, and which of them were reached through a template import
+	stack := make([]*Package, 0, 30)
+	viaTemplate := make(map[*Package]bool)
+
+	var visit func(pkg *Package, template bool) (int, error)
+	visit = func(pkg *Package, template bool) (int, error) {
 		// Handle cases where we have visited the node already
 		if done, checked := visited[pkg.Meta.ImportPath]; done {
 			return pkg.level, nil
 		} else if checked {
+			// Template imports are only added where they don't cause a cycle, drop the last one on it
+			for idx := len(stack) - 1; stack[idx] != pkg; idx-- {
+				if viaTemplate[stack[idx]] {
+					return -1, &templateCycleError{pkg: stack[idx]}
+				}
+			}
 			return -1, &importCycleError{
 				stack: []string{
 					pkg.Meta.ImportPath,
@@ -112,20 +143,34 @@ func (tree *ImportTree) Resolve() error {
 
 		// Mark so that if we see it again, we know we have a cycle
 		visited[pkg.Meta.ImportPath] = false
+		stack = append(stack, pkg)
+		viaTemplate[pkg] = template
+
+		// Forget the package if the search is unwound past it, it is searched again from elsewhere
+		unwind := func(err error) (int, error) {
+			delete(visited, pkg.Meta.ImportPath)
+			stack = stack[:len(stack)-1]
+			return -1, err
+		}
 
 		level := 0
 
-		// Visit each import path
-		for _, ipkg := range pkg.Imports {
-			ipkg.Parents = append(ipkg.Parents, pkg)
+		// Visit each import path (in order so the search is deterministic)
+		ipaths := make([]string, 0, len(pkg.Imports))
+		for ipath := range pkg.Imports {
+			ipaths = append(ipaths, ipath)
+		}
+		sort.Strings(ipaths)
 
-			seenlevel, err := visit(ipkg)
+		for _, ipath := range ipaths {
+			ipkg := pkg.Imports[ipath]
+			seenlevel, err := visit(ipkg, false)
 			if err != nil {
 				// Create traceback for import cycles
 				if ice, ok := err.(*importCycleError); ok {
 					ice.stack = append(ice.stack, pkg.Meta.ImportPath)
 				}
-				return -1, err
+				return unwind(err)
 			}
 
 			pkg.DepDirty = pkg.DepDirty || ipkg.DepDirty || ipkg.Dirty || ipkg.Modified
@@ -135,6 +180,34 @@ func (tree *ImportTree) Resolve() error {
 			}
 		}
 
+		// Packages templates may add to its files come before it too, unless they depend on it
+		pkg.TemplateImports = nil
+		for _, ipath := range tree.templateImports(pkg) {
+			tpkg := tree.cache[ipath]
+			if tpkg == nil || tpkg.Meta == nil || pkg.Imports[ipath] != nil {
+				continue
+			}
+
+			seenlevel, err := visit(tpkg, true)
+			if tce, ok := err.(*templateCycleError); ok && tce.pkg == tpkg {
+				continue
+			} else if err != nil {
+				if ice, ok := err.(*importCycleError); ok {
+					ice.stack = append(ice.stack, pkg.Meta.ImportPath)
+				}
+				return unwind(err)
+			}
+
+			if pkg.TemplateImports == nil {
+				pkg.TemplateImports = make(map[string]*Package)
+			}
+			pkg.TemplateImports[ipath] = tpkg
+			if seenlevel >= level {
+				level = seenlevel + 1
+			}
+		}
+		stack = stack[:len(stack)-1]
+
 		// We now have a known level, so we attach the import layer
 		for len(layers) <= level {
 			layers = append(layers, make([]*Package, 0))
@@ -155,13 +228,41 @@ func (tree *ImportTree) Resolve() error {
 			panic("package is marked visited when no DFS is currently being performed")
 		} else {
 			// DFS on this node
-			_, err := visit(pkg)
+			_, err := visit(pkg, false)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	// Layers are processed concurrently, keep their order independent of the search
+	for _, layer := range layers {
+		sort.Slice(layer, func(i, j int) bool {
+			return layer[i].Meta.ImportPath < layer[j].Meta.ImportPath
+		})
+	}
+
+	// Drop the parents found by an earlier resolve, then list the parents in the order of the layers
+	for _, layer := range layers {
+		for _, pkg := range layer {
+			pkg.Parents = pkg.Parents[:0]
+		}
+	}
+	for _, layer := range layers {
+		for _, pkg := range layer {
+			for _, ipkg := range pkg.Imports {
+				ipkg.Parents = append(ipkg.Parents, pkg)
+			}
+		}
+	}
+	for _, layer := range layers {
+		for _, pkg := range layer {
+			sort.Slice(pkg.Parents, func(i, j int) bool {
+				return pkg.Parents[i].Meta.ImportPath < pkg.Parents[j].Meta.ImportPath
+			})
+		}
+	}
+
 	tree.resolved = true
 	tree.groups = layers
 	return nil
@@ -174,6 +275,10 @@ type Package struct {
 	// Builds
 	Builds []BuildConfig
 
+	// Configs of the default environment and of whole platforms come first (Builds[:PlatformBuilds]),
+	// configs added while porting (mixed, borrowed, converted, patched) follow them
+	PlatformBuilds int
+
 	// Files
 	Files map[string]*GoFile
 
@@ -182,6 +287,10 @@ type Package struct {
 	// Imported packages
 	Imports map[string]*Package
 
+	// Packages the template directives of its imports may add to its files (keyed by import path),
+	// they are ordered before it but only become imports once a template is applied
+	TemplateImports map[string]*Package
+
 	// Whether or not the package would actually get built in the default environment
 	Included bool
 
@@ -205,6 +314,9 @@ type Package struct {
 
 	// Any errors that occurred during load
 	Errors []error
+
+	// Tree the package was loaded into
+	tree *ImportTree
 }
 
 func (pkg *Package) LoadSyntax(build int) error {
@@ -212,17 +324,8 @@ func (pkg *Package) LoadSyntax(build int) error {
 	// Make sure we have the syntax loaded
 	if cfg.Syntax == nil {
 		for _, gofile := range cfg.Files {
-			if gofile.Syntax == nil {
-				src, err := os.ReadFile(gofile.Path)
-				if err != nil {
-					return err
-				}
-
-				parsed, err := parser.ParseFile(FileSet, gofile.Name, src, 0)
-				if err != nil {
-					return err
-				}
-				gofile.Syntax = parsed
+			if err := gofile.LoadSyntax(); err != nil {
+				return err
 			}
 			cfg.Syntax = append(cfg.Syntax, gofile.Syntax)
 		}
@@ -230,17 +333,98 @@ func (pkg *Package) LoadSyntax(build int) error {
 	return nil
 }
 
+// Drop the syntax trees of the package to save memory, they are parsed again when needed
+//
+// Positions of anything computed from the old trees (such as type errors) no longer match the new ones,
+// so this should only be done once the package is not being worked on. The file set the trees
+// were parsed into keeps their line tables, parsing the files again adds new ones.
+func (pkg *Package) ReleaseSyntax() {
+	for idx := range pkg.Builds {
+		for _, gofile := range pkg.Builds[idx].Files {
+			gofile.Syntax = nil
+		}
+		pkg.Builds[idx].Syntax = nil
+	}
+	for _, gofile := range pkg.Files {
+		gofile.Syntax = nil
+	}
+}
+
+// Append a new build config made up of the given files
+//
+// Returns the index of the new config
+func (pkg *Package) AddBuild(platforms []string, files []*GoFile) (int, error) {
+	cfg := BuildConfig{
+		Platforms: platforms,
+		Files:     files,
+		Syntax:    make([]*ast.File, 0, len(files)),
+	}
+
+	for _, gofile := range files {
+		if err := gofile.LoadSyntax(); err != nil {
+			return -1, err
+		}
+		cfg.Syntax = append(cfg.Syntax, gofile.Syntax)
+	}
+
+	pkg.Builds = append(pkg.Builds, cfg)
+	return len(pkg.Builds) - 1, nil
+}
+
 func (pkg *Package) LookupImport(pkgName string, fileName string) *Package {
 	file := pkg.Files[fileName]
 	if file.Imports[pkgName] != "" {
 		return pkg.Imports[file.Imports[pkgName]]
-	} else if backup := BackupNameLookup(pkgName); backup != nil {
+	} else if backup := pkg.BackupNameLookup(pkgName); backup != nil {
 		return backup
 	} else {
 		return nil
 	}
 }
 
+// Packages the templates of directives for the package's imports add to its files (none for packages that are never ported)
+func (tree *ImportTree) templateImports(pkg *Package) []string {
+	if tree.sess == nil || IsStdlibPkg(pkg) {
+		return nil
+	}
+
+	var paths []string
+	for ipath := range pkg.Imports {
+		if mapped, ok := pkg.Meta.ImportMap[ipath]; ok {
+			ipath = mapped
+		}
+		for _, tpath := range tree.sess.TemplateImports(ipath) {
+			if tpath != pkg.Meta.ImportPath {
+				paths = append(paths, tpath)
+			}
+		}
+	}
+	return paths
+}
+
+// Whether the package imports (directly or not) a package of any of the given modules
+func (pkg *Package) DependsOn(modules map[string]bool) bool {
+	visited := make(map[*Package]bool)
+	var visit func(pkg *Package) bool
+	visit = func(pkg *Package) bool {
+		if visited[pkg] {
+			return false
+		}
+		visited[pkg] = true
+
+		for _, ipkg := range pkg.Imports {
+			if ipkg.Meta.Module != nil && modules[ipkg.Meta.Module.Path] {
+				return true
+			}
+			if visit(ipkg) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(pkg)
+}
+
 func (pkg *Package) MarkModified() {
 	pkg.modified = true
 }
@@ -271,6 +455,16 @@ type importCycleError struct {
 	stack []string
 }
 
+// Search reached a package it is already on the path of through the template import of pkg
+// (the template import is dropped, it never leaves Resolve)
+type templateCycleError struct {
+	pkg *Package
+}
+
+func (tce *templateCycleError) Error() string {
+	return "template import of " + tce.pkg.Meta.ImportPath + " causes an import cycle"
+}
+
 type BuildConfig struct {
 	Platforms []string
 	Files     []*GoFile
@@ -287,6 +481,122 @@ type GoFile struct {
 	Imports     map[string]string
 	AnonImports []string
 	Replaced    *ReplacedFile
+
+	// File set the syntax is parsed into
+	Fset *token.FileSet
+
+	// Cached set of top level declarations
+	decls map[string]bool
+
+	// Cached digest of the file contents
+	digest string
+}
+
+// Digest of the file contents, used to tell if type data computed in a previous run still applies
+func (gf *GoFile) Digest() (string, error) {
+	if gf.digest != "" {
+		return gf.digest, nil
+	}
+
+	src, err := os.ReadFile(gf.Path)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(src)
+	gf.digest = hex.EncodeToString(sum[:])
+	return gf.digest, nil
+}
+
+// Make sure the full syntax of the file is loaded
+//
+// Comments are left out, only files that get written out need them (see SyntaxWithComments)
+func (gf *GoFile) LoadSyntax() error {
+	if gf.Syntax != nil {
+		return nil
+	}
+
+	src, err := os.ReadFile(gf.Path)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parser.ParseFile(gf.Fset, gf.Name, src, 0)
+	if err != nil {
+		return err
+	}
+	gf.Syntax = parsed
+	return nil
+}
+
+// Parse the file again with its comments, for files that get written out
+//
+// The tree is not kept, positions in it don't match the ones computed from Syntax
+func (gf *GoFile) SyntaxWithComments() (*ast.File, error) {
+	src, err := os.ReadFile(gf.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parser.ParseFile(gf.Fset, gf.Name, src, parser.ParseComments)
+}
+
+// Top level declarations provided by the file
+//
+// Methods are reported as "Type.Method", files that can't be parsed declare nothing
+func (gf *GoFile) Declarations() map[string]bool {
+	if gf.decls != nil {
+		return gf.decls
+	}
+
+	gf.decls = make(map[string]bool)
+	if gf.LoadSyntax() != nil {
+		return gf.decls
+	}
+	for _, decl := range gf.Syntax.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil || len(decl.Recv.List) == 0 {
+				gf.decls[decl.Name.Name] = true
+			} else if recv := ReceiverName(decl.Recv.List[0].Type); recv != "" {
+				gf.decls[recv+"."+decl.Name.Name] = true
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					gf.decls[spec.Name.Name] = true
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						if name.Name != "_" {
+							gf.decls[name.Name] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return gf.decls
+}
+
+// Name of the type a method receiver belongs to
+func ReceiverName(expr ast.Expr) string {
+	for {
+		switch recv := expr.(type) {
+		case *ast.StarExpr:
+			expr = recv.X
+		case *ast.ParenExpr:
+			expr = recv.X
+		case *ast.IndexExpr:
+			expr = recv.X
+		case *ast.IndexListExpr:
+			expr = recv.X
+		case *ast.Ident:
+			return recv.Name
+		default:
+			return ""
+		}
+	}
 }
 
 func (gf *GoFile) String() string {
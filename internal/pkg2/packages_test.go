@@ -0,0 +1,207 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package pkg2
+
+import (
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+)
+
+// Session porting to zos/s390x with its own cache directory
+func testSession(t *testing.T) *base.Session {
+	sess := base.SessionFromEnv(map[string]string{"GOOS": "zos", "GOARCH": "s390x", "GOVERSION": "go1.20"})
+	sess.Cache = t.TempDir()
+	sess.TypeCache = ""
+	return sess
+}
+
+func testPackage(path string, module string, imports ...*Package) *Package {
+	pkg := &Package{
+		Meta:    &MetaPackage{ImportPath: path, Module: &Module{Path: module}},
+		Imports: make(map[string]*Package, len(imports)),
+	}
+	for _, ipkg := range imports {
+		pkg.Imports[ipkg.Meta.ImportPath] = ipkg
+	}
+	return pkg
+}
+
+func TestResolveTwiceKeepsParents(t *testing.T) {
+	leaf := testPackage("example.com/dep/leaf", "example.com/dep")
+	mid := testPackage("example.com/m/mid", "example.com/m", leaf)
+	top := testPackage("example.com/m", "example.com/m", mid, leaf)
+
+	tree := ImportTree{from: []*Package{top}}
+	for pass := 0; pass < 2; pass++ {
+		if err := tree.Resolve(); err != nil {
+			t.Fatalf("resolve failed: %v", err)
+		}
+	}
+
+	if len(leaf.Parents) != 2 {
+		t.Errorf("expected 2 parents of leaf after resolving twice, found %v", len(leaf.Parents))
+	}
+	if len(mid.Parents) != 1 || len(top.Parents) != 0 {
+		t.Errorf("unexpected parents: mid has %v, top has %v", len(mid.Parents), len(top.Parents))
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	leaf := testPackage("example.com/dep/leaf", "example.com/dep")
+	mid := testPackage("example.com/m/mid", "example.com/m", leaf)
+	top := testPackage("example.com/m", "example.com/m", mid)
+
+	if !top.DependsOn(map[string]bool{"example.com/dep": true}) {
+		t.Errorf("indirect dependency on example.com/dep not found")
+	}
+	if leaf.DependsOn(map[string]bool{"example.com/dep": true}) {
+		t.Errorf("package without imports should not depend on any module")
+	}
+	if top.DependsOn(map[string]bool{"example.com/other": true}) {
+		t.Errorf("found dependency on a module that is not imported")
+	}
+}
+
+func TestResolveTemplateImports(t *testing.T) {
+	sess := testSession(t)
+	sess.Inlines["syscall"] = &base.PackageInline{
+		Exports: map[string]base.ExportInline{
+			"Pipe2": {Type: base.InlineTemplateSym, Replace: "compat.Pipe2($0, $1)", Import: "example.com/compat"},
+		},
+	}
+
+	sys := testPackage("syscall", "")
+	sys.Meta.Standard = true
+	ospkg := testPackage("os", "", sys)
+	ospkg.Meta.Standard = true
+	// Imported by compat (through mid), the template cannot be applied to it
+	q := testPackage("example.com/q", "example.com/q", sys)
+	mid := testPackage("example.com/mid", "example.com/mid", q)
+	compat := testPackage("example.com/compat", "example.com/compat", mid)
+	top := testPackage("example.com/m", "example.com/m", ospkg, q)
+
+	tree := &ImportTree{sess: sess, from: []*Package{top}, cache: make(map[string]*Package)}
+	for _, pkg := range []*Package{sys, ospkg, q, mid, compat, top} {
+		pkg.tree = tree
+		tree.cache[pkg.Meta.ImportPath] = pkg
+	}
+
+	if err := tree.Resolve(); err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+
+	if q.TemplateImports["example.com/compat"] != nil {
+		t.Errorf("template import added to a package it depends on")
+	}
+	if ospkg.TemplateImports["example.com/compat"] != nil {
+		t.Errorf("template import added to a standard library package")
+	}
+	if top.TemplateImports["example.com/compat"] != nil {
+		t.Errorf("template import added to a package that doesn't import syscall")
+	}
+
+	// The template import is ordered before the packages it can be added to, without importing it
+	q.Imports = map[string]*Package{"syscall": sys}
+	compat.Imports = map[string]*Package{}
+	top.Imports["syscall"] = sys
+	if err := tree.Resolve(); err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	for _, pkg := range []*Package{q, top} {
+		if pkg.TemplateImports["example.com/compat"] != compat || compat.level >= pkg.level {
+			t.Errorf("%v: template import not ordered before it (levels %v and %v)", pkg, compat.level, pkg.level)
+		}
+		if pkg.Imports["example.com/compat"] != nil {
+			t.Errorf("%v: template import added to its imports before a template was applied", pkg)
+		}
+	}
+	if len(compat.Parents) != 0 {
+		t.Errorf("template import has parents %v", compat.Parents)
+	}
+	if len(sys.Parents) != 3 || sys.Parents[0] != top || sys.Parents[1] != q || sys.Parents[2] != ospkg {
+		t.Errorf("syscall has parents %v", sys.Parents)
+	}
+}
+
+func TestGolangXPortingOptIn(t *testing.T) {
+	sess := testSession(t)
+	sess.Modules["golang.org/x/term"] = &base.ModuleConfig{Port: true}
+	tree := &ImportTree{sess: sess}
+
+	sys := testPackage("golang.org/x/sys/unix", "golang.org/x/sys")
+	term := testPackage("golang.org/x/term", "golang.org/x/term")
+	for _, pkg := range []*Package{sys, term} {
+		pkg.tree = tree
+		pkg.Meta.Module.Replace = &Module{Path: pkg.Meta.Module.Path, Version: "v1.0.0"}
+	}
+
+	if !IsStdlibPkg(sys) || !IsFrozenPkg(sys) {
+		t.Errorf("pinned golang.org/x/sys should be frozen")
+	}
+	if IsStdlibPkg(term) || IsFrozenPkg(term) {
+		t.Errorf("golang.org/x/term was opted in and should be ported")
+	}
+
+	sess.PortGolangX = true
+	if IsStdlibPkg(sys) || IsFrozenPkg(sys) {
+		t.Errorf("golang.org/x/sys should be ported once the run opts in")
+	}
+}
+
+func TestReleaseSyntax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.go")
+	if err := os.WriteFile(path, []byte("package a\n\nfunc A() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gofile := &GoFile{Name: "a.go", Path: path, Fset: token.NewFileSet()}
+	pkg := testPackage("example.com/a", "example.com/a")
+	pkg.Files = map[string]*GoFile{gofile.Name: gofile}
+	pkg.Builds = []BuildConfig{{Files: []*GoFile{gofile}}}
+
+	if err := pkg.LoadSyntax(0); err != nil {
+		t.Fatalf("unable to load syntax: %v", err)
+	}
+
+	pkg.ReleaseSyntax()
+	if gofile.Syntax != nil || pkg.Builds[0].Syntax != nil {
+		t.Fatalf("syntax was not released")
+	}
+
+	if err := pkg.LoadSyntax(0); err != nil {
+		t.Fatalf("unable to load syntax again: %v", err)
+	}
+	if len(pkg.Builds[0].Syntax) != 1 || pkg.Builds[0].Syntax[0] != gofile.Syntax || gofile.Syntax == nil {
+		t.Errorf("syntax was not parsed again after being released")
+	}
+}
+
+func TestLoadSyntaxComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a_linux.go")
+	if err := os.WriteFile(path, []byte("//go:build linux\n\npackage a\n\n// A does nothing\nfunc A() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Comments are only parsed for files that get written out
+	gofile := &GoFile{Name: "a_linux.go", Path: path, Fset: token.NewFileSet()}
+	if err := gofile.LoadSyntax(); err != nil {
+		t.Fatalf("unable to load syntax: %v", err)
+	}
+	if len(gofile.Syntax.Comments) > 0 {
+		t.Errorf("syntax kept comments %v", gofile.Syntax.Comments)
+	}
+
+	syntax, err := gofile.SyntaxWithComments()
+	if err != nil {
+		t.Fatalf("unable to load syntax with comments: %v", err)
+	}
+	if len(syntax.Comments) != 2 || syntax == gofile.Syntax {
+		t.Errorf("got comments %v", syntax.Comments)
+	}
+}
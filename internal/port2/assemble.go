@@ -0,0 +1,435 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"sort"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/tags"
+)
+
+// Search for a working build config by adding platform specific files one at a time
+//
+// Rather than taking a whole platform's config, files are picked based on the declarations
+// they provide for names missing from the current config (including names that importing
+// packages expect from us), preferring platforms by their rank in tags.UNIX_PLATFORM_RANKING.
+// Therefore a config can end up mixing files from several platforms.
+//
+// On success the new config is selected and the imports that still have missing names are returned
+func (handle *Handle) assemble() (map[*pkg2.Package]bool, bool) {
+	pkg := handle.pkg
+	demands := handle.demands()
+
+	files := append([]*pkg2.GoFile(nil), pkg.Builds[handle.buildIdx].Files...)
+	inConfig := make(map[*pkg2.GoFile]bool, len(files))
+	for _, gofile := range files {
+		inConfig[gofile] = true
+	}
+
+	// Index the declarations of every platform specific file that isn't already built
+	names := make([]string, 0, len(pkg.Files))
+	for name := range pkg.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	providers := make(map[string][]*pkg2.GoFile)
+	for _, name := range names {
+		gofile := pkg.Files[name]
+		if inConfig[gofile] {
+			continue
+		}
+		if _, ok := gofile.Tags.(tags.Platforms); !ok {
+			continue
+		}
+		if err := gofile.LoadSyntax(); err != nil {
+			continue
+		}
+		for decl := range gofile.Declarations() {
+			providers[decl] = append(providers[decl], gofile)
+		}
+	}
+	for _, candidates := range providers {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return platformRank(candidates[i]) < platformRank(candidates[j])
+		})
+	}
+
+	typed, errs := handle.types, handle.errs
+	added := make([]*pkg2.GoFile, 0, 4)
+	rejected := make(map[*pkg2.GoFile]bool)
+
+	for {
+		missing := missingNames(files, errs, demands)
+		if len(missing) == 0 {
+			break
+		}
+
+		// Names that no file declares can never be satisfied by mixing files
+		for _, name := range missing {
+			if len(providers[name]) == 0 {
+				return nil, false
+			}
+		}
+
+		// Add the first file that provides a missing name without breaking the config
+		var picked *pkg2.GoFile
+	search:
+		for _, name := range missing {
+			for _, candidate := range providers[name] {
+				if inConfig[candidate] || rejected[candidate] {
+					continue
+				}
+
+				trial := append(files[:len(files):len(files)], candidate)
+				ttyped, terrs := handle.typeCheckFiles(syntaxOf(trial), defaultTypeConfig())
+
+				// The candidate can conflict with files of the config, in which case we may exclude them instead
+				var excluded []*pkg2.GoFile
+				if names := redeclaredNames(terrs); len(names) > 0 {
+					excluded = resolveRedeclared(trial, candidate, names, added)
+					if excluded == nil {
+						rejected[candidate] = true
+						continue
+					}
+
+					trial = withoutFiles(trial, excluded)
+					ttyped, terrs = handle.typeCheckFiles(syntaxOf(trial), defaultTypeConfig())
+				}
+
+				if !assemblable(terrs) {
+					rejected[candidate] = true
+					continue
+				}
+
+				picked = candidate
+				files, typed, errs = trial, ttyped, terrs
+				for _, gofile := range excluded {
+					inConfig[gofile] = false
+					rejected[gofile] = true
+				}
+				break search
+			}
+		}
+
+		if picked == nil {
+			return nil, false
+		}
+
+		inConfig[picked] = true
+		added = append(added, picked)
+	}
+
+	if len(added) == 0 {
+		return nil, false
+	}
+
+	// Report the platforms the donated files were taken from
+	platforms := make([]string, 0, len(added))
+	seen := make(map[string]bool, len(added))
+	for _, gofile := range added {
+		if pltf := bestPlatform(gofile); pltf != "" && !seen[pltf] {
+			seen[pltf] = true
+			platforms = append(platforms, pltf)
+		}
+	}
+	sort.SliceStable(platforms, func(i, j int) bool {
+		return rankOf(platforms[i]) < rankOf(platforms[j])
+	})
+
+	build, err := pkg.AddBuild(platforms, files)
+	if err != nil {
+		return nil, false
+	}
+
+	prevIdx, prevTypes, prevErrs := handle.buildIdx, handle.types, handle.errs
+	handle.buildIdx, handle.types, handle.errs = build, typed, errs
+
+	if !handle.validate() {
+		handle.dropBuilds(build)
+		handle.buildIdx, handle.types, handle.errs = prevIdx, prevTypes, prevErrs
+		return nil, false
+	}
+
+	imports := make(map[*pkg2.Package]bool)
+	for _, err := range errs {
+		if iname, ok := err.Reason.(pkg2.TCBadImportName); ok {
+			ipkg := pkg.LookupImport(iname.PkgName, err.Err.Fset.Position(err.Err.Pos).Filename)
+			if ipkg == nil {
+				handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, iname.PkgName))
+			}
+			imports[ipkg] = true
+		}
+	}
+
+	return imports, true
+}
+
+// Names that packages importing this package expect it to declare (but it does not)
+//
+// The parents are done porting by the time the package is, so they are only type checked once per port attempt
+func (handle *Handle) demands() map[string]bool {
+	if handle.demanded != nil {
+		return handle.demanded
+	}
+
+	pkg := handle.pkg
+	demands := make(map[string]bool)
+	for _, parent := range pkg.Parents {
+		ph := handle.ctx.handles[parent]
+		if ph == nil || ph.types == nil {
+			continue
+		}
+
+		_, errs := ph.typeCheck(ph.buildIdx, defaultTypeConfig())
+		for _, err := range errs {
+			if info, ok := err.Reason.(pkg2.TCBadImportName); ok {
+				if pkg.Meta.ImportPath == handle.importPathOf(parent, err, info) {
+					demands[declName(info.Name)] = true
+				}
+			}
+		}
+	}
+	handle.demanded = demands
+	return demands
+}
+
+// Names that are declared more than once in a config
+func redeclaredNames(errs []pkg2.TypeError) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(errs))
+	for _, err := range errs {
+		if info, ok := err.Reason.(pkg2.TCRedeclared); ok && !seen[info.Name] {
+			seen[info.Name] = true
+			names = append(names, info.Name)
+		}
+	}
+	return names
+}
+
+// Exclude files of the given config until no name is declared twice
+//
+// Every platform specific file (one that would not be built by default) that conflicts
+// with other files of the config is resolved as in resolveRedeclared, excluding the file
+// itself if that loses fewer declarations. If any file was excluded a new config is added
+// without them, otherwise the config is returned as is.
+func (handle *Handle) excludeRedeclared(build int, typed *types.Package, errs []pkg2.TypeError) (int, *types.Package, []pkg2.TypeError) {
+	names := redeclaredNames(errs)
+	if len(names) == 0 {
+		return build, typed, errs
+	}
+
+	pkg := handle.pkg
+	cfg := pkg.Builds[build]
+	files := cfg.Files
+	for _, donor := range cfg.Files {
+		if donor.Default {
+			continue
+		}
+
+		// Either side of a conflict may have been excluded already
+		others := withoutFiles(files, []*pkg2.GoFile{donor})
+		if len(others) == len(files) {
+			continue
+		}
+		conflicts := make([]string, 0, len(names))
+		for _, name := range names {
+			if !donor.Declarations()[name] {
+				continue
+			}
+			for _, gofile := range others {
+				if gofile.Declarations()[name] {
+					conflicts = append(conflicts, name)
+					break
+				}
+			}
+		}
+		if len(conflicts) == 0 {
+			continue
+		}
+
+		excluded := resolveRedeclared(files, donor, conflicts, nil)
+		if excluded == nil {
+			excluded = []*pkg2.GoFile{donor}
+		}
+		files = withoutFiles(files, excluded)
+	}
+	if len(files) == len(cfg.Files) {
+		return build, typed, errs
+	}
+
+	rbuild, err := pkg.AddBuild(cfg.Platforms, files)
+	if err != nil {
+		return build, typed, errs
+	}
+	rtyped, rerrs := handle.typeCheck(rbuild, defaultTypeConfig())
+	return rbuild, rtyped, rerrs
+}
+
+// Choose the files to exclude so that a candidate no longer conflicts with the config
+//
+// Whichever side would lose fewer declarations (that no other file provides) is excluded,
+// on a tie the files already in the config are excluded since the candidate provides a name we need.
+// Returns nil if the candidate should be rejected instead (files in fixed are never excluded)
+func resolveRedeclared(files []*pkg2.GoFile, candidate *pkg2.GoFile, names []string, fixed []*pkg2.GoFile) []*pkg2.GoFile {
+	isFixed := make(map[*pkg2.GoFile]bool, len(fixed))
+	for _, gofile := range fixed {
+		isFixed[gofile] = true
+	}
+
+	others := make([]*pkg2.GoFile, 0, 1)
+	for _, gofile := range files {
+		if gofile == candidate {
+			continue
+		}
+		for _, name := range names {
+			if gofile.Declarations()[name] {
+				if isFixed[gofile] {
+					return nil
+				}
+				others = append(others, gofile)
+				break
+			}
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+
+	if lostDecls(files, others) > lostDecls(files, []*pkg2.GoFile{candidate}) {
+		return nil
+	}
+	return others
+}
+
+// Number of declarations no longer provided by the config after excluding some of its files
+func lostDecls(files []*pkg2.GoFile, excluded []*pkg2.GoFile) int {
+	remaining := make(map[string]bool)
+	for _, gofile := range withoutFiles(files, excluded) {
+		for decl := range gofile.Declarations() {
+			remaining[decl] = true
+		}
+	}
+
+	lost := make(map[string]bool)
+	for _, gofile := range excluded {
+		for decl := range gofile.Declarations() {
+			if !remaining[decl] {
+				lost[decl] = true
+			}
+		}
+	}
+	return len(lost)
+}
+
+func withoutFiles(files []*pkg2.GoFile, excluded []*pkg2.GoFile) []*pkg2.GoFile {
+	skip := make(map[*pkg2.GoFile]bool, len(excluded))
+	for _, gofile := range excluded {
+		skip[gofile] = true
+	}
+
+	kept := make([]*pkg2.GoFile, 0, len(files))
+	for _, gofile := range files {
+		if !skip[gofile] {
+			kept = append(kept, gofile)
+		}
+	}
+	return kept
+}
+
+// Config errors that can still be resolved by adding more files (or porting imports)
+func assemblable(errs []pkg2.TypeError) bool {
+	for _, err := range errs {
+		switch err.Reason.(type) {
+		case pkg2.TCBadName, pkg2.TCBadImportName:
+			continue
+		}
+		if !err.Err.Soft {
+			return false
+		}
+	}
+	return true
+}
+
+// Sorted list of names that the given files fail to declare
+func missingNames(files []*pkg2.GoFile, errs []pkg2.TypeError, demands map[string]bool) []string {
+	declared := make(map[string]bool)
+	for _, gofile := range files {
+		for decl := range gofile.Declarations() {
+			declared[decl] = true
+		}
+	}
+
+	missing := make(map[string]bool)
+	for _, err := range errs {
+		if info, ok := err.Reason.(pkg2.TCBadName); ok {
+			missing[declName(info)] = true
+		}
+	}
+	for name := range demands {
+		if !declared[name] {
+			missing[name] = true
+		}
+	}
+
+	list := make([]string, 0, len(missing))
+	for name := range missing {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Name of the declaration a missing name refers to (methods are "Type.Method")
+func declName(info pkg2.TCBadName) string {
+	if info.MemberOf != nil {
+		return *info.MemberOf + "." + info.Name
+	}
+	return info.Name
+}
+
+func syntaxOf(files []*pkg2.GoFile) []*ast.File {
+	syntax := make([]*ast.File, 0, len(files))
+	for _, gofile := range files {
+		syntax = append(syntax, gofile.Syntax)
+	}
+	return syntax
+}
+
+func rankOf(pltf string) int {
+	for idx, ranked := range tags.UNIX_PLATFORM_RANKING {
+		if ranked == pltf {
+			return idx
+		}
+	}
+	return len(tags.UNIX_PLATFORM_RANKING)
+}
+
+// Highest ranked platform the file is built for
+func bestPlatform(gofile *pkg2.GoFile) string {
+	cnstr, ok := gofile.Tags.(tags.Platforms)
+	if !ok {
+		return ""
+	}
+
+	best := ""
+	for pltf, on := range cnstr {
+		if on && (best == "" || rankOf(pltf) < rankOf(best)) {
+			best = pltf
+		}
+	}
+	return best
+}
+
+func platformRank(gofile *pkg2.GoFile) int {
+	if pltf := bestPlatform(gofile); pltf != "" {
+		return rankOf(pltf)
+	}
+	return len(tags.UNIX_PLATFORM_RANKING)
+}
@@ -0,0 +1,147 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/tags"
+)
+
+// Handle of a package without imports made up of the given files (keyed by name)
+//
+// Files named after a platform (f_linux.go) are built for it, every other file is built by default.
+// The configs list the platform specific files they add to the default ones, the first config is selected.
+func testHandle(t *testing.T, sess *base.Session, files map[string]string, builds ...[]string) *Handle {
+	handle := NewContext(sess).GetHandle(testPackage(t, sess, files, builds...))
+	handle.types, handle.errs = handle.typeCheck(0, defaultTypeConfig())
+	return handle
+}
+
+// Session porting to zos/s390x with its own cache directory (and no type cache)
+func testSession(t *testing.T) *base.Session {
+	sess := base.SessionFromEnv(map[string]string{"GOOS": "zos", "GOARCH": "s390x", "GOVERSION": "go1.20"})
+	sess.Cache = t.TempDir()
+	sess.TypeCache = ""
+	return sess
+}
+
+// Package made up of the given files and configs (see testHandle)
+func testPackage(t *testing.T, sess *base.Session, files map[string]string, builds ...[]string) *pkg2.Package {
+	dir := t.TempDir()
+	pkg := &pkg2.Package{
+		Meta:  &pkg2.MetaPackage{ImportPath: "example.com/p", Name: "p", Dir: dir},
+		Files: make(map[string]*pkg2.GoFile, len(files)),
+	}
+
+	defaults := make([]*pkg2.GoFile, 0, len(files))
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		gofile := &pkg2.GoFile{Name: name, Path: path, Fset: sess.FileSet, Tags: tags.All{}, Default: true}
+		for _, pltf := range tags.UNIX_PLATFORM_RANKING {
+			if strings.HasSuffix(name, "_"+pltf+".go") {
+				gofile.Tags, gofile.Default = tags.Platforms{pltf: true}, false
+			}
+		}
+		pkg.Files[name] = gofile
+		if gofile.Default {
+			defaults = append(defaults, gofile)
+		}
+	}
+
+	for _, names := range builds {
+		cfg := pkg2.BuildConfig{Files: append([]*pkg2.GoFile(nil), defaults...)}
+		for _, name := range names {
+			cfg.Files = append(cfg.Files, pkg.Files[name])
+			cfg.Platforms = append(cfg.Platforms, bestPlatform(pkg.Files[name]))
+		}
+		pkg.Builds = append(pkg.Builds, cfg)
+	}
+	pkg.PlatformBuilds = len(pkg.Builds)
+	return pkg
+}
+
+func buildFiles(cfg pkg2.BuildConfig) string {
+	names := make([]string, 0, len(cfg.Files))
+	for _, gofile := range cfg.Files {
+		names = append(names, gofile.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestAssembleThenRetag(t *testing.T) {
+	sess := testSession(t)
+	handle := testHandle(t, sess, map[string]string{
+		"p.go":         "package p\n\nfunc G() int { return A() + B() }\n",
+		"a_linux.go":   "package p\n\nfunc A() int { return 1 }\n",
+		"a_darwin.go":  "package p\n\nfunc A() int { return 2 }\n",
+		"b_freebsd.go": "package p\n\nfunc B() int { return 3 }\n",
+		"b_darwin.go":  "package p\n\nfunc B() int { return 4 }\n",
+	},
+		nil,
+		[]string{"a_linux.go"},
+		[]string{"b_freebsd.go"},
+		[]string{"a_darwin.go", "b_darwin.go"},
+	)
+	pkg := handle.pkg
+
+	// Neither the linux nor the freebsd config is enough, mixing them is
+	if _, ok := handle.assemble(); !ok {
+		t.Fatal("no config was assembled")
+	}
+	if handle.buildIdx != 4 || len(handle.errs) != 0 {
+		t.Fatalf("selected config %v with errors %v", handle.buildIdx, handle.errs)
+	}
+	if got, want := buildFiles(pkg.Builds[4]), "p.go a_linux.go b_freebsd.go"; got != want {
+		t.Errorf("assembled %v, want %v", got, want)
+	}
+	if got := strings.Join(pkg.Builds[4].Platforms, " "); got != "linux freebsd" {
+		t.Errorf("assembled config reports platforms %v", got)
+	}
+
+	// Whole platform configs are still tried after a mixed config was selected
+	if _, ok := handle.retag(false); !ok {
+		t.Fatal("no whole platform config was selected after the mixed one")
+	}
+	if handle.buildIdx != 3 || handle.platformIdx != 3 {
+		t.Errorf("selected config %v (platform config %v), want the darwin config", handle.buildIdx, handle.platformIdx)
+	}
+	if _, ok := handle.retag(false); ok {
+		t.Errorf("retag selected config %v past the last platform config", handle.buildIdx)
+	}
+}
+
+func TestRetagExcludesRedeclared(t *testing.T) {
+	sess := testSession(t)
+	handle := testHandle(t, sess, map[string]string{
+		"p.go":       "package p\n\nfunc G() int { return X() + Y() }\n",
+		"x.go":       "package p\n\nfunc X() int { return 0 }\n",
+		"x_linux.go": "package p\n\nfunc X() int { return 1 }\n\nfunc Y() int { return 2 }\n",
+	},
+		nil,
+		[]string{"x_linux.go"},
+	)
+	pkg := handle.pkg
+
+	// The linux file redeclares X but is the only one declaring Y, so the default file goes
+	if _, ok := handle.retag(false); !ok {
+		t.Fatal("no config was selected")
+	}
+	if handle.platformIdx != 1 || len(handle.errs) != 0 {
+		t.Fatalf("selected config %v (platform config %v) with errors %v", handle.buildIdx, handle.platformIdx, handle.errs)
+	}
+	if got, want := buildFiles(pkg.Builds[handle.buildIdx]), "p.go x_linux.go"; got != want {
+		t.Errorf("selected %v, want %v", got, want)
+	}
+}
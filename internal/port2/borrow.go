@@ -0,0 +1,382 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/tags"
+)
+
+// Declarations copied out of a donor file (used as the reason of a pkg2.ReplacedFile)
+type borrowedDecls []string
+
+// Try borrowing just the missing declarations from a donor platform's files
+//
+// For every donor file a minimal copy is generated containing the missing declarations,
+// any declarations from the same file they depend on (including the methods of borrowed types),
+// and the imports they use. Only packages missing at most sess.BorrowLimit names are tried.
+// If a copy would end up containing the entire donor file we leave it to retagging instead.
+//
+// On success the new config is selected and the imports that still have missing names are returned
+func (handle *Handle) borrow() (map[*pkg2.Package]bool, bool) {
+	pkg := handle.pkg
+	files := pkg.Builds[handle.buildIdx].Files
+
+	missing := missingNames(files, handle.errs, handle.demands())
+	if len(missing) == 0 || len(missing) > handle.ctx.sess.BorrowLimit {
+		return nil, false
+	}
+
+	declared := make(map[string]bool)
+	inConfig := make(map[*pkg2.GoFile]bool, len(files))
+	for _, gofile := range files {
+		inConfig[gofile] = true
+		for decl := range gofile.Declarations() {
+			declared[decl] = true
+		}
+	}
+
+	// Find the highest ranked donor file for each missing name
+	donors := make(map[*pkg2.GoFile][]string)
+	order := make([]*pkg2.GoFile, 0, len(missing))
+	for _, name := range missing {
+		var donor *pkg2.GoFile
+		for _, gofile := range pkg.Files {
+			if inConfig[gofile] || gofile.Cgo {
+				continue
+			}
+			if _, ok := gofile.Tags.(tags.Platforms); !ok {
+				continue
+			}
+			if err := gofile.LoadSyntax(); err != nil || !gofile.Declarations()[name] {
+				continue
+			}
+			if donor == nil || platformRank(gofile) < platformRank(donor) ||
+				(platformRank(gofile) == platformRank(donor) && gofile.Name < donor.Name) {
+				donor = gofile
+			}
+		}
+
+		if donor == nil {
+			return nil, false
+		}
+		if donors[donor] == nil {
+			order = append(order, donor)
+		}
+		donors[donor] = append(donors[donor], name)
+	}
+
+	pkgCacheDir := filepath.Join(handle.ctx.sess.Cache, pkg.Meta.ImportPath)
+	if err := os.MkdirAll(pkgCacheDir, 0740); err != nil {
+		return nil, false
+	}
+
+	cfgFiles := append([]*pkg2.GoFile(nil), files...)
+	platforms := make([]string, 0, len(order))
+	for _, donor := range order {
+		repl, err := handle.borrowFrom(donor, donors[donor], declared, pkgCacheDir)
+		if err != nil || repl == nil {
+			return nil, false
+		}
+
+		cfgFiles = append(cfgFiles, repl)
+		if pltf := bestPlatform(donor); pltf != "" {
+			platforms = append(platforms, pltf)
+		}
+	}
+
+	typed, errs := handle.typeCheckFiles(syntaxOf(cfgFiles), defaultTypeConfig())
+	if !assemblable(errs) || len(missingNames(cfgFiles, errs, nil)) > 0 {
+		return nil, false
+	}
+
+	build, err := pkg.AddBuild(platforms, cfgFiles)
+	if err != nil {
+		return nil, false
+	}
+
+	// Generated files are part of the package now (needed to resolve imports in type errors)
+	for _, gofile := range cfgFiles[len(files):] {
+		pkg.Files[gofile.Name] = gofile
+	}
+
+	prevIdx, prevTypes, prevErrs := handle.buildIdx, handle.types, handle.errs
+	handle.buildIdx, handle.types, handle.errs = build, typed, errs
+
+	if !handle.validate() {
+		handle.dropBuilds(build)
+		handle.buildIdx, handle.types, handle.errs = prevIdx, prevTypes, prevErrs
+		return nil, false
+	}
+
+	imports := make(map[*pkg2.Package]bool)
+	for _, err := range errs {
+		if iname, ok := err.Reason.(pkg2.TCBadImportName); ok {
+			ipkg := pkg.LookupImport(iname.PkgName, err.Err.Fset.Position(err.Err.Pos).Filename)
+			if ipkg == nil {
+				handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, iname.PkgName))
+			}
+			imports[ipkg] = true
+		}
+	}
+
+	return imports, true
+}
+
+// Generate a copy of the donor file with only the given declarations (and what they depend on)
+//
+// Returns nil if the copy would contain every declaration of the donor file
+func (handle *Handle) borrowFrom(donor *pkg2.GoFile, names []string, declared map[string]bool, cache string) (*pkg2.GoFile, error) {
+	src, err := os.ReadFile(donor.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The donor's syntax may have been parsed without comments, the copy keeps the doc comments
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, donor.Name, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	// Map each top level name to the declaration (or spec) that provides it
+	provides := make(map[string]ast.Node)
+	parents := make(map[ast.Node]*ast.GenDecl)
+	methods := make(map[string][]string)
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil || len(decl.Recv.List) == 0 {
+				provides[decl.Name.Name] = decl
+			} else if recv := pkg2.ReceiverName(decl.Recv.List[0].Type); recv != "" {
+				provides[recv+"."+decl.Name.Name] = decl
+				methods[recv] = append(methods[recv], recv+"."+decl.Name.Name)
+			}
+		case *ast.GenDecl:
+			if decl.Tok == token.IMPORT {
+				continue
+			}
+			// Values of constants using iota (or repeating an implicit value) depend on their position in the block,
+			// such blocks can only be copied whole
+			whole := false
+			if decl.Tok == token.CONST {
+				for _, spec := range decl.Specs {
+					if vspec, ok := spec.(*ast.ValueSpec); ok && (len(vspec.Values) == 0 || usesIota(vspec)) {
+						whole = true
+					}
+				}
+			}
+			for _, spec := range decl.Specs {
+				var node ast.Node = spec
+				if whole {
+					node = decl
+				}
+				parents[node] = decl
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					provides[spec.Name.Name] = node
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						provides[name.Name] = node
+					}
+				}
+			}
+		}
+	}
+
+	// Take the transitive closure of declarations from this file that are referenced
+	picked := make(map[ast.Node]bool)
+	used := make(map[string]bool)
+	queue := make([]ast.Node, 0, len(names))
+	pick := func(name string) {
+		if declared[name] {
+			return
+		}
+		if node := provides[name]; node != nil && !picked[node] {
+			picked[node] = true
+			queue = append(queue, node)
+		}
+	}
+	for _, name := range names {
+		pick(name)
+	}
+
+	var visit func(n ast.Node) bool
+	visit = func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if x, ok := n.X.(*ast.Ident); ok {
+				if _, ok := donor.Imports[x.Name]; ok {
+					used[x.Name] = true
+					return false
+				}
+			}
+			// Selected names are fields or methods, only the operand can refer to declarations
+			ast.Inspect(n.X, visit)
+			return false
+		case *ast.TypeSpec:
+			// A borrowed type needs its methods to satisfy the same interfaces it does on the donor platform
+			for _, method := range methods[n.Name.Name] {
+				pick(method)
+			}
+		case *ast.Ident:
+			pick(n.Name)
+		}
+		return true
+	}
+
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		ast.Inspect(node, visit)
+	}
+
+	if used[pkg2.CGO_PACKAGE_NAME] {
+		return nil, fmt.Errorf("cannot borrow declarations that use cgo")
+	}
+
+	// Don't bother if we would copy the whole file, retagging does that without duplicating code
+	whole := true
+	for _, node := range provides {
+		if !picked[node] {
+			whole = false
+			break
+		}
+	}
+	if whole {
+		return nil, nil
+	}
+
+	// Write out the declarations in the order they appear in the donor
+	nodes := make([]ast.Node, 0, len(picked))
+	for node := range picked {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Pos() < nodes[j].Pos()
+	})
+
+	offset := func(pos token.Pos) int {
+		return fset.Position(pos).Offset
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "package %v\n", file.Name.Name)
+
+	importNames := make(map[string]string, len(donor.Imports))
+	for name, ipath := range donor.Imports {
+		importNames[ipath] = name
+	}
+	for _, ispec := range file.Imports {
+		ipath := strings.Trim(ispec.Path.Value, "\"")
+		name := importNames[ipath]
+		if ispec.Name != nil {
+			name = ispec.Name.Name
+		}
+		if used[name] {
+			fmt.Fprintf(&out, "\nimport %s\n", src[offset(ispec.Pos()):offset(ispec.End())])
+		}
+	}
+
+	borrowed := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		start, end := node.Pos(), node.End()
+		switch node := node.(type) {
+		case *ast.FuncDecl:
+			if node.Doc != nil {
+				start = node.Doc.Pos()
+			}
+		case *ast.GenDecl:
+			if node.Doc != nil {
+				start = node.Doc.Pos()
+			}
+		case ast.Spec:
+			// Specs taken out of a block need their keyword back, the doc comment goes above it
+			doc := specDoc(node)
+			if !parents[node].Lparen.IsValid() {
+				doc = parents[node].Doc
+			}
+			out.WriteString("\n")
+			if doc != nil {
+				fmt.Fprintf(&out, "%s\n", src[offset(doc.Pos()):offset(doc.End())])
+			}
+			fmt.Fprintf(&out, "%v %s\n", parents[node].Tok, src[offset(start):offset(end)])
+			continue
+		}
+		fmt.Fprintf(&out, "\n%s\n", src[offset(start):offset(end)])
+	}
+
+	for name, node := range provides {
+		if picked[node] && !declared[name] {
+			borrowed = append(borrowed, name)
+		}
+	}
+	sort.Strings(borrowed)
+
+	name := handle.copyName(donor)
+	cpath := filepath.Join(cache, name)
+
+	syntax, err := parser.ParseFile(handle.ctx.sess.FileSet, name, out.Bytes(), 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse borrowed declarations: %w", err)
+	}
+
+	if err := os.WriteFile(cpath, out.Bytes(), 0740); err != nil {
+		return nil, fmt.Errorf("unable to write borrowed declarations: %w", err)
+	}
+
+	imports := make(map[string]string, len(used))
+	for iname := range used {
+		imports[iname] = donor.Imports[iname]
+	}
+
+	return &pkg2.GoFile{
+		Name:    name,
+		Path:    cpath,
+		Syntax:  syntax,
+		Fset:    handle.ctx.sess.FileSet,
+		Tags:    tags.Supported{},
+		Imports: imports,
+		Replaced: &pkg2.ReplacedFile{
+			File:   donor,
+			Reason: borrowedDecls(borrowed),
+		},
+	}, nil
+}
+
+// Doc comment of a type or value spec
+func specDoc(spec ast.Spec) *ast.CommentGroup {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Doc
+	case *ast.ValueSpec:
+		return spec.Doc
+	}
+	return nil
+}
+
+// Whether any value of the spec refers to iota
+func usesIota(spec *ast.ValueSpec) bool {
+	found := false
+	for _, value := range spec.Values {
+		ast.Inspect(value, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok && ident.Name == "iota" {
+				found = true
+			}
+			return !found
+		})
+	}
+	return found
+}
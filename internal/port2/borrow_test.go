@@ -0,0 +1,133 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"go/constant"
+	"go/types"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+func TestBorrowIotaBlock(t *testing.T) {
+	sess := testSession(t)
+	handle := testHandle(t, sess, map[string]string{
+		"p.go":       "package p\n\nfunc G() int { return B() }\n",
+		"b_linux.go": "package p\n\nconst (\n\tX = iota\n\tY = iota\n)\n\nfunc B() int { return Y }\n\nfunc Other() int { return 5 }\n",
+	}, nil)
+	pkg := handle.pkg
+
+	// The name of the copy is taken by another generated file
+	pkg.Files["b_linux_zos.go"] = &pkg2.GoFile{Name: "b_linux_zos.go"}
+
+	if _, ok := handle.borrow(); !ok {
+		t.Fatalf("nothing was borrowed, type errors %v", handle.errs)
+	}
+
+	files := pkg.Builds[handle.buildIdx].Files
+	copied := files[len(files)-1]
+	if copied.Name != "b_linux_2_zos.go" {
+		t.Errorf("borrowed into %v", copied.Name)
+	}
+	src, err := os.ReadFile(copied.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), "X = iota") || strings.Contains(string(src), "Other") {
+		t.Errorf("borrowed:\n%s", src)
+	}
+
+	if y, ok := handle.types.Scope().Lookup("Y").(*types.Const); !ok || y.Val().Kind() != constant.Int || y.Val().String() != "1" {
+		t.Errorf("borrowed Y is %v", handle.types.Scope().Lookup("Y"))
+	}
+}
+
+func TestBorrowHelpersAndMethods(t *testing.T) {
+	sess := testSession(t)
+	handle := testHandle(t, sess, map[string]string{
+		"p.go": "package p\n\ntype Namer interface{ Name() string }\n\nfunc G() Namer { return New() }\n",
+		"b_linux.go": `package p
+
+// Handle of the donor platform
+type handle struct{ fd int }
+
+// Name of the handle
+func (h *handle) Name() string { return label(h.fd) }
+
+func label(fd int) string { return "fd" }
+
+var (
+	// Descriptor new handles get
+	defaultFd = 3
+
+	otherFd = 4
+)
+
+// New returns a handle
+func New() *handle { return &handle{fd: defaultFd} }
+
+func Unrelated() int { return otherFd }
+`,
+	}, nil)
+	pkg := handle.pkg
+
+	if _, ok := handle.borrow(); !ok {
+		t.Fatalf("nothing was borrowed, type errors %v", handle.errs)
+	}
+	if len(handle.errs) != 0 {
+		t.Fatalf("borrowed config has errors %v", handle.errs)
+	}
+
+	files := pkg.Builds[handle.buildIdx].Files
+	copied := files[len(files)-1]
+	src, err := os.ReadFile(copied.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"// Handle of the donor platform\ntype handle struct",
+		"// Name of the handle\nfunc (h *handle) Name() string",
+		"func label(fd int)",
+		"// Descriptor new handles get\nvar defaultFd = 3",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("expected %q in:\n%s", want, src)
+		}
+	}
+	if strings.Contains(string(src), "Unrelated") || strings.Contains(string(src), "otherFd") {
+		t.Errorf("borrowed more than needed:\n%s", src)
+	}
+
+	want := "New defaultFd handle handle.Name label"
+	if got := copied.Replaced.Reason.(borrowedDecls); strings.Join(got, " ") != want {
+		t.Errorf("borrowed %v, want %v", got, want)
+	}
+}
+
+func TestBorrowLimit(t *testing.T) {
+	files := map[string]string{
+		"p.go":       "package p\n\nfunc G() int { return A() + B() + C() }\n",
+		"b_linux.go": "package p\n\nfunc A() int { return 1 }\n\nfunc B() int { return 2 }\n\nfunc C() int { return 3 }\n\nfunc D() int { return 4 }\n",
+	}
+
+	sess := testSession(t)
+	handle := testHandle(t, sess, files, nil)
+	if _, ok := handle.borrow(); ok {
+		t.Errorf("borrowed %v names past the default limit", len(handle.errs))
+	}
+
+	sess = testSession(t)
+	sess.BorrowLimit = 3
+	handle = testHandle(t, sess, files, nil)
+	if _, ok := handle.borrow(); !ok {
+		t.Fatalf("nothing was borrowed with a limit of 3, type errors %v", handle.errs)
+	}
+	if len(handle.pkg.Builds) != 2 || len(handle.errs) != 0 {
+		t.Errorf("got configs %v, type errors %v", len(handle.pkg.Builds), handle.errs)
+	}
+}
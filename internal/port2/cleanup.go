@@ -0,0 +1,61 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+// Record the unused imports and variables left in the files we write out
+//
+// go/types only reports these as soft errors, but the compiler rejects them
+func (handle *Handle) recordCleanups(files []base.FilePatch) {
+	written := make(map[string]*base.FilePatch, len(files))
+	for idx := range files {
+		if files[idx].Build {
+			written[files[idx].Name] = &files[idx]
+		}
+	}
+	if len(written) == 0 {
+		return
+	}
+
+	_, errs := handle.typeCheck(handle.buildIdx, defaultTypeConfig())
+	for _, err := range errs {
+		pos := err.Err.Fset.Position(err.Err.Pos)
+		file := written[pos.Filename]
+		if file == nil {
+			continue
+		}
+
+		switch reason := err.Reason.(type) {
+		case pkg2.TCUnusedImport:
+			file.Cleanups = append(file.Cleanups, base.Cleanup{
+				Kind:   base.CleanupImport,
+				Name:   reason.Name,
+				Path:   reason.Path,
+				Line:   pos.Line,
+				Column: pos.Column,
+			})
+		case pkg2.TCUnusedVar:
+			file.Cleanups = append(file.Cleanups, base.Cleanup{
+				Kind:   base.CleanupVariable,
+				Name:   reason.Name,
+				Line:   pos.Line,
+				Column: pos.Column,
+			})
+		}
+	}
+}
+
+// Errors that are fixed up by cleanups when the patch is applied
+func isCleanup(err pkg2.TypeError) bool {
+	switch err.Reason.(type) {
+	case pkg2.TCUnusedImport, pkg2.TCUnusedVar:
+		return true
+	}
+	return false
+}
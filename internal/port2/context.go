@@ -6,34 +6,87 @@ package port2
 
 import (
 	"fmt"
+	"go/types"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/zosopentools/wharf/internal/base"
 	"github.com/zosopentools/wharf/internal/pkg2"
 )
 
 type Context struct {
+	sess *base.Session
+
+	// Guards handles, packages of the same layer are refreshed concurrently
+	mu sync.RWMutex
+
 	handles map[*pkg2.Package]*Handle
 	pins    map[string]versionPin
+
+	// Strategies that can be selected (keyed by name)
+	strategies map[string]Strategy
+
+	// Recognize additional kinds of type errors (tried in order, before the built in ones)
+	classifiers []pkg2.Classifier
+
+	// Shared importer for frozen packages loaded from compiler export data (see exportedTypes)
+	exportMu    sync.Mutex
+	exporter    types.Importer
+	exportFiles map[string]string
+
+	// Notes that don't stop the port (io.Discard unless set with SetLog)
+	log io.Writer
+
+	// Suggested directives for symbols that could not be ported
+	suggestions []base.InlineSuggestion
 }
 
 type versionPin struct {
 	version  string
 	pinTo    string
 	imported bool
+
+	// Looking for the lowest version that works (nil once it's over or if the module is not searched)
+	search *versionSearch
+
+	// Replacement the workspace already had (in go.work or go.mod), the module is not pinned
+	replace *pkg2.Module
 }
 
 func (pin versionPin) isPinned() bool {
 	return pin.pinTo != ""
 }
 
-func NewContext() *Context {
-	return &Context{
-		handles: make(map[*pkg2.Package]*Handle),
-		pins:    make(map[string]versionPin),
+// The module is replaced by a local directory, its packages are ported in place instead of being imported
+func (pin versionPin) isLocal() bool {
+	return pin.replace != nil && pin.replace.Version == ""
+}
+
+func NewContext(sess *base.Session) *Context {
+	ctx := &Context{
+		sess:       sess,
+		handles:    make(map[*pkg2.Package]*Handle),
+		pins:       make(map[string]versionPin),
+		strategies: make(map[string]Strategy, len(defaultStrategies)),
+		log:        io.Discard,
+	}
+	for _, strategy := range defaultStrategies {
+		ctx.AddStrategy(strategy)
 	}
+	return ctx
+}
+
+// Report notes that don't stop the port to w
+func (ctx *Context) SetLog(w io.Writer) {
+	ctx.log = w
 }
 
 func (ctx *Context) GetHandle(pkg *pkg2.Package) *Handle {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
 	if ctx.handles[pkg] == nil {
 		ctx.handles[pkg] = &Handle{
 			pkg: pkg,
@@ -43,20 +96,104 @@ func (ctx *Context) GetHandle(pkg *pkg2.Package) *Handle {
 	return ctx.handles[pkg]
 }
 
+// Recognize an additional kind of type errors, strategies get to fix errors of that kind (see Attempt.Errors)
+//
+// Classifiers are tried in the order they were added, before the kinds pkg2 recognizes itself
+func (ctx *Context) AddClassifier(cl pkg2.Classifier) {
+	ctx.classifiers = append(ctx.classifiers, cl)
+}
+
+// Handle of an already registered package (safe to call while packages are refreshed)
+func (ctx *Context) handleOf(pkg *pkg2.Package) *Handle {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.handles[pkg]
+}
+
+// Refresh the type data of a layer of packages using up to jobs workers
+//
+// Packages of a layer never import each other, so they can be type checked in any order
+func (ctx *Context) RefreshAll(handles []*Handle, jobs int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	queue := make(chan *Handle)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < len(handles); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for handle := range queue {
+				handle.Refresh()
+			}
+		}()
+	}
+
+	for _, handle := range handles {
+		queue <- handle
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// Release the syntax of packages that are done with once more memory than the limit is in use
+//
+// Trades memory for CPU, the syntax is parsed again if it turns out to be needed (a limit of 0 disables this).
+// Parsing again adds the file to the session's file set once more, the file set only grows
+// (by the line tables of the files, a small fraction of their syntax trees)
+func (ctx *Context) TrimSyntax(limit uint64) {
+	if limit == 0 {
+		return
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc <= limit {
+		return
+	}
+
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	for pkg, handle := range ctx.handles {
+		// Packages that still need porting keep their syntax (their type errors point into it)
+		if handle.exhausted || handle.patched || (handle.built && len(handle.errs) == 0 && !handle.incomplete) {
+			pkg.ReleaseSyntax()
+		}
+	}
+	runtime.GC()
+}
+
 func (ctx *Context) CollectPins() []base.ModulePin {
 	pins := make([]base.ModulePin, 0, len(ctx.pins))
 	for path, pin := range ctx.pins {
-		pins = append(pins, base.ModulePin{
+		modPin := base.ModulePin{
 			Path:     path,
 			Version:  pin.version,
 			Pinned:   pin.pinTo,
 			Imported: pin.imported,
-		})
+		}
+		if pin.replace != nil {
+			modPin.Replace = pin.replace.Path
+			modPin.Pinned = pin.replace.Version
+			if pin.isLocal() {
+				modPin.Local = true
+				modPin.Dir = pin.replace.Dir
+			}
+		}
+		pins = append(pins, modPin)
 	}
 	return pins
 }
 
+func (ctx *Context) CollectSuggestions() []base.InlineSuggestion {
+	return ctx.suggestions
+}
+
 func (ctx *Context) CollectPatches() []base.PackagePatch {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
 	patches := make([]base.PackagePatch, 0, 20)
 	for pkg, handle := range ctx.handles {
 		if !handle.patched {
@@ -81,28 +218,55 @@ func (ctx *Context) CollectPatches() []base.PackagePatch {
 			fileAction.Name = gofile.Name
 			fileAction.Build = true
 			fileAction.Cached = gofile.Path
-			fileAction.Syntax = gofile.Syntax
+			syntax, err := gofile.SyntaxWithComments()
+			if err != nil {
+				handle.panic(fmt.Sprintf("unable to load syntax of %v: %v", gofile.Name, err))
+			}
+			fileAction.Syntax = syntax
 
 			if gofile.Replaced != nil {
 				repl := gofile.Replaced.File
 				fileAction.BaseFile = repl.Name
 
-				for iname, symbols := range gofile.Replaced.Reason.(map[string]map[string]base.ExportInline) {
-					for symname, ed := range symbols {
-						var repstr string
-						switch ed.Type {
-						case base.InlineExportSym:
-							repstr = iname + "." + ed.Replace
-						case base.InlineConstSym:
-							repstr = ed.Replace
-						default:
-							handle.panic("unknown export directive type")
+				switch reason := gofile.Replaced.Reason.(type) {
+				case *fileEdit:
+					for iname, symbols := range reason.exports {
+						for symname, ed := range symbols {
+							var repstr string
+							switch ed.Type {
+							case base.InlineExportSym:
+								repstr = iname + "." + ed.Replace
+							case base.InlineConstSym, base.InlineTemplateSym:
+								repstr = ed.Replace
+							default:
+								handle.panic("unknown export directive type")
+							}
+							fileAction.Symbols = append(fileAction.Symbols, base.SymbolRepl{
+								Original: fmt.Sprintf("%v.%v", iname, symname),
+								New:      repstr,
+							})
+						}
+					}
+
+					members := make(map[string]bool, len(reason.members))
+					for _, medit := range reason.members {
+						original := fmt.Sprintf("%v.%v", medit.pkgName, medit.member)
+						if members[original] {
+							continue
 						}
+						members[original] = true
 						fileAction.Symbols = append(fileAction.Symbols, base.SymbolRepl{
-							Original: fmt.Sprintf("%v.%v", iname, symname),
-							New:      repstr,
+							Original: original,
+							New:      fmt.Sprintf("%v.%v", strings.TrimSuffix(original, medit.member[strings.LastIndexByte(medit.member, '.'):]), medit.ed.Replace),
 						})
 					}
+				case borrowedDecls:
+					fileAction.Borrowed = reason
+				case conversions:
+					fileAction.Symbols = append(fileAction.Symbols, reason...)
+				case replacedSource:
+				default:
+					handle.panic("unknown reason for replaced file")
 				}
 			}
 
@@ -114,9 +278,16 @@ func (ctx *Context) CollectPatches() []base.PackagePatch {
 			var fileAction base.FilePatch
 			fileAction.Name = gofile.Name
 			fileAction.Build = false
+			syntax, err := gofile.SyntaxWithComments()
+			if err != nil {
+				handle.panic(fmt.Sprintf("unable to load syntax of %v: %v", gofile.Name, err))
+			}
+			fileAction.Syntax = syntax
 			files = append(files, fileAction)
 		}
 
+		handle.recordCleanups(files)
+
 		patches = append(patches, base.PackagePatch{
 			Path:   pkg.Meta.ImportPath,
 			Module: pkg.Meta.Module.Path,
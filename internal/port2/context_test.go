@@ -0,0 +1,128 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+func TestTrimSyntax(t *testing.T) {
+	sess := testSession(t)
+	// Always past the limit
+	sess.MemoryLimit = 1
+
+	ctx := NewContext(sess)
+	frozen := ctx.GetHandle(testPackage(t, sess, map[string]string{
+		"p.go":       "package p\n\nfunc G() int { return F() }\n",
+		"f_linux.go": "package p\n\nfunc F() int { return 1 }\n",
+	}, []string{"f_linux.go"}))
+	frozen.pkg.Meta.Standard = true
+	frozen.types, frozen.errs = frozen.typeCheck(0, defaultTypeConfig())
+	frozen.MarkExhausted()
+
+	// Still needs porting, its type errors point into its syntax
+	broken := ctx.GetHandle(testPackage(t, sess, map[string]string{
+		"p.go": "package p\n\nfunc G() int { return F() }\n",
+	}, nil))
+	broken.types, broken.errs = broken.typeCheck(0, defaultTypeConfig())
+	if len(broken.errs) == 0 {
+		t.Fatal("expected F to be missing")
+	}
+
+	ctx.TrimSyntax(sess.MemoryLimit)
+
+	if frozen.pkg.Builds[0].Syntax != nil || frozen.pkg.Files["p.go"].Syntax != nil {
+		t.Fatal("syntax of the frozen package was kept")
+	}
+	if broken.pkg.Builds[0].Syntax == nil {
+		t.Fatal("syntax of the package that still needs porting was released")
+	}
+
+	// Syntax is parsed again when the package turns out to be needed
+	typed, errs := frozen.typeCheck(0, defaultTypeConfig())
+	if len(errs) != 0 || typed.Scope().Lookup("F") == nil {
+		t.Fatalf("reloaded syntax type checks with errors %v", errs)
+	}
+	if syntax := frozen.pkg.Builds[0].Syntax; len(syntax) != 2 || syntax[0] != frozen.pkg.Files["p.go"].Syntax {
+		t.Errorf("config got syntax %v after reloading", syntax)
+	}
+}
+
+func TestCollectPatchesKeepsComments(t *testing.T) {
+	sess := testSession(t)
+	handle := testHandle(t, sess, map[string]string{
+		"p.go":       "package p\n\nfunc G() int { return F() }\n",
+		"f_linux.go": "package p\n\n// F is only declared on linux\nfunc F() int { return 1 }\n",
+	}, nil, []string{"f_linux.go"})
+	handle.pkg.Meta.Module = &pkg2.Module{Path: "example.com/p"}
+	handle.buildIdx, handle.patched = 1, true
+	handle.types, handle.errs = handle.typeCheck(1, defaultTypeConfig())
+
+	// Syntax used for type checking has no comments, the files written out keep them
+	if gofile := handle.pkg.Files["f_linux.go"]; gofile.Syntax == nil || len(gofile.Syntax.Comments) > 0 {
+		t.Fatalf("type checked syntax %v", gofile.Syntax)
+	}
+
+	patches := handle.ctx.CollectPatches()
+	if len(patches) != 1 || len(patches[0].Files) != 1 {
+		t.Fatalf("got patches %+v", patches)
+	}
+	file := patches[0].Files[0]
+	if file.Name != "f_linux.go" || !file.Build || len(file.Syntax.Comments) != 1 {
+		t.Errorf("patched %v (build %v) with comments %v", file.Name, file.Build, file.Syntax.Comments)
+	}
+}
+
+// Meant to be run with -race as well, the layer is refreshed by several workers
+func TestRefreshAllParallel(t *testing.T) {
+	refresh := func(jobs int) []*Handle {
+		sess := testSession(t)
+		ctx := NewContext(sess)
+
+		dep := testPackage(t, sess, map[string]string{"d.go": "package dep\n\nfunc D() int { return 1 }\n"}, nil)
+		dep.Meta.ImportPath, dep.Meta.Name = "example.com/dep", "dep"
+		dep.Dirty = true
+		ctx.RefreshAll([]*Handle{ctx.GetHandle(dep)}, jobs)
+
+		handles := make([]*Handle, 0, 8)
+		for idx := 0; idx < cap(handles); idx++ {
+			// Every other package uses a name dep doesn't declare
+			name := "D"
+			if idx%2 == 1 {
+				name = "E"
+			}
+			pkg := testPackage(t, sess, map[string]string{
+				"p.go": fmt.Sprintf("package p\n\nimport \"example.com/dep\"\n\nfunc G%v() int { return dep.%v() }\n", idx, name),
+			}, nil)
+			pkg.Meta.ImportPath = fmt.Sprintf("example.com/p%v", idx)
+			pkg.Files["p.go"].Imports = map[string]string{"dep": "example.com/dep"}
+			pkg.Imports = map[string]*pkg2.Package{"example.com/dep": dep}
+			pkg.Dirty, pkg.Included = true, true
+			handles = append(handles, ctx.GetHandle(pkg))
+		}
+		ctx.RefreshAll(handles, jobs)
+		return handles
+	}
+
+	sequential, parallel := refresh(1), refresh(4)
+	for idx := range sequential {
+		seq, par := sequential[idx], parallel[idx]
+		if !seq.built || !par.built || seq.types == nil || par.types == nil {
+			t.Fatalf("p%v: not refreshed", idx)
+		}
+		if seq.types.Path() != par.types.Path() || fmt.Sprint(seq.types.Scope().Names()) != fmt.Sprint(par.types.Scope().Names()) {
+			t.Errorf("p%v: refreshed to %v %v, sequentially %v %v", idx, par.types.Path(), par.types.Scope().Names(), seq.types.Path(), seq.types.Scope().Names())
+		}
+		if fmt.Sprint(seq.errs) != fmt.Sprint(par.errs) {
+			t.Errorf("p%v: refreshed with errors %v, sequentially %v", idx, par.errs, seq.errs)
+		}
+		if len(seq.errs) != idx%2 {
+			t.Errorf("p%v: got errors %v", idx, seq.errs)
+		}
+	}
+}
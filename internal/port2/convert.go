@@ -0,0 +1,289 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/tags"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Packages whose types are known to use different integer widths across platforms
+var conversionBoundaries = map[string]bool{
+	"syscall":               true,
+	"golang.org/x/sys/unix": true,
+}
+
+// Expressions wrapped in explicit conversions (used as the reason of a pkg2.ReplacedFile)
+type conversions []base.SymbolRepl
+
+// A conversion to splice into a file
+type conversion struct {
+	start, end int
+	to         string
+}
+
+// Repair integer type mismatches at syscall boundaries in the given config using explicit conversions
+//
+// Only applies to modules that opted in, a value must either come from or be passed to a package
+// in conversionBoundaries. If anything was converted a new config is added using patched copies
+// of the files, otherwise the config is returned as is.
+func (handle *Handle) convertTypes(build int, typed *types.Package, errs []pkg2.TypeError) (int, *types.Package, []pkg2.TypeError) {
+	pkg := handle.pkg
+	if pkg.Meta.Module == nil || !handle.ctx.sess.ModuleOptions(pkg.Meta.Module.Path).Convert {
+		return build, typed, errs
+	}
+
+	bad := make([]pkg2.TypeError, 0, 4)
+	for _, err := range errs {
+		if _, ok := err.Reason.(pkg2.TCBadAssign); ok {
+			bad = append(bad, err)
+		}
+	}
+	if len(bad) == 0 {
+		return build, typed, errs
+	}
+
+	cfg := pkg.Builds[build]
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	handle.typeCheckInfo(cfg.Syntax, defaultTypeConfig(), info)
+
+	// File Index -> Conversions
+	edits := make(map[int][]conversion)
+	for _, err := range bad {
+		reason := err.Reason.(pkg2.TCBadAssign)
+		pos := err.Err.Fset.Position(err.Err.Pos)
+
+		fidx := -1
+		for idx, gofile := range cfg.Files {
+			if gofile.Name == pos.Filename && gofile.Replaced == nil {
+				fidx = idx
+			}
+		}
+		if fidx < 0 {
+			continue
+		}
+
+		syntax := cfg.Syntax[fidx]
+		path, _ := astutil.PathEnclosingInterval(syntax, err.Err.Pos, err.Err.Pos)
+
+		// The operand is the outermost expression starting where the error was reported
+		oidx := -1
+		for idx, node := range path {
+			if _, ok := node.(ast.Expr); !ok || node.Pos() != err.Err.Pos {
+				break
+			}
+			if _, ok := node.(*ast.KeyValueExpr); ok {
+				break
+			}
+			oidx = idx
+		}
+		if oidx < 0 || oidx+1 >= len(path) {
+			continue
+		}
+		operand := path[oidx].(ast.Expr)
+
+		tv, ok := info.Types[operand]
+		if !ok || !isInteger(tv.Type) {
+			continue
+		}
+		if !handle.integerTypeName(reason.To, cfg.Files[fidx]) {
+			continue
+		}
+		if !touchesBoundary(operand, info) && !touchesBoundary(destinationOf(operand, path[oidx+1:]), info) {
+			continue
+		}
+
+		edits[fidx] = append(edits[fidx], conversion{
+			start: handle.ctx.sess.FileSet.Position(operand.Pos()).Offset,
+			end:   handle.ctx.sess.FileSet.Position(operand.End()).Offset,
+			to:    reason.To,
+		})
+	}
+	if len(edits) == 0 {
+		return build, typed, errs
+	}
+
+	pkgCacheDir := filepath.Join(handle.ctx.sess.Cache, pkg.Meta.ImportPath)
+	if err := os.MkdirAll(pkgCacheDir, 0740); err != nil {
+		return build, typed, errs
+	}
+
+	files := append([]*pkg2.GoFile(nil), cfg.Files...)
+	generated := make([]*pkg2.GoFile, 0, len(edits))
+	for fidx, convs := range edits {
+		repl, err := handle.convertFile(cfg.Files[fidx], convs, pkgCacheDir)
+		if err != nil {
+			return build, typed, errs
+		}
+		files[fidx] = repl
+		generated = append(generated, repl)
+	}
+
+	platforms := cfg.Platforms
+	if len(platforms) == 0 {
+		platforms = []string{handle.ctx.sess.GOOS()}
+	}
+
+	cbuild, err := pkg.AddBuild(platforms, files)
+	if err != nil {
+		return build, typed, errs
+	}
+
+	// Generated files are part of the package now (needed to resolve imports in type errors)
+	for _, gofile := range generated {
+		pkg.Files[gofile.Name] = gofile
+	}
+
+	ctyped, cerrs := handle.typeCheck(cbuild, defaultTypeConfig())
+	return cbuild, ctyped, cerrs
+}
+
+// Write a copy of the file with the given expressions wrapped in conversions
+func (handle *Handle) convertFile(gofile *pkg2.GoFile, convs []conversion, cache string) (*pkg2.GoFile, error) {
+	src, err := os.ReadFile(gofile.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every config converting the file gets its own copy
+	name := handle.copyName(gofile)
+	cpath := filepath.Join(cache, name)
+
+	// Splice from the back so offsets stay valid
+	sort.Slice(convs, func(i, j int) bool {
+		return convs[i].start > convs[j].start
+	})
+
+	repls := make(conversions, 0, len(convs))
+	for idx, conv := range convs {
+		if idx > 0 && convs[idx-1].start == conv.start {
+			continue
+		}
+		expr := string(src[conv.start:conv.end])
+		wrapped := conv.to + "(" + expr + ")"
+		src = append(src[:conv.start:conv.start], append([]byte(wrapped), src[conv.end:]...)...)
+		repls = append(repls, base.SymbolRepl{
+			Original: expr,
+			New:      wrapped,
+		})
+	}
+
+	// Report conversions in the order they appear in the file
+	for i, j := 0, len(repls)-1; i < j; i, j = i+1, j-1 {
+		repls[i], repls[j] = repls[j], repls[i]
+	}
+
+	syntax, err := parser.ParseFile(handle.ctx.sess.FileSet, name, src, parser.AllErrors)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse converted file: %w", err)
+	}
+
+	if err := os.WriteFile(cpath, src, 0740); err != nil {
+		return nil, fmt.Errorf("unable to write converted file: %w", err)
+	}
+
+	return &pkg2.GoFile{
+		Name:    name,
+		Path:    cpath,
+		Cgo:     gofile.Cgo,
+		Syntax:  syntax,
+		Fset:    handle.ctx.sess.FileSet,
+		Tags:    tags.Supported{},
+		Imports: gofile.Imports,
+		Replaced: &pkg2.ReplacedFile{
+			File:   gofile,
+			Reason: repls,
+		},
+	}, nil
+}
+
+// Whether the type name (as reported in a type error) is an integer type
+func (handle *Handle) integerTypeName(name string, gofile *pkg2.GoFile) bool {
+	dot := strings.IndexByte(name, '.')
+	if dot < 0 {
+		if obj, ok := types.Universe.Lookup(name).(*types.TypeName); ok {
+			return isInteger(obj.Type())
+		}
+		return false
+	}
+
+	// Qualified types are only converted to if they come from a boundary package
+	ipath := gofile.Imports[name[:dot]]
+	if !conversionBoundaries[ipath] {
+		return false
+	}
+	ih := handle.ctx.handles[handle.pkg.Imports[ipath]]
+	if ih == nil || ih.types == nil {
+		return false
+	}
+	if obj, ok := ih.types.Scope().Lookup(name[dot+1:]).(*types.TypeName); ok {
+		return isInteger(obj.Type())
+	}
+	return false
+}
+
+// The node a value is assigned to (or passed to), given the path enclosing the value
+func destinationOf(operand ast.Expr, path []ast.Node) ast.Node {
+	parent := path[0]
+	if kv, ok := parent.(*ast.KeyValueExpr); ok && kv.Value == operand && len(path) > 1 {
+		parent, operand = path[1], kv
+	}
+
+	switch parent := parent.(type) {
+	case *ast.CallExpr:
+		return parent.Fun
+	case *ast.AssignStmt:
+		for idx, rhs := range parent.Rhs {
+			if rhs == operand && len(parent.Lhs) == len(parent.Rhs) {
+				return parent.Lhs[idx]
+			}
+		}
+	case *ast.CompositeLit:
+		return parent.Type
+	}
+	return nil
+}
+
+// Whether the node refers to anything declared by a boundary package
+func touchesBoundary(node ast.Node, info *types.Info) bool {
+	if node == nil {
+		return false
+	}
+
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if obj := info.Uses[ident]; obj != nil && obj.Pkg() != nil && conversionBoundaries[obj.Pkg().Path()] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func isInteger(typ types.Type) bool {
+	basic, ok := typ.Underlying().(*types.Basic)
+	return ok && basic.Info()&types.IsInteger != 0
+}
@@ -0,0 +1,66 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+func TestRetagConvertsEveryCandidate(t *testing.T) {
+	sess := testSession(t)
+	sess.Modules = map[string]*base.ModuleConfig{"example.com/p": {Convert: true}}
+
+	pkg := testPackage(t, sess, map[string]string{
+		"p.go":        "package p\n\nimport \"syscall\"\n\nfunc G(uid int) error { return syscall.Setuid(uid) }\n",
+		"a_linux.go":  "package p\n\nfunc A() int { return undefined }\n",
+		"a_darwin.go": "package p\n\nfunc A() int { return 1 }\n",
+	},
+		nil,
+		[]string{"a_linux.go"},
+		[]string{"a_darwin.go"},
+	)
+	pkg.Meta.Module = &pkg2.Module{Path: "example.com/p"}
+	pkg.Files["p.go"].Imports = map[string]string{"syscall": "syscall"}
+
+	// Stand in for syscall with a narrower argument than the callers use
+	src, err := parser.ParseFile(sess.FileSet, "syscall.go", "package syscall\n\nfunc Setuid(uid int32) error { return nil }\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	systypes, err := (&types.Config{}).Check("syscall", sess.FileSet, []*ast.File{src}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syspkg := &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: "syscall", Name: "syscall"}}
+	pkg.Imports = map[string]*pkg2.Package{"syscall": syspkg}
+
+	ctx := NewContext(sess)
+	ctx.GetHandle(syspkg).types = systypes
+	handle := ctx.GetHandle(pkg)
+	handle.types, handle.errs = handle.typeCheck(0, defaultTypeConfig())
+
+	// The linux config is converted but still broken, the darwin config needs the same conversion
+	if _, ok := handle.retag(false); !ok {
+		t.Fatalf("no config was selected, type errors %v", handle.errs)
+	}
+	if handle.platformIdx != 2 || handle.buildIdx != pkg.PlatformBuilds || len(pkg.Builds) != pkg.PlatformBuilds+1 {
+		t.Fatalf("selected config %v (platform config %v) out of %v", handle.buildIdx, handle.platformIdx, len(pkg.Builds))
+	}
+	if got, want := buildFiles(pkg.Builds[handle.buildIdx]), "p_zos.go a_darwin.go"; got != want {
+		t.Errorf("selected %v, want %v", got, want)
+	}
+	if len(handle.errs) != 0 {
+		t.Errorf("selected config has errors %v", handle.errs)
+	}
+	if len(pkg.Files) != 4 {
+		t.Errorf("package has %v files, the rejected conversion was kept", len(pkg.Files))
+	}
+}
@@ -0,0 +1,75 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"fmt"
+	goimporter "go/importer"
+	"go/types"
+	"io"
+	"os"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+// Load the types of a frozen package from the export data the compiler produced for it
+//
+// All packages loaded this way share one importer, so a package is only loaded from export data
+// if all of its imports were too (otherwise objects of the same import would not be identical).
+// Returns nil if the package has to be type checked from source.
+func (handle *Handle) exportedTypes() *types.Package {
+	pkg := handle.pkg
+	if !pkg2.IsFrozenPkg(pkg) || pkg.Meta.Export == "" {
+		return nil
+	}
+
+	for _, gofile := range pkg.Builds[handle.buildIdx].Files {
+		for _, ipath := range gofile.Imports {
+			if ipath == pkg2.UNSAFE_PACKAGE_NAME || ipath == pkg2.CGO_PACKAGE_NAME {
+				continue
+			}
+			if ih := handle.ctx.handleOf(pkg.Imports[ipath]); ih == nil || !ih.exported {
+				return nil
+			}
+		}
+	}
+
+	ctx := handle.ctx
+	ctx.exportMu.Lock()
+	defer ctx.exportMu.Unlock()
+
+	if ctx.exporter == nil {
+		ctx.exportFiles = make(map[string]string)
+		ctx.exporter = goimporter.ForCompiler(ctx.sess.FileSet, "gc", func(path string) (io.ReadCloser, error) {
+			file := ctx.exportFiles[path]
+			if file == "" {
+				return nil, fmt.Errorf("no export data for %v", path)
+			}
+			return os.Open(file)
+		})
+	}
+	ctx.exportFiles[pkg.Meta.ImportPath] = pkg.Meta.Export
+
+	typed, err := importExportData(ctx.exporter, pkg.Meta.ImportPath)
+	if err != nil {
+		// Type checking from source still works, the failure is only worth a note
+		fmt.Fprintf(ctx.log, "unable to load %v from export data, type checking it from source: %v\n", pkg.Meta.ImportPath, err)
+		return nil
+	}
+	return typed
+}
+
+// Read the export data of a package with the importer of the toolchain (golang.org/x/tools/go/gcexportdata
+// lags behind the format the compiler writes)
+//
+// Export data written by a different toolchain can make the importer panic, which is returned as an error
+func importExportData(imp types.Importer, path string) (typed *types.Package, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			typed, err = nil, fmt.Errorf("malformed export data: %v", r)
+		}
+	}()
+	return imp.Import(path)
+}
@@ -0,0 +1,67 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"bytes"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/util"
+)
+
+func TestExportedTypes(t *testing.T) {
+	exports, err := util.GoListExport(util.Env{}, []string{"unicode/utf8"})
+	if err != nil {
+		t.Fatalf("unable to list export data: %v", err)
+	}
+	if exports["unicode/utf8"] == "" {
+		t.Fatalf("no export data for unicode/utf8: %v", exports)
+	}
+
+	sess := testSession(t)
+	ctx := NewContext(sess)
+	var log bytes.Buffer
+	ctx.SetLog(&log)
+
+	// Frozen package without imports, the files are never read
+	frozen := func(path, export string) *Handle {
+		dir := t.TempDir()
+		gofile := &pkg2.GoFile{Name: "a.go", Path: filepath.Join(dir, "a.go"), Fset: sess.FileSet}
+		pkg := &pkg2.Package{
+			Meta:   &pkg2.MetaPackage{ImportPath: path, Name: filepath.Base(path), Dir: dir, Goroot: true, Standard: true, Export: export},
+			Builds: []pkg2.BuildConfig{{Files: []*pkg2.GoFile{gofile}}},
+		}
+		return ctx.GetHandle(pkg)
+	}
+
+	typed := frozen("unicode/utf8", exports["unicode/utf8"]).exportedTypes()
+	if typed == nil {
+		t.Fatalf("unicode/utf8 was not loaded from export data: %v", log.String())
+	}
+	runeLen, ok := typed.Scope().Lookup("RuneLen").(*types.Func)
+	if !ok {
+		t.Fatal("RuneLen missing from exported types")
+	}
+	if got, want := runeLen.Type().String(), "func(r rune) int"; got != want {
+		t.Errorf("RuneLen has type %v, want %v", got, want)
+	}
+
+	// Export data that cannot be read falls back to type checking, with a note in the log
+	bad := filepath.Join(t.TempDir(), "bad.a")
+	if err := os.WriteFile(bad, []byte("!<arch>\nnot export data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if typed := frozen("unicode/utf16", bad).exportedTypes(); typed != nil {
+		t.Errorf("loaded %v from malformed export data", typed)
+	}
+	if !strings.Contains(log.String(), "unable to load unicode/utf16 from export data") {
+		t.Errorf("failure was not logged: %q", log.String())
+	}
+}
@@ -6,7 +6,9 @@ package port2
 
 import (
 	"fmt"
+	"go/ast"
 	"go/types"
+	"strings"
 
 	"github.com/zosopentools/wharf/internal/pkg2"
 )
@@ -22,6 +24,20 @@ type Handle struct {
 
 	buildIdx int
 
+	// Whole platform config the selected config is based on, retag moves on from it
+	// (configs added while porting come after every whole platform config)
+	platformIdx int
+
+	// Key of the types in the persistent type cache, only valid while types is still keyedTypes
+	cacheKey   string
+	keyedTypes *types.Package
+
+	// Types were loaded from compiler export data
+	exported bool
+
+	// Names the parents expect the package to declare, kept for the current port attempt (see demands)
+	demanded map[string]bool
+
 	// Package has valid and complete type data for the current selected build
 	built      bool
 	incomplete bool
@@ -61,23 +77,47 @@ func (handle *Handle) Refresh() {
 	handle.included = handle.included || pkg.Included
 
 	if pkg.Dirty || pkg.DepDirty {
-		if len(pkg.Builds[handle.buildIdx].Syntax) == 0 {
+		tcfg := &types.Config{
+			IgnoreFuncBodies: !pkg.Included || pkg2.IsStdlibPkg(pkg),
+			FakeImportC:      true,
+		}
+		key := handle.typesKey(handle.buildIdx, tcfg)
+		handle.exported = false
+
+		if len(pkg.Builds[handle.buildIdx].Files) == 0 {
 			handle.types = types.NewPackage(pkg.Meta.ImportPath, pkg.Meta.Name)
 			handle.types.MarkComplete()
+		} else if typed := handle.exportedTypes(); typed != nil {
+			handle.types, handle.errs, handle.exported = typed, nil, true
+		} else if typed := handle.cachedTypes(key); typed != nil {
+			handle.types, handle.errs = typed, nil
 		} else {
-			tcfg := &types.Config{
-				IgnoreFuncBodies: !pkg.Included || pkg2.IsStdlibPkg(pkg),
-				FakeImportC:      true,
-			}
 			handle.types, handle.errs = handle.typeCheck(handle.buildIdx, tcfg)
+			if len(handle.errs) > 0 {
+				key = ""
+			}
+			handle.storeTypes(key, handle.types)
 		}
+		handle.cacheKey, handle.keyedTypes = key, handle.types
 		handle.built = true
 	}
 }
 
 func (handle *Handle) typeCheck(build int, cfg *types.Config) (typed *types.Package, errs []pkg2.TypeError) {
+	if err := handle.pkg.LoadSyntax(build); err != nil {
+		handle.panic(fmt.Sprintf("unable to load syntax: %v", err))
+	}
+	return handle.typeCheckFiles(handle.pkg.Builds[build].Syntax, cfg)
+}
+
+func (handle *Handle) typeCheckFiles(files []*ast.File, cfg *types.Config) (typed *types.Package, errs []pkg2.TypeError) {
+	return handle.typeCheckInfo(files, cfg, nil)
+}
+
+// Type check the files while recording the given type information
+func (handle *Handle) typeCheckInfo(files []*ast.File, cfg *types.Config, info *types.Info) (typed *types.Package, errs []pkg2.TypeError) {
 	cfg.Error = func(err error) {
-		errs = append(errs, pkg2.NewTypeCheckError(err.(types.Error)))
+		errs = append(errs, pkg2.ClassifyTypeError(err.(types.Error), handle.ctx.classifiers))
 	}
 
 	cfg.Importer = (importer)(func(path string) (*types.Package, error) {
@@ -90,7 +130,7 @@ func (handle *Handle) typeCheck(build int, cfg *types.Config) (typed *types.Pack
 			handle.panic(fmt.Sprintf("unknown imported package %v requested during type check", path))
 		}
 
-		ih := handle.ctx.handles[ipkg]
+		ih := handle.ctx.handleOf(ipkg)
 		if ih == nil {
 			handle.panic(fmt.Sprintf("imported package %v with uninitialized state found during type check", path))
 		}
@@ -102,10 +142,22 @@ func (handle *Handle) typeCheck(build int, cfg *types.Config) (typed *types.Pack
 		return ih.types, nil
 	})
 
-	typed, _ = cfg.Check(handle.pkg.Meta.ImportPath, pkg2.FileSet, handle.pkg.Builds[build].Syntax, nil)
+	typed, _ = cfg.Check(handle.pkg.Meta.ImportPath, handle.ctx.sess.FileSet, files, info)
 	return
 }
 
+// Name for a generated copy of the file that no file of the package uses yet
+//
+// Copies keep the target platform as suffix so they are only built for it
+func (handle *Handle) copyName(gofile *pkg2.GoFile) string {
+	stem, goos := strings.TrimSuffix(gofile.Name, ".go"), handle.ctx.sess.GOOS()
+	name := fmt.Sprintf("%v_%v.go", stem, goos)
+	for n := 2; handle.pkg.Files[name] != nil; n++ {
+		name = fmt.Sprintf("%v_%v_%v.go", stem, n, goos)
+	}
+	return name
+}
+
 func (handle *Handle) panic(msg string) {
 	panic(fmt.Sprintf("%v: %v", handle.pkg.Meta.ImportPath, msg))
 }
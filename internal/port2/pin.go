@@ -0,0 +1,274 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/util"
+)
+
+// Bisection for the lowest version of a module that works for the package that started it
+//
+// Assumes that once a version works every version after it works too. The latest version is
+// tested first, if it doesn't work none of them do and the search ends after a single reload.
+type versionSearch struct {
+	// Import path of the package the versions are tested with
+	target string
+
+	// Packages of the module that worked at the version MVS selected (keyed by import path), only their
+	// failures rule a version out besides the target's (the others need porting at any version)
+	worked map[string]bool
+
+	// Versions after the one MVS selected (ascending)
+	candidates []string
+
+	// Candidates before lo don't work, candidates from hi on work (hi is len(candidates) until one does)
+	lo, hi int
+
+	// Candidate being tested
+	probe int
+}
+
+func newVersionSearch(target string, candidates []string) *versionSearch {
+	return &versionSearch{
+		target:     target,
+		candidates: candidates,
+		hi:         len(candidates),
+		probe:      len(candidates) - 1,
+	}
+}
+
+// Record whether the candidate being tested works and move on to the next one
+func (search *versionSearch) next(works bool) {
+	if works {
+		search.hi = search.probe
+	} else {
+		search.lo = search.probe + 1
+	}
+	search.probe = search.lo + (search.hi-search.lo)/2
+}
+
+func (search *versionSearch) done() bool {
+	return search.lo >= search.hi
+}
+
+// Lowest candidate known to work, false if none of them do
+func (search *versionSearch) result() (string, bool) {
+	if search.hi < len(search.candidates) {
+		return search.candidates[search.hi], true
+	}
+	return "", false
+}
+
+// Versions of the module a search goes through: releases after the one MVS selected
+func searchCandidates(versions []string, selected string) []string {
+	candidates := make([]string, 0, len(versions))
+	for _, version := range versions {
+		if !util.IsPrerelease(version) && util.CompareVersions(version, selected) > 0 {
+			candidates = append(candidates, version)
+		}
+	}
+	return candidates
+}
+
+// How the version of the module is picked, the module's selection overrides the run's
+func (ctx *Context) pinSearchFor(module *pkg2.Module) string {
+	if search := ctx.sess.ModuleOptions(module.Path).Pin; search != "" {
+		return search
+	}
+	if ctx.sess.PinSearch != "" {
+		return ctx.sess.PinSearch
+	}
+	return base.PinUpdate
+}
+
+func checkPinSearch(search string) error {
+	switch search {
+	case "", base.PinUpdate, base.PinMinimal:
+		return nil
+	}
+	return fmt.Errorf("unknown pin search %q (available: %v, %v)", search, base.PinUpdate, base.PinMinimal)
+}
+
+// Start looking for the lowest version of the module that works for the package
+//
+// Returns nil if there is no version after the one MVS selected (that the policy allows) to try.
+func (ctx *Context) startVersionSearch(pkg *pkg2.Package) (*versionSearch, error) {
+	module := pkg.Meta.Module
+	versions, err := util.GoListModVersions(ctx.sess.Env, module.Path)
+	if err != nil {
+		if pkg2.IsExcludeGoListError(err.Error()) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	candidates := searchCandidates(versions, module.Version)
+
+	// Only versions the policy allows are tried
+	violations, err := ctx.policyViolations(module, candidates)
+	if err != nil {
+		return nil, err
+	}
+	allowed := candidates[:0]
+	for _, version := range candidates {
+		if _, ok := violations[version]; !ok {
+			allowed = append(allowed, version)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+
+	search := newVersionSearch(pkg.Meta.ImportPath, allowed)
+	search.worked = make(map[string]bool)
+	for mpkg, handle := range ctx.handles {
+		if mpkg.Meta.Module != nil && mpkg.Meta.Module.Path == module.Path && handle.built && len(handle.errs) == 0 && !handle.incomplete {
+			search.worked[mpkg.Meta.ImportPath] = true
+		}
+	}
+	return search, nil
+}
+
+// Reasons the versions of the module break the version policy (keyed by version, versions that don't are left out)
+func (ctx *Context) policyViolations(module *pkg2.Module, versions []string) (map[string]string, error) {
+	policy := ctx.sess.Policy
+	violations := make(map[string]string)
+
+	remaining := make([]string, 0, len(versions))
+	for _, version := range versions {
+		switch {
+		case version == module.Version:
+			continue
+		case policy.Upgrade == base.UpgradePatch && !util.SameRelease(module.Version, version, true):
+			violations[version] = fmt.Sprintf("more than a patch upgrade from %v (upgrade: %v)", module.Version, policy.Upgrade)
+		case policy.Upgrade == base.UpgradeMinor && !util.SameRelease(module.Version, version, false):
+			violations[version] = fmt.Sprintf("more than a minor upgrade from %v (upgrade: %v)", module.Version, policy.Upgrade)
+		case !policy.AllowsPseudo() && util.IsPseudoVersion(version):
+			violations[version] = "pseudo-version (pseudo: false)"
+		default:
+			remaining = append(remaining, version)
+		}
+	}
+
+	if policy.Go == "" || len(remaining) == 0 {
+		return violations, nil
+	}
+
+	goVersions, err := util.GoListModGoVersions(ctx.sess.Env, module.Path, remaining)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range remaining {
+		if goVersion := goVersions[version]; goVersion != "" && util.CompareGoVersions(goVersion, policy.Go) > 0 {
+			violations[version] = fmt.Sprintf("requires go %v (go: %v)", goVersion, policy.Go)
+		}
+	}
+	return violations, nil
+}
+
+// Version the update search pins the module to: the latest version or the highest one the policy allows
+//
+// Fails if there are versions after the one MVS selected but the policy allows none of them,
+// stays at the version MVS selected if there is nothing to update to.
+func (ctx *Context) updateVersion(module *pkg2.Module) (string, error) {
+	latest, err := util.GoListModUpdate(ctx.sess.Env, module.Path)
+	if err != nil {
+		if pkg2.IsExcludeGoListError(err.Error()) {
+			return module.Version, nil
+		}
+		return "", err
+	}
+
+	policyErr := ctx.checkPolicy(module, latest)
+	if policyErr == nil {
+		return latest, nil
+	}
+
+	versions, err := util.GoListModVersions(ctx.sess.Env, module.Path)
+	if err != nil {
+		return "", err
+	}
+	if version, ok, err := ctx.highestAllowed(module, searchCandidates(versions, module.Version)); err != nil {
+		return "", err
+	} else if ok {
+		return version, nil
+	}
+	return "", policyErr
+}
+
+// Highest of the versions (ascending) that the policy allows, false if it allows none of them
+func (ctx *Context) highestAllowed(module *pkg2.Module, versions []string) (string, bool, error) {
+	violations, err := ctx.policyViolations(module, versions)
+	if err != nil {
+		return "", false, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if _, ok := violations[versions[i]]; !ok {
+			return versions[i], true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Verify the module may be pinned to the version, the error tells how to get past the policy
+func (ctx *Context) checkPolicy(module *pkg2.Module, version string) error {
+	violations, err := ctx.policyViolations(module, []string{version})
+	if err != nil {
+		return err
+	}
+	if reason, ok := violations[version]; ok {
+		return fmt.Errorf(
+			"%v: pinning %v breaks the version policy: %v\n"+
+				"\tpin an allowed version in go.work, change the policy in the config, "+
+				"or deny the module to port it at %v",
+			module.Path, version, reason, module.Version,
+		)
+	}
+	return nil
+}
+
+// Version of every module in the build list of the workspace (keyed by path)
+//
+// Taken before the port starts, CollectBuildChanges compares it to the build list with the pins.
+func (ctx *Context) BuildList() (map[string]string, error) {
+	return util.GoListModAll(ctx.sess.Env)
+}
+
+// Changes the pins made to the build list since it was taken (see BuildList)
+func (ctx *Context) CollectBuildChanges(before map[string]string) ([]base.BuildChange, error) {
+	after, err := ctx.BuildList()
+	if err != nil {
+		return nil, err
+	}
+	return diffBuildLists(before, after, ctx.pins), nil
+}
+
+func diffBuildLists(before, after map[string]string, pins map[string]versionPin) []base.BuildChange {
+	changes := make([]base.BuildChange, 0)
+	for path, version := range before {
+		if after[path] != version {
+			changes = append(changes, base.BuildChange{Path: path, Before: version, After: after[path]})
+		}
+	}
+	for path, version := range after {
+		if _, ok := before[path]; !ok {
+			changes = append(changes, base.BuildChange{Path: path, After: version})
+		}
+	}
+
+	for i := range changes {
+		changes[i].Pinned = pins[changes[i].Path].isPinned()
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
@@ -0,0 +1,214 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/util"
+)
+
+func TestVersionSearch(t *testing.T) {
+	versions := []string{"v1.0.0", "v1.1.0", "v1.2.0-rc.1", "v1.2.0", "v1.3.0", "v1.4.0", "v1.5.0", "v1.6.0", "v2.0.0"}
+	candidates := searchCandidates(versions, "v1.1.0")
+	if len(candidates) != 6 || candidates[0] != "v1.2.0" || candidates[5] != "v2.0.0" {
+		t.Fatalf("got candidates %v", candidates)
+	}
+
+	tests := []struct {
+		first string // Lowest version that works, empty if none do
+		want  string
+		most  int
+	}{
+		{"v1.2.0", "v1.2.0", 4},
+		{"v1.4.0", "v1.4.0", 4},
+		{"v2.0.0", "v2.0.0", 4},
+		{"", "", 1},
+	}
+	for _, test := range tests {
+		search := newVersionSearch("example.com/m", candidates)
+		probes := 0
+		for !search.done() {
+			probes++
+			version := search.candidates[search.probe]
+			search.next(test.first != "" && util.CompareVersions(version, test.first) >= 0)
+		}
+
+		got, ok := search.result()
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("first working %q: got %q", test.first, got)
+		}
+		if probes > test.most {
+			t.Errorf("first working %q: took %v probes, want at most %v", test.first, probes, test.most)
+		}
+	}
+}
+
+func TestPolicyViolations(t *testing.T) {
+	sess := testSession(t)
+	pseudo := false
+	sess.Policy = base.Policy{Upgrade: base.UpgradeMinor, Pseudo: &pseudo}
+	ctx := NewContext(sess)
+
+	module := &pkg2.Module{Path: "example.com/m", Version: "v1.2.0"}
+	violations, err := ctx.policyViolations(module, []string{
+		"v1.2.0",
+		"v1.2.1",
+		"v1.5.0",
+		"v1.6.1-0.20230101000000-abcdefabcdef",
+		"v2.0.0+incompatible",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"v1.6.1-0.20230101000000-abcdefabcdef": "pseudo-version",
+		"v2.0.0+incompatible":                  "minor upgrade",
+	}
+	if len(violations) != len(want) {
+		t.Errorf("got violations %v", violations)
+	}
+	for version, reason := range want {
+		if !strings.Contains(violations[version], reason) {
+			t.Errorf("%v: got violation %q, want it to mention %q", version, violations[version], reason)
+		}
+	}
+}
+
+func TestHighestAllowed(t *testing.T) {
+	sess := testSession(t)
+	ctx := NewContext(sess)
+	module := &pkg2.Module{Path: "example.com/m", Version: "v1.2.0"}
+	candidates := searchCandidates([]string{"v1.2.0", "v1.2.1", "v1.2.3", "v1.3.0", "v2.0.0+incompatible"}, module.Version)
+
+	tests := []struct {
+		upgrade string
+		want    string
+	}{
+		{base.UpgradeAny, "v2.0.0+incompatible"},
+		{base.UpgradeMinor, "v1.3.0"},
+		{base.UpgradePatch, "v1.2.3"},
+	}
+	for _, test := range tests {
+		sess.Policy = base.Policy{Upgrade: test.upgrade}
+		got, ok, err := ctx.highestAllowed(module, candidates)
+		if err != nil || !ok || got != test.want {
+			t.Errorf("upgrade %v: got %v (%v, %v), want %v", test.upgrade, got, ok, err, test.want)
+		}
+	}
+
+	// Nothing the patch policy allows after a minor release
+	sess.Policy = base.Policy{Upgrade: base.UpgradePatch}
+	if got, ok, _ := ctx.highestAllowed(module, searchCandidates([]string{"v1.3.0", "v1.4.0"}, module.Version)); ok {
+		t.Errorf("got %v, want no allowed version", got)
+	}
+}
+
+func TestDiffBuildLists(t *testing.T) {
+	before := map[string]string{
+		"example.com/pinned":  "v1.0.0",
+		"example.com/moved":   "v1.1.0",
+		"example.com/same":    "v1.0.0",
+		"example.com/dropped": "v0.1.0",
+	}
+	after := map[string]string{
+		"example.com/pinned": "v1.3.0",
+		"example.com/moved":  "v1.0.0",
+		"example.com/same":   "v1.0.0",
+		"example.com/added":  "v0.2.0",
+	}
+	pins := map[string]versionPin{"example.com/pinned": {version: "v1.0.0", pinTo: "v1.3.0"}}
+
+	want := []base.BuildChange{
+		{Path: "example.com/added", After: "v0.2.0"},
+		{Path: "example.com/dropped", Before: "v0.1.0"},
+		{Path: "example.com/moved", Before: "v1.1.0", After: "v1.0.0"},
+		{Path: "example.com/pinned", Before: "v1.0.0", After: "v1.3.0", Pinned: true},
+	}
+	got := diffBuildLists(before, after, pins)
+	if len(got) != len(want) {
+		t.Fatalf("got changes %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got change %+v, want %+v", got[i], want[i])
+		}
+	}
+}
+
+func TestPinKeepsReplacements(t *testing.T) {
+	ctx := NewContext(testSession(t))
+
+	local := &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: "example.com/fork/p", Module: &pkg2.Module{
+		Path:    "example.com/fork",
+		Version: "v1.0.0",
+		Replace: &pkg2.Module{Path: "./fork", Dir: "/work/fork"},
+	}}}
+	replaced := &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: "example.com/old/p", Module: &pkg2.Module{
+		Path:    "example.com/old",
+		Version: "v1.0.0",
+		Replace: &pkg2.Module{Path: "example.com/new", Version: "v1.2.0"},
+	}}}
+
+	for _, pkg := range []*pkg2.Package{local, replaced} {
+		if changed, err := ctx.pin(pkg, false); err != nil || changed {
+			t.Fatalf("%v: replaced module was pinned (changed %v, error %v)", pkg.Meta.ImportPath, changed, err)
+		}
+	}
+
+	pins := make(map[string]base.ModulePin)
+	for _, pin := range ctx.CollectPins() {
+		pins[pin.Path] = pin
+	}
+	if pin := pins["example.com/fork"]; !pin.Local || pin.Dir != "/work/fork" || pin.Replace != "./fork" {
+		t.Errorf("local replacement reported as %+v", pin)
+	}
+	if pin := pins["example.com/old"]; pin.Local || pin.Replace != "example.com/new" || pin.Pinned != "v1.2.0" || pin.Version != "v1.0.0" {
+		t.Errorf("version replacement reported as %+v", pin)
+	}
+}
+
+func TestVersionSearchIgnoresBrokenPackages(t *testing.T) {
+	dir := t.TempDir()
+	gowork := filepath.Join(dir, "go.work")
+	if err := os.WriteFile(gowork, []byte("go 1.18\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sess := testSession(t)
+	sess.Env = util.Env{Dir: dir, Vars: []string{"GOWORK=" + gowork}}
+	ctx := NewContext(sess)
+
+	module := &pkg2.Module{Path: "example.com/m", Version: "v1.0.0"}
+	pkgOf := func(name string) *pkg2.Package {
+		return &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: "example.com/m/" + name, Module: module}}
+	}
+	target, broken, worked := pkgOf("target"), pkgOf("broken"), pkgOf("worked")
+
+	search := newVersionSearch(target.Meta.ImportPath, []string{"v1.1.0", "v1.2.0", "v1.3.0"})
+	search.worked = map[string]bool{worked.Meta.ImportPath: true}
+
+	// The latest version worked, v1.2.0 is being tested
+	search.next(true)
+	ctx.pins[module.Path] = versionPin{version: module.Version, pinTo: "v1.2.0", search: search}
+
+	// A package that needs porting at any version says nothing about the version being tested
+	if changed, err := ctx.pin(broken, false); err != nil || changed || search.probe != 1 {
+		t.Fatalf("failure of a broken package moved the search (changed %v, probe %v, error %v)", changed, search.probe, err)
+	}
+
+	// A package that worked at the version MVS selected rules it out
+	if changed, err := ctx.pin(worked, false); err != nil || !changed {
+		t.Fatalf("failure of a working package did not move the search (changed %v, error %v)", changed, err)
+	}
+	if pin := ctx.pins[module.Path]; pin.pinTo != "v1.3.0" || pin.search != nil {
+		t.Errorf("search pinned %v (still searching: %v), want v1.3.0", pin.pinTo, pin.search != nil)
+	}
+}
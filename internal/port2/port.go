@@ -7,9 +7,12 @@ package port2
 import (
 	"bytes"
 	"fmt"
+	"go/ast"
 	"go/parser"
+	"go/types"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/zosopentools/wharf/internal/base"
@@ -55,6 +58,13 @@ func (ctx *Context) Port(pkg *pkg2.Package) (Result, error) {
 	}
 
 	if len(handle.errs) == 0 && !handle.incomplete {
+		if !pkg.Meta.Module.Main {
+			if changed, err := ctx.pin(pkg, true); err != nil {
+				return RESULT_ERROR, err
+			} else if changed {
+				return RESULT_RELOAD, nil
+			}
+		}
 		if handle.buildIdx > 0 {
 			handle.patched = true
 		}
@@ -62,7 +72,7 @@ func (ctx *Context) Port(pkg *pkg2.Package) (Result, error) {
 	}
 
 	if !pkg.Meta.Module.Main {
-		if changed, err := ctx.pin(pkg.Meta.Module); err != nil {
+		if changed, err := ctx.pin(pkg, false); err != nil {
 			return RESULT_ERROR, err
 		} else if changed {
 			return RESULT_RELOAD, nil
@@ -72,6 +82,7 @@ func (ctx *Context) Port(pkg *pkg2.Package) (Result, error) {
 	baseId := handle.buildIdx
 	err := handle.port()
 	if err != nil {
+		handle.suggest()
 		return RESULT_ERROR, err
 	}
 
@@ -82,7 +93,7 @@ func (ctx *Context) Port(pkg *pkg2.Package) (Result, error) {
 	if handle.patched {
 		if !pkg.Meta.Module.Main {
 			pin := ctx.pins[pkg.Meta.Module.Path]
-			pin.imported = true
+			pin.imported = !pin.isLocal()
 			ctx.pins[pkg.Meta.Module.Path] = pin
 		}
 		return RESULT_PATCHED, nil
@@ -91,48 +102,110 @@ func (ctx *Context) Port(pkg *pkg2.Package) (Result, error) {
 	return RESULT_CONTINUE, err
 }
 
-func (ctx *Context) pin(module *pkg2.Module) (bool, error) {
+// Pin the module of a package that needs porting without porting it
+//
+// Used to batch pins before a single reload, returns true if the version of the module changed
+func (ctx *Context) Pin(pkg *pkg2.Package) (bool, error) {
+	handle := ctx.handles[pkg]
+	if handle == nil || !handle.included || handle.exhausted || handle.patched || pkg.Meta.Module.Main {
+		return false, nil
+	}
+
+	if !handle.built {
+		return false, nil
+	}
+
+	return ctx.pin(pkg, len(handle.errs) == 0 && !handle.incomplete)
+}
+
+func (ctx *Context) pin(pkg *pkg2.Package, works bool) (bool, error) {
 	var err error
+	module := pkg.Meta.Module
 	pin := ctx.pins[module.Path]
 
+	// A version search in progress is moved forward by every result it gets: the target or a package
+	// of the module that worked at the version MVS selected failing rules the version out, only the target confirms it works
+	if search := pin.search; search != nil {
+		if pkg.Meta.ImportPath != search.target && (works || !search.worked[pkg.Meta.ImportPath]) {
+			return false, nil
+		}
+
+		search.next(works)
+		pinTo := pin.version
+		if !search.done() {
+			pinTo = search.candidates[search.probe]
+		} else {
+			if version, ok := search.result(); ok {
+				pinTo = version
+			}
+			pin.search = nil
+		}
+		return ctx.pinVersion(module, pin, pinTo)
+	}
+
+	if works {
+		return false, nil
+	}
+
+	// Replacements that were there before the port are kept (the module is ported at the replacement)
+	if module.Replace != nil && !pin.isPinned() {
+		if pin.replace == nil {
+			ctx.pins[module.Path] = versionPin{version: module.Version, replace: module.Replace}
+		}
+		return false, nil
+	}
+
 	// First lock the version the module will use (using the following process):
 	//
 	// 1. If the module can be updated we try locking it to the updated version
+	//    (or search for the lowest version after the one MVS selected that works)
 	// 2. If we already tried the updated version then lock it to the original version determined by MVS
 	if module.Replace == nil || (pin.isPinned() && pin.pinTo != pin.version) {
 		pinTo := module.Version
-
-		if !pin.isPinned() {
-			pinTo, err = util.GoListModUpdate(module.Path)
-			if err != nil && !pkg2.IsExcludeGoListError(err.Error()) {
-				return false, err
+		pin = versionPin{version: module.Version, pinTo: pin.pinTo}
+
+		// Modules the policy keeps out are locked to the version MVS selected
+		if !pin.isPinned() && ctx.sess.Policy.Pinnable(module.Path) {
+			switch ctx.pinSearchFor(module) {
+			case base.PinMinimal:
+				if pin.search, err = ctx.startVersionSearch(pkg); err != nil {
+					return false, err
+				}
+				if pin.search != nil {
+					pinTo = pin.search.candidates[pin.search.probe]
+				}
+			default:
+				if pinTo, err = ctx.updateVersion(module); err != nil {
+					return false, err
+				}
 			}
 		}
 
-		if err = util.GoWorkEditReplaceVersion(
-			module.Path,
-			pinTo,
-		); err != nil {
-			return false, err
-		}
-
-		oldVer := pin.pinTo
-		if oldVer == "" {
-			oldVer = module.Version
-		}
+		return ctx.pinVersion(module, pin, pinTo)
+	}
 
-		ctx.pins[module.Path] = versionPin{
-			version: module.Version,
-			pinTo:   pinTo,
-		}
+	return false, nil
+}
 
-		if oldVer != pinTo {
-			return true, err
-		}
+// Replace the module with the given version in the workspace, returns true if its version changed
+func (ctx *Context) pinVersion(module *pkg2.Module, pin versionPin, pinTo string) (bool, error) {
+	if err := util.GoWorkEditReplaceVersion(
+		ctx.sess.Env,
+		module.Path,
+		pinTo,
+	); err != nil {
+		return false, err
+	}
 
+	oldVer := pin.pinTo
+	if oldVer == "" {
+		oldVer = module.Version
 	}
 
-	return false, nil
+	pin.pinTo = pinTo
+	ctx.pins[module.Path] = pin
+
+	return oldVer != pinTo, nil
 }
 
 // Run the build + port process on a package
@@ -141,35 +214,37 @@ func (handle *Handle) port() error {
 
 	// If this is the first time checking this package verify
 	// that it has errors before we begin our investigation
-	imports := make(map[*pkg2.Package]bool, 0)
-	needTag := handle.incomplete
+	incomplete := handle.incomplete
 	handle.incomplete = false
+	handle.demanded = nil
 
-	var illList []pkg2.TypeError
-	for _, err := range handle.errs {
-		if iname, ok := err.Reason.(pkg2.TCBadImportName); ok {
-			ipkg := pkg.LookupImport(iname.PkgName, err.Err.Fset.Position(err.Err.Pos).Filename)
+	strategies, err := handle.ctx.strategiesFor(pkg.Meta.Module)
+	if err != nil {
+		return err
+	}
 
-			if ipkg == nil {
-				handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, iname.PkgName))
-			}
-			if handle.ctx.handles[ipkg].exhausted {
-				needTag = true
-			} else {
-				imports[ipkg] = true
-			}
+	// Repair conversions first, they are unlikely to be solved by any other means
+	convBuild := handle.buildIdx
+	handle.buildIdx, handle.types, handle.errs = handle.convertTypes(handle.buildIdx, handle.types, handle.errs)
 
-		} else if _, ok := err.Reason.(pkg2.TCBadName); ok {
-			needTag = true
-		} else {
-			illList = append(illList, err)
+	imports, needTag, classified, illList := handle.classifyErrors()
+	needTag = needTag || incomplete
+
+	// Errors of kinds registered classifiers recognize are up to the strategies, fix those before anything else
+	fixed := false
+	if len(classified) > 0 && len(illList) == 0 {
+		attempt := &Attempt{Errors: classified}
+		if ok, err := handle.tryStrategies(strategies, attempt); err != nil {
+			return err
+		} else if !ok {
+			handle.MarkExhausted()
+			return fmt.Errorf("no strategy could fix the error(s) in %v: %v", pkg.Meta.ImportPath, classified)
 		}
-	}
 
-	// If we saw no errors, move on
-	if !needTag && len(imports) == 0 {
-		handle.valid = true
-		return nil
+		fixed = true
+		imports, needTag, classified, illList = handle.classifyErrors()
+		needTag = needTag || incomplete
+		illList = append(illList, classified...)
 	}
 
 	// Never try porting a package with unknown type errors
@@ -177,46 +252,28 @@ func (handle *Handle) port() error {
 		return fmt.Errorf("unknown type error(s) occurred in %v: %v", pkg.Meta.ImportPath, illList)
 	}
 
-	// Have to do tagging
-	if needTag {
-		// Use the error filter to rebuild the import list whenever we decide to use a new config
-		build := handle.buildIdx + 1
-		for build < len(pkg.Builds) {
-			pkg.LoadSyntax(build)
-			typed, errs := handle.typeCheck(build, defaultTypeConfig())
-			imports = make(map[*pkg2.Package]bool)
-
-			satisfied := true
-			for _, err := range errs {
-				if iname, ok := err.Reason.(pkg2.TCBadImportName); ok {
-					ipkg := pkg.LookupImport(iname.PkgName, err.Err.Fset.Position(err.Err.Pos).Filename)
-
-					if ipkg == nil {
-						handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, iname.PkgName))
-					}
-					imports[ipkg] = true
-				} else if !err.Err.Soft {
-					satisfied = false
-					break
-				}
-			}
-
-			if satisfied {
-				handle.buildIdx = build
-				handle.types = typed
-				handle.errs = errs
-
-				if handle.validate() {
-					break
-				}
-			}
-			build++
+	// If we saw no errors, move on
+	if !needTag && len(imports) == 0 {
+		handle.valid = true
+		if convBuild != handle.buildIdx || fixed {
+			handle.patched = true
 		}
+		return nil
+	}
 
-		if build >= len(pkg.Builds) {
+	// Have to do tagging, by default we first try borrowing only the declarations we are missing,
+	// then mixing files from different platforms, then fallback to the configs of whole platforms
+	// and as a last resort see if export directives can patch the config we have
+	if needTag {
+		attempt := &Attempt{Missing: true, Imports: imports, KeepImports: true}
+		ok, err := handle.tryStrategies(strategies, attempt)
+		if err != nil {
+			return err
+		} else if !ok {
 			handle.MarkExhausted()
 			return fmt.Errorf("unable to find a valid config")
 		}
+		imports = attempt.Imports
 	}
 
 	if len(imports) == 0 {
@@ -245,101 +302,15 @@ func (handle *Handle) port() error {
 		return nil
 	}
 
-	// Try retagging to remove the bad imports
-	fiEdits := make(fileImportEdits)
-	fiBuild := handle.buildIdx
-	build := handle.buildIdx + 1
-	for build < len(pkg.Builds) {
-		if fiEdits == nil {
-			fiEdits = make(fileImportEdits)
-			fiBuild = build
-		}
-
-		pkg.LoadSyntax(build)
-		typed, errs := handle.typeCheck(build, defaultTypeConfig())
-
-		satisfied := true
-		for _, err := range errs {
-			if info, ok := err.Reason.(pkg2.TCBadImportName); ok {
-				file := err.Err.Fset.Position(err.Err.Pos).Filename
-				ipkg := pkg.LookupImport(info.PkgName, file)
-				if ipkg == nil {
-					handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, info.PkgName))
-				}
-
-				directives := base.Inlines[ipkg.Meta.ImportPath]
-				if directives != nil && directives.Exports != nil {
-					ed, ok := directives.Exports[info.Name.Name]
-					if ok {
-						if fiEdits[file] == nil {
-							fiEdits[file] = make(map[string]map[string]base.ExportInline)
-							fiEdits[file][info.PkgName] = make(map[string]base.ExportInline)
-						} else if fiEdits[file][info.PkgName] == nil {
-							fiEdits[file][info.PkgName] = make(map[string]base.ExportInline)
-						}
-
-						fiEdits[file][info.PkgName][info.Name.Name] = ed
-					}
-				}
-			}
-
-			if !err.Err.Soft {
-				if fiBuild == build {
-					fiEdits = nil
-				}
-
-				satisfied = false
-				break
-			}
-		}
-
-		if satisfied {
-			handle.buildIdx = build
-			handle.types = typed
-			handle.errs = errs
-
-			if handle.validate() {
-				break
-			}
-		}
-		build++
-	}
-
-	if build < len(pkg.Builds) {
-		handle.patched = true
-		return nil
-	} else if fiEdits == nil {
-		return fmt.Errorf("unable to find a valid config")
-	}
-
-	pkgCacheDir := filepath.Join(base.Cache, pkg.Meta.ImportPath)
-	if err := os.MkdirAll(pkgCacheDir, 0740); err != nil {
-		return fmt.Errorf("unable to create cache directory for package: %w", err)
-	}
-
-	// Didn't find a working config, therefore we try to use export directives
-	err := handle.applyExportDirective(fiBuild, pkgCacheDir, fiEdits)
-	if err != nil {
+	// Otherwise the config has to do without the bad imports
+	attempt := &Attempt{Imports: imports}
+	if ok, err := handle.tryStrategies(strategies, attempt); err != nil {
 		return err
-	}
-
-	typed, errs := handle.typeCheck(len(pkg.Builds)-1, defaultTypeConfig())
-	if len(errs) > 0 {
-		handle.MarkExhausted()
-		return fmt.Errorf("inline edits resulted in a bad config")
-	}
-
-	handle.types = typed
-	handle.buildIdx = fiBuild
-
-	// Verify the config
-	if handle.validate() {
+	} else if ok {
 		handle.patched = true
 		return nil
 	}
 
-	// We couldn't find a working config, so we try and see if we can fix the package using explicit handlers
-	//
 	// TODO: RE-IMPLEMENT THIS
 	// if handler := base.Inlines[pkg.Meta.ImportPath]; handler != nil && handler.Files != nil {
 	// 	err := c.applyPackageDirective(pkg, pkgCacheDir, handler.Files)
@@ -354,6 +325,38 @@ func (handle *Handle) port() error {
 	return fmt.Errorf("no applicable options available to port package %v", pkg.Meta.ImportPath)
 }
 
+// Sort the errors of the selected config by what it takes to fix them
+//
+// Returns the imports that are missing declarations (unless they can't be ported), whether declarations
+// of the package itself are missing, the errors of kinds registered classifiers recognize and any other errors
+func (handle *Handle) classifyErrors() (imports map[*pkg2.Package]bool, needTag bool, classified []pkg2.TypeError, illList []pkg2.TypeError) {
+	pkg := handle.pkg
+	imports = make(map[*pkg2.Package]bool, 0)
+	for _, err := range handle.errs {
+		if iname, ok := err.Reason.(pkg2.TCBadImportName); ok {
+			ipkg := pkg.LookupImport(iname.PkgName, err.Err.Fset.Position(err.Err.Pos).Filename)
+
+			if ipkg == nil {
+				handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, iname.PkgName))
+			}
+			if handle.ctx.handles[ipkg].exhausted {
+				needTag = true
+			} else {
+				imports[ipkg] = true
+			}
+
+		} else if _, ok := err.Reason.(pkg2.TCBadName); ok {
+			needTag = true
+		} else if _, ok := err.Reason.(pkg2.ClassifiedId); ok {
+			classified = append(classified, err)
+		} else if !isCleanup(err) && !err.Err.Soft {
+			// Soft errors (such as unused labels) don't stop the package from building
+			illList = append(illList, err)
+		}
+	}
+	return
+}
+
 func (handle *Handle) validate() bool {
 	pkg := handle.pkg
 	for _, parent := range pkg.Parents {
@@ -366,18 +369,9 @@ func (handle *Handle) validate() bool {
 		for _, err := range errs {
 			// We only care about errors from local imports
 			if info, ok := err.Reason.(pkg2.TCBadImportName); ok {
-				ipath, ok := parent.Files[err.Err.Fset.Position(err.Err.Pos).Filename].Imports[info.PkgName]
-				if !ok {
-					if backup := pkg2.BackupNameLookup(info.PkgName); backup != nil {
-						ipath = backup.Meta.ImportPath
-					} else {
-						handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, info.PkgName))
-					}
-				}
-
 				// If we have a match then that means the parents failed because of
 				// of the package under test, therefore we have a bad build
-				if pkg.Meta.ImportPath == ipath {
+				if pkg.Meta.ImportPath == handle.importPathOf(parent, err, info) {
 					return false
 				}
 			} else if !err.Err.Soft {
@@ -396,38 +390,224 @@ func (handle *Handle) validate() bool {
 	return true
 }
 
-// File Name -> Import Name -> Symbol Name -> Directive
-type fileImportEdits map[string]map[string]map[string]base.ExportInline
+// Resolve the import path of the package a parent's type error refers to
+func (handle *Handle) importPathOf(parent *pkg2.Package, err pkg2.TypeError, info pkg2.TCBadImportName) string {
+	ipath, ok := parent.Files[err.Err.Fset.Position(err.Err.Pos).Filename].Imports[info.PkgName]
+	if !ok {
+		if backup := parent.BackupNameLookup(info.PkgName); backup != nil {
+			ipath = backup.Meta.ImportPath
+		} else {
+			handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, info.PkgName))
+		}
+	}
+	return ipath
+}
+
+// File Name -> Edits
+type fileEdits map[string]*fileEdit
+
+// Edits made to a copy of a file using export directives
+type fileEdit struct {
+	// Import Name -> Symbol Name -> Directive
+	exports map[string]map[string]base.ExportInline
+
+	// Offset of a selected field or method name -> Directive
+	members map[int]memberEdit
+}
+
+// Rename of a field or method selected on a value of an imported type
+type memberEdit struct {
+	pkgName string
+	member  string
+	ed      base.ExportInline
+}
+
+// Collect the export directives that apply to the missing imported names in the given errors
+func (handle *Handle) exportEdits(errs []pkg2.TypeError) fileEdits {
+	pkg := handle.pkg
+	edits := make(fileEdits)
+	for _, err := range errs {
+		info, ok := err.Reason.(pkg2.TCBadImportName)
+		if !ok {
+			continue
+		}
+
+		pos := err.Err.Fset.Position(err.Err.Pos)
+		ipkg := pkg.LookupImport(info.PkgName, pos.Filename)
+		if ipkg == nil {
+			handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, info.PkgName))
+		}
+
+		directives := handle.ctx.sess.Inlines[ipkg.Meta.ImportPath]
+		if directives == nil || directives.Exports == nil {
+			continue
+		}
+
+		ed, ok := directives.Exports[declName(info.Name)]
+		if !ok {
+			continue
+		}
+
+		edit := edits[pos.Filename]
+		if edit == nil {
+			edit = &fileEdit{
+				exports: make(map[string]map[string]base.ExportInline),
+				members: make(map[int]memberEdit),
+			}
+			edits[pos.Filename] = edit
+		}
+
+		switch ed.Type {
+		case base.InlineFieldSym, base.InlineMethodSym:
+			if info.Name.MemberOf == nil {
+				continue
+			}
+			// Errors for missing members are reported at the selected name
+			edit.members[pos.Offset] = memberEdit{
+				pkgName: info.PkgName,
+				member:  declName(info.Name),
+				ed:      ed,
+			}
+		default:
+			if info.Name.MemberOf != nil {
+				continue
+			}
+			if edit.exports[info.PkgName] == nil {
+				edit.exports[info.PkgName] = make(map[string]base.ExportInline)
+			}
+			edit.exports[info.PkgName][info.Name.Name] = ed
+		}
+	}
+
+	for file, edit := range edits {
+		if len(edit.exports) == 0 && len(edit.members) == 0 {
+			delete(edits, file)
+		}
+	}
+
+	return edits
+}
+
+// Patch a copy of the given config using the export directives that apply to its errors
+//
+// Returns false if no directives apply, the package is marked as patched if the patched config is valid
+func (handle *Handle) useExportDirectives(build int, errs []pkg2.TypeError) (bool, error) {
+	pkg := handle.pkg
+	fiEdits := handle.exportEdits(errs)
+	if len(fiEdits) == 0 {
+		return false, nil
+	}
+
+	pkgCacheDir := filepath.Join(handle.ctx.sess.Cache, pkg.Meta.ImportPath)
+	if err := os.MkdirAll(pkgCacheDir, 0740); err != nil {
+		return true, fmt.Errorf("unable to create cache directory for package: %w", err)
+	}
+
+	err := handle.applyExportDirective(build, pkgCacheDir, fiEdits)
+	if err != nil {
+		return true, err
+	}
+
+	// Unused imports left behind by the edits are cleaned up when the patch is applied
+	typed, errs := handle.typeCheck(len(pkg.Builds)-1, defaultTypeConfig())
+	for _, err := range errs {
+		if !isCleanup(err) {
+			handle.MarkExhausted()
+			return true, fmt.Errorf("inline edits resulted in a bad config")
+		}
+	}
+
+	handle.types = typed
+	handle.errs = errs
+	handle.buildIdx = len(pkg.Builds) - 1
+
+	// Verify the config
+	if handle.validate() {
+		handle.patched = true
+	}
+	return true, nil
+}
 
 // Apply export directives to a package based on the
-func (handle *Handle) applyExportDirective(build int, cache string, fiEdits fileImportEdits) error {
+func (handle *Handle) applyExportDirective(build int, cache string, fiEdits fileEdits) error {
 	pkg := handle.pkg
 	ccfg := pkg.Builds[build]
 	pcfg := pkg2.BuildConfig{
-		Platforms: []string{base.GOOS()},
+		Platforms: []string{handle.ctx.sess.GOOS()},
 		Files:     make([]*pkg2.GoFile, 0, len(ccfg.Files)),
 	}
 
+	// Uses recorded by type checking the config, only needed once a template is applied
+	var uses map[*ast.Ident]types.Object
+
 	// Apply the changes and make copies of files, store files in cache
 	for idx := range ccfg.Files {
 		gofile := ccfg.Files[idx]
 
-		iEdits := fiEdits[gofile.Name]
-		if iEdits == nil {
+		edit := fiEdits[gofile.Name]
+		if edit == nil {
 			pcfg.Files = append(pcfg.Files, gofile)
 			pcfg.Syntax = append(pcfg.Syntax, ccfg.Syntax[idx])
 			continue
 		}
 
-		file, err := os.ReadFile(filepath.Join(pkg.Meta.Dir, gofile.Name))
+		file, err := os.ReadFile(gofile.Path)
 		if err != nil {
 			// TODO: better info
 			return fmt.Errorf("unable to read file for custom import replacement: %w", err)
 		}
 
-		cpath := filepath.Join(cache, gofile.Name)
+		name := handle.copyName(gofile)
+		cpath := filepath.Join(cache, name)
+
+		// Rename members first (from the back so offsets stay valid)
+		offsets := make([]int, 0, len(edit.members))
+		for offset := range edit.members {
+			offsets = append(offsets, offset)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(offsets)))
+		for _, offset := range offsets {
+			medit := edit.members[offset]
+			old := medit.member[strings.LastIndexByte(medit.member, '.')+1:]
+			if !bytes.HasPrefix(file[offset:], []byte(old)) {
+				return fmt.Errorf("unable to apply custom member replacement: %v not found at offset %v of %v", old, offset, gofile.Name)
+			}
+			file = append(file[:offset:offset], append([]byte(medit.ed.Replace), file[offset+len(old):]...)...)
+		}
 
-		for iname, sEdits := range iEdits {
+		// Rewrite calls next, this needs the AST so it has to happen before any text replacement
+		templates := make(map[string]base.ExportInline)
+		for iname, sEdits := range edit.exports {
+			for sname, ed := range sEdits {
+				if ed.Type == base.InlineTemplateSym {
+					templates[iname+"."+sname] = ed
+				}
+			}
+		}
+		imports := gofile.Imports
+		if len(templates) > 0 {
+			// Which identifiers name a package is only known after type checking (they can be shadowed)
+			if uses == nil {
+				info := &types.Info{Uses: make(map[*ast.Ident]types.Object)}
+				handle.typeCheckInfo(ccfg.Syntax, defaultTypeConfig(), info)
+				uses = info.Uses
+			}
+			qualifiers := packageQualifiers(handle.ctx.sess.FileSet, ccfg.Syntax[idx], uses, edit.members)
+
+			var added []string
+			file, added, err = applyTemplates(name, file, templates, qualifiers)
+			if err != nil {
+				return fmt.Errorf("unable to apply custom call replacement to %v: %w", gofile.Name, err)
+			}
+
+			if len(added) > 0 {
+				if imports, err = templateImports(gofile, pkg, added); err != nil {
+					return fmt.Errorf("unable to apply custom call replacement to %v: %w", gofile.Name, err)
+				}
+			}
+		}
+
+		for iname, sEdits := range edit.exports {
 			for sname, ed := range sEdits {
 				var repstr string
 				switch ed.Type {
@@ -435,6 +615,8 @@ func (handle *Handle) applyExportDirective(build int, cache string, fiEdits file
 					repstr = iname + "." + ed.Replace
 				case base.InlineConstSym:
 					repstr = ed.Replace
+				case base.InlineTemplateSym:
+					continue
 				default:
 					panic("unknown export directive type")
 				}
@@ -444,7 +626,7 @@ func (handle *Handle) applyExportDirective(build int, cache string, fiEdits file
 		}
 
 		// Create AST for file
-		syntax, err := parser.ParseFile(pkg2.FileSet, cpath, file, parser.AllErrors)
+		syntax, err := parser.ParseFile(handle.ctx.sess.FileSet, name, file, parser.AllErrors)
 		if err != nil {
 			return fmt.Errorf("unable to apply custom import patch: unable to parse patched file: %w", err)
 		}
@@ -456,18 +638,22 @@ func (handle *Handle) applyExportDirective(build int, cache string, fiEdits file
 		}
 
 		repl := &pkg2.GoFile{
-			Name:    fmt.Sprintf("%v_%v.go", strings.TrimSuffix(gofile.Name, ".go"), base.GOOS()),
+			Name:    name,
 			Path:    cpath,
 			Cgo:     gofile.Cgo,
 			Syntax:  syntax,
+			Fset:    handle.ctx.sess.FileSet,
 			Tags:    tags.Supported{},
-			Imports: gofile.Imports,
+			Imports: imports,
 			Replaced: &pkg2.ReplacedFile{
 				File:   gofile,
-				Reason: iEdits,
+				Reason: edit,
 			},
 		}
 
+		// Register the copy so type errors in it can be traced back to imports
+		pkg.Files[name] = repl
+
 		pcfg.Files = append(pcfg.Files, repl)
 		pcfg.Syntax = append(pcfg.Syntax, syntax)
 	}
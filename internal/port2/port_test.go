@@ -0,0 +1,269 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+func TestFieldDirective(t *testing.T) {
+	sess := testSession(t)
+	sess.Inlines["golang.org/x/sys/unix"] = &base.PackageInline{
+		Exports: map[string]base.ExportInline{
+			"Stat_t.Atim": {Type: base.InlineFieldSym, Replace: "Atimespec"},
+		},
+	}
+
+	pkg := testPackage(t, sess, map[string]string{
+		"p.go": "package p\n\nimport \"golang.org/x/sys/unix\"\n\nfunc Atime(st *unix.Stat_t) int64 { return st.Atim.Sec + st.Atim.Nsec }\n",
+	}, nil)
+	pkg.Meta.Module = &pkg2.Module{Path: "example.com/p"}
+	pkg.Files["p.go"].Imports = map[string]string{"unix": "golang.org/x/sys/unix"}
+
+	// Stand in for unix with the field named the way the target platform names it
+	src, err := parser.ParseFile(sess.FileSet, "unix.go", "package unix\n\ntype Timespec struct{ Sec, Nsec int64 }\n\ntype Stat_t struct{ Atimespec Timespec }\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixtypes, err := (&types.Config{}).Check("golang.org/x/sys/unix", sess.FileSet, []*ast.File{src}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixpkg := &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: "golang.org/x/sys/unix", Name: "unix"}}
+	pkg.Imports = map[string]*pkg2.Package{"golang.org/x/sys/unix": unixpkg}
+
+	ctx := NewContext(sess)
+	ctx.GetHandle(unixpkg).types = unixtypes
+	handle := ctx.GetHandle(pkg)
+	handle.types, handle.errs = handle.typeCheck(0, defaultTypeConfig())
+	if len(handle.errs) != 2 {
+		t.Fatalf("expected both selections of Atim to fail, got %v", handle.errs)
+	}
+
+	if applied, err := handle.useExportDirectives(0, handle.errs); err != nil || !applied {
+		t.Fatalf("directive was not applied (error %v)", err)
+	}
+	if !handle.patched || len(handle.errs) != 0 {
+		t.Fatalf("patched config has errors %v", handle.errs)
+	}
+
+	// Only the selected names are rewritten, the selectors keep their operands
+	copied := pkg.Builds[handle.buildIdx].Files[0]
+	patched, err := os.ReadFile(copied.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "return st.Atimespec.Sec + st.Atimespec.Nsec"; !strings.Contains(string(patched), want) {
+		t.Errorf("expected %q in:\n%s", want, patched)
+	}
+
+	patches := ctx.CollectPatches()
+	if len(patches) != 1 {
+		t.Fatalf("got patches %+v", patches)
+	}
+	var symbols []base.SymbolRepl
+	for _, file := range patches[0].Files {
+		if file.Name == copied.Name {
+			symbols = file.Symbols
+		}
+	}
+	want := base.SymbolRepl{Original: "unix.Stat_t.Atim", New: "unix.Stat_t.Atimespec"}
+	if len(symbols) != 1 || symbols[0] != want {
+		t.Errorf("reported replacements %+v, want %+v", symbols, want)
+	}
+}
+
+func TestTemplateDirective(t *testing.T) {
+	sess := testSession(t)
+	sess.Inlines["example.com/unix"] = &base.PackageInline{
+		Exports: map[string]base.ExportInline{
+			"Pipe2": {Type: base.InlineTemplateSym, Replace: "compat.Pipe2($0, $1)", Import: "example.com/compat"},
+		},
+	}
+
+	pkg := testPackage(t, sess, map[string]string{
+		"p.go": `package p
+
+import "example.com/unix"
+
+type pipes struct{}
+
+func (pipes) Pipe2(p []int, flags int) error { return nil }
+
+func Open(p []int) error {
+	if err := unix.Pipe2(p, 0); err != nil {
+		return unix.Pipe(p)
+	}
+	unix := pipes{}
+	return unix.Pipe2(p, 1)
+}
+`,
+	}, nil)
+	pkg.Meta.Module = &pkg2.Module{Path: "example.com/p"}
+	pkg.Files["p.go"].Imports = map[string]string{"unix": "example.com/unix"}
+
+	ctx := NewContext(sess)
+	typed := func(path, src string) *pkg2.Package {
+		file, err := parser.ParseFile(sess.FileSet, path+".go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipkg := &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: path, Name: file.Name.Name}}
+		if ctx.GetHandle(ipkg).types, err = (&types.Config{}).Check(path, sess.FileSet, []*ast.File{file}, nil); err != nil {
+			t.Fatal(err)
+		}
+		return ipkg
+	}
+	unixpkg := typed("example.com/unix", "package unix\n\nfunc Pipe(p []int) error { return nil }\n")
+	compat := typed("example.com/compat", "package compat\n\nfunc Pipe2(p []int, flags int) error { return nil }\n")
+	pkg.Imports = map[string]*pkg2.Package{"example.com/unix": unixpkg}
+	pkg.TemplateImports = map[string]*pkg2.Package{"example.com/compat": compat}
+
+	handle := ctx.GetHandle(pkg)
+	handle.types, handle.errs = handle.typeCheck(0, defaultTypeConfig())
+	if len(handle.errs) != 1 {
+		t.Fatalf("expected unix.Pipe2 to fail, got %v", handle.errs)
+	}
+
+	if applied, err := handle.useExportDirectives(0, handle.errs); err != nil || !applied {
+		t.Fatalf("directive was not applied (error %v)", err)
+	}
+	if !handle.patched || len(handle.errs) != 0 {
+		t.Fatalf("patched config has errors %v", handle.errs)
+	}
+
+	// The call on the variable shadowing the import is left alone
+	patched, err := os.ReadFile(pkg.Builds[handle.buildIdx].Files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"err := compat.Pipe2(p, 0)", "return unix.Pipe2(p, 1)", "\"example.com/compat\""} {
+		if !strings.Contains(string(patched), want) {
+			t.Errorf("expected %q in:\n%s", want, patched)
+		}
+	}
+
+	// Applying the template made compat an import of the package
+	if pkg.Imports["example.com/compat"] != compat || len(compat.Parents) != 1 || compat.Parents[0] != pkg {
+		t.Errorf("imports %v, compat imported by %v", pkg.Imports, compat.Parents)
+	}
+}
+
+func TestClassifyErrorsSkipsSoftErrors(t *testing.T) {
+	sess := testSession(t)
+	handle := testHandle(t, sess, map[string]string{
+		"p.go": "package p\n\nfunc F() {\nL:\n\tfor {\n\t}\n}\n",
+	}, nil)
+	if len(handle.errs) != 1 || !handle.errs[0].Err.Soft {
+		t.Fatalf("expected the unused label to be the only error, got %v", handle.errs)
+	}
+
+	if imports, needTag, classified, illList := handle.classifyErrors(); len(imports) > 0 || needTag || len(classified) > 0 || len(illList) > 0 {
+		t.Errorf("soft error classified as imports %v, tagging %v, classified %v, unknown %v", imports, needTag, classified, illList)
+	}
+}
+
+// Kind of its own for calls that are missing the flags argument, like a classifier outside of pkg2 would define it
+type missingFlags struct {
+	pkg2.TCClassified
+	Func string
+}
+
+type flagsClassifier struct{}
+
+var missingArgs = regexp.MustCompile(`^not enough arguments in call to (\w+)`)
+
+func (flagsClassifier) Classify(err types.Error) (pkg2.ClassifiedId, bool) {
+	match := missingArgs.FindStringSubmatch(err.Msg)
+	if match == nil {
+		return nil, false
+	}
+	return missingFlags{TCClassified: pkg2.TCClassified{Kind: "missing-flags"}, Func: match[1]}, true
+}
+
+// Passes no flags to the calls the classifier found
+type flagsStrategy struct{}
+
+func (flagsStrategy) Name() string {
+	return "flags"
+}
+
+func (flagsStrategy) Port(handle *Handle, attempt *Attempt) (bool, error) {
+	if len(attempt.Errors) == 0 {
+		return false, nil
+	}
+
+	files := append([]*pkg2.GoFile(nil), handle.Config().Files...)
+	for _, err := range attempt.Errors {
+		reason, ok := err.Reason.(missingFlags)
+		if !ok {
+			return false, nil
+		}
+		for idx, gofile := range files {
+			src, rerr := os.ReadFile(gofile.Path)
+			if rerr != nil {
+				return false, rerr
+			}
+			fixed := strings.ReplaceAll(string(src), reason.Func+"(p)", reason.Func+"(p, 0)")
+			if fixed == string(src) {
+				continue
+			}
+			if files[idx], rerr = handle.ReplaceFile(gofile, []byte(fixed)); rerr != nil {
+				return false, rerr
+			}
+		}
+	}
+
+	imports, ok := handle.Select(files, attempt.KeepImports)
+	if ok {
+		attempt.Imports = imports
+	}
+	return ok, nil
+}
+
+func TestPortFixesClassifiedErrors(t *testing.T) {
+	sess := testSession(t)
+	sess.Strategies = []string{"flags"}
+
+	pkg := testPackage(t, sess, map[string]string{
+		"p.go": "package p\n\nfunc open(p []int, flags int) error { return nil }\n\nfunc Open(p []int) error { return open(p) }\n",
+	}, nil)
+
+	ctx := NewContext(sess)
+	ctx.AddClassifier(flagsClassifier{})
+	ctx.AddStrategy(flagsStrategy{})
+	handle := ctx.GetHandle(pkg)
+	handle.types, handle.errs = handle.typeCheck(0, defaultTypeConfig())
+	if len(handle.errs) != 1 {
+		t.Fatalf("expected the call of open to fail, got %v", handle.errs)
+	}
+	if reason, ok := handle.errs[0].Reason.(missingFlags); !ok || reason.Func != "open" || reason.Classified().Kind != "missing-flags" {
+		t.Fatalf("classified as %#v", handle.errs[0].Reason)
+	}
+
+	if err := handle.port(); err != nil {
+		t.Fatal(err)
+	}
+	if !handle.valid || !handle.patched || len(handle.errs) != 0 {
+		t.Fatalf("package is valid %v, patched %v with errors %v", handle.valid, handle.patched, handle.errs)
+	}
+
+	fixed, err := os.ReadFile(handle.Config().Files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(fixed), "return open(p, 0)") {
+		t.Errorf("selected config was not fixed:\n%s", fixed)
+	}
+}
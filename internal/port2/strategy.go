@@ -0,0 +1,381 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"fmt"
+	"go/parser"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/tags"
+)
+
+// Approach to porting a package
+//
+// Strategies are tried in order until one of them fixes the package (see Context.AddStrategy).
+// New approaches (stubbing, shimming, rewrites specific to an organization...) are added by
+// implementing this interface, the loop in Handle.port does not need to change. Strategies
+// outside of this package work through Handle.Config, Handle.Errors, Handle.ReplaceFile and Handle.Select.
+type Strategy interface {
+	// Name the strategy is selected by in the strategies option (of a run or a module)
+	Name() string
+
+	// Try to fix what the attempt describes, returns false if the strategy does not apply
+	//
+	// On success the selected config of the handle must be the fixed one, and the attempt
+	// must list the imports that are still broken. On failure any change of the selected config is undone.
+	Port(handle *Handle, attempt *Attempt) (bool, error)
+}
+
+// What is wrong with the selected config of a package
+type Attempt struct {
+	// Declarations the package needs are missing from its own files
+	Missing bool
+
+	// Imports that are missing declarations the package needs
+	Imports map[*pkg2.Package]bool
+
+	// The fix may leave imports broken, they are ported before the package is tried again
+	KeepImports bool
+
+	// Errors of kinds recognized by registered classifiers (see Context.AddClassifier), a fix has to get rid of all of them
+	//
+	// Their Reason is the pkg2.ClassifiedId the classifier returned. Of the built in strategies only retag
+	// acts on them (it looks for a platform config without them), fixing them is up to added strategies.
+	Errors []pkg2.TypeError
+}
+
+// Strategies that are tried (in this order) unless the run or the module selects others
+var defaultStrategies = []Strategy{
+	borrowStrategy{},
+	assembleStrategy{},
+	retagStrategy{},
+	exportStrategy{},
+}
+
+// Make a strategy available to be selected by name, replaces a strategy with the same name
+func (ctx *Context) AddStrategy(strategy Strategy) {
+	ctx.strategies[strategy.Name()] = strategy
+}
+
+// Verify every strategy (and pin search) selected by the session is available
+func (ctx *Context) CheckStrategies() error {
+	if _, err := ctx.selectStrategies(ctx.sess.Strategies); err != nil {
+		return err
+	}
+	if err := checkPinSearch(ctx.sess.PinSearch); err != nil {
+		return err
+	}
+
+	modules := make([]string, 0, len(ctx.sess.Modules))
+	for modpath := range ctx.sess.Modules {
+		modules = append(modules, modpath)
+	}
+	sort.Strings(modules)
+
+	for _, modpath := range modules {
+		if _, err := ctx.selectStrategies(ctx.sess.Modules[modpath].Strategies); err != nil {
+			return fmt.Errorf("%v: %w", modpath, err)
+		}
+		if err := checkPinSearch(ctx.sess.Modules[modpath].Pin); err != nil {
+			return fmt.Errorf("%v: %w", modpath, err)
+		}
+	}
+	return nil
+}
+
+// Strategies used to port packages of the module, the module's selection overrides the run's
+func (ctx *Context) strategiesFor(module *pkg2.Module) ([]Strategy, error) {
+	if module != nil {
+		if names := ctx.sess.ModuleOptions(module.Path).Strategies; len(names) > 0 {
+			return ctx.selectStrategies(names)
+		}
+	}
+	return ctx.selectStrategies(ctx.sess.Strategies)
+}
+
+func (ctx *Context) selectStrategies(names []string) ([]Strategy, error) {
+	if len(names) == 0 {
+		return defaultStrategies, nil
+	}
+
+	selected := make([]Strategy, 0, len(names))
+	for _, name := range names {
+		strategy := ctx.strategies[name]
+		if strategy == nil {
+			known := make([]string, 0, len(ctx.strategies))
+			for name := range ctx.strategies {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown porting strategy %q (available: %v)", name, strings.Join(known, ", "))
+		}
+		selected = append(selected, strategy)
+	}
+	return selected, nil
+}
+
+// Try each strategy in order until one fixes the attempt, returns false if none of them did
+func (handle *Handle) tryStrategies(strategies []Strategy, attempt *Attempt) (bool, error) {
+	for _, strategy := range strategies {
+		prevIdx, prevTypes, prevErrs := handle.buildIdx, handle.types, handle.errs
+		ok, err := strategy.Port(handle, attempt)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+		handle.buildIdx, handle.types, handle.errs = prevIdx, prevTypes, prevErrs
+	}
+	return false, nil
+}
+
+// Config that is currently selected for the package (its syntax may have been released, see GoFile.LoadSyntax)
+func (handle *Handle) Config() pkg2.BuildConfig {
+	return handle.pkg.Builds[handle.buildIdx]
+}
+
+// Type errors of the selected config
+func (handle *Handle) Errors() []pkg2.TypeError {
+	return handle.errs
+}
+
+// Source of a file replaced by a strategy (used as the reason of a pkg2.ReplacedFile)
+type replacedSource struct{}
+
+// Generate a copy of the file with the given source, built for the target platform only
+//
+// The copy takes the place of the file in the configs it is selected into (see Select), it can only
+// import packages the package already imports. Once the package is patched it is written next to the file.
+func (handle *Handle) ReplaceFile(gofile *pkg2.GoFile, src []byte) (*pkg2.GoFile, error) {
+	pkg := handle.pkg
+	name := handle.copyName(gofile)
+
+	syntax, err := parser.ParseFile(handle.ctx.sess.FileSet, name, src, parser.AllErrors)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse replacement of %v: %w", gofile.Name, err)
+	}
+
+	imports := make(map[string]string, len(syntax.Imports))
+	for _, ispec := range syntax.Imports {
+		ipath, err := strconv.Unquote(ispec.Path.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse replacement of %v: %w", gofile.Name, err)
+		}
+
+		iname, _ := pkg2.ImportPathToAssumedName(ipath)
+		if ipath == pkg2.UNSAFE_PACKAGE_NAME || ipath == pkg2.CGO_PACKAGE_NAME {
+			iname = ipath
+		} else if ipkg := pkg.Imports[ipath]; ipkg != nil {
+			iname = ipkg.Meta.Name
+		} else {
+			return nil, fmt.Errorf("replacement of %v imports %v, which %v does not import", gofile.Name, ipath, pkg.Meta.ImportPath)
+		}
+		if ispec.Name != nil {
+			iname = ispec.Name.Name
+		}
+		imports[iname] = ipath
+	}
+
+	cache := filepath.Join(handle.ctx.sess.Cache, pkg.Meta.ImportPath)
+	if err := os.MkdirAll(cache, 0740); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory for package: %w", err)
+	}
+	cpath := filepath.Join(cache, name)
+	if err := os.WriteFile(cpath, src, 0740); err != nil {
+		return nil, fmt.Errorf("unable to write replacement of %v: %w", gofile.Name, err)
+	}
+
+	repl := &pkg2.GoFile{
+		Name:    name,
+		Path:    cpath,
+		Cgo:     gofile.Cgo,
+		Syntax:  syntax,
+		Fset:    handle.ctx.sess.FileSet,
+		Tags:    tags.Supported{},
+		Imports: imports,
+		Replaced: &pkg2.ReplacedFile{
+			File:   gofile,
+			Reason: replacedSource{},
+		},
+	}
+
+	// Type errors in the copy have to be traced back to its imports
+	pkg.Files[name] = repl
+	return repl, nil
+}
+
+// Select a config made up of the given files if it type checks and doesn't break the packages importing it
+//
+// Imports that are missing declarations are only accepted if keepImports is set, they are returned.
+// The config is built for the target platform, if it is not selected it is dropped (along with the copies only it used).
+func (handle *Handle) Select(files []*pkg2.GoFile, keepImports bool) (map[*pkg2.Package]bool, bool) {
+	pkg := handle.pkg
+	added := len(pkg.Builds)
+	build, err := pkg.AddBuild([]string{handle.ctx.sess.GOOS()}, files)
+	if err != nil {
+		handle.dropBuilds(added)
+		return nil, false
+	}
+
+	typed, errs := handle.typeCheck(build, defaultTypeConfig())
+	if imports, ok := handle.brokenImports(errs, keepImports); ok {
+		prevIdx, prevTypes, prevErrs := handle.buildIdx, handle.types, handle.errs
+		handle.buildIdx, handle.types, handle.errs = build, typed, errs
+		if handle.validate() {
+			return imports, true
+		}
+		handle.buildIdx, handle.types, handle.errs = prevIdx, prevTypes, prevErrs
+	}
+
+	handle.dropBuilds(added)
+	return nil, false
+}
+
+// Imports the errors report missing declarations from, returns false if any other error is not soft
+// (or if imports missing declarations are not accepted)
+func (handle *Handle) brokenImports(errs []pkg2.TypeError, keepImports bool) (map[*pkg2.Package]bool, bool) {
+	imports := make(map[*pkg2.Package]bool)
+	for _, err := range errs {
+		if iname, ok := err.Reason.(pkg2.TCBadImportName); ok && keepImports {
+			ipkg := handle.pkg.LookupImport(iname.PkgName, err.Err.Fset.Position(err.Err.Pos).Filename)
+
+			if ipkg == nil {
+				handle.panic(fmt.Sprintf("type check got %v but cannot identify import path for %v", err.Err, iname.PkgName))
+			}
+			imports[ipkg] = true
+		} else if !err.Err.Soft {
+			return nil, false
+		}
+	}
+	return imports, true
+}
+
+// Copy the declarations that are missing from the files of other platforms
+type borrowStrategy struct{}
+
+func (borrowStrategy) Name() string {
+	return "borrow"
+}
+
+func (borrowStrategy) Port(handle *Handle, attempt *Attempt) (bool, error) {
+	if !attempt.Missing || !attempt.KeepImports {
+		return false, nil
+	}
+	imports, ok := handle.borrow()
+	if ok {
+		attempt.Imports = imports
+	}
+	return ok, nil
+}
+
+// Mix the files of several platforms into a config that provides the missing declarations
+type assembleStrategy struct{}
+
+func (assembleStrategy) Name() string {
+	return "assemble"
+}
+
+func (assembleStrategy) Port(handle *Handle, attempt *Attempt) (bool, error) {
+	if !attempt.Missing || !attempt.KeepImports {
+		return false, nil
+	}
+	imports, ok := handle.assemble()
+	if ok {
+		attempt.Imports = imports
+	}
+	return ok, nil
+}
+
+// Switch to the config of another platform
+type retagStrategy struct{}
+
+func (retagStrategy) Name() string {
+	return "retag"
+}
+
+func (retagStrategy) Port(handle *Handle, attempt *Attempt) (bool, error) {
+	imports, ok := handle.retag(attempt.KeepImports)
+	if ok {
+		attempt.Imports = imports
+	}
+	return ok, nil
+}
+
+// Patch the selected config using the export directives of the config files
+type exportStrategy struct{}
+
+func (exportStrategy) Name() string {
+	return "exports"
+}
+
+func (exportStrategy) Port(handle *Handle, attempt *Attempt) (bool, error) {
+	// Directives only replace declarations missing from imports, the config would stay broken
+	if len(attempt.Errors) > 0 {
+		return false, nil
+	}
+	applied, err := handle.useExportDirectives(handle.buildIdx, handle.errs)
+	if err != nil || !applied || !handle.patched {
+		return false, err
+	}
+	attempt.Imports = nil
+	return true, nil
+}
+
+// Select the first whole platform config (after the current one) that type checks and doesn't break the parents
+//
+// Configs with broken imports are only accepted if keepImports is set, the broken imports are returned.
+// If a mixed config is selected the search goes on after the platform config it was mixed from.
+func (handle *Handle) retag(keepImports bool) (map[*pkg2.Package]bool, bool) {
+	pkg := handle.pkg
+	for build := handle.platformIdx + 1; build < pkg.PlatformBuilds; build++ {
+		added := len(pkg.Builds)
+		pkg.LoadSyntax(build)
+		btyped, berrs := handle.typeCheck(build, defaultTypeConfig())
+		cbuild, typed, errs := handle.excludeRedeclared(build, btyped, berrs)
+		cbuild, typed, errs = handle.convertTypes(cbuild, typed, errs)
+
+		if imports, ok := handle.brokenImports(errs, keepImports); ok {
+			handle.buildIdx = cbuild
+			handle.types = typed
+			handle.errs = errs
+
+			if handle.validate() {
+				handle.platformIdx = build
+				return imports, true
+			}
+			handle.buildIdx, handle.types, handle.errs = build, btyped, berrs
+		}
+
+		// Configs derived from a candidate are only kept if it gets selected
+		handle.dropBuilds(added)
+	}
+	return nil, false
+}
+
+// Remove the configs from the given index on, along with the files generated for them
+func (handle *Handle) dropBuilds(from int) {
+	pkg := handle.pkg
+	kept := make(map[*pkg2.GoFile]bool)
+	for _, cfg := range pkg.Builds[:from] {
+		for _, gofile := range cfg.Files {
+			kept[gofile] = true
+		}
+	}
+	for _, cfg := range pkg.Builds[from:] {
+		for _, gofile := range cfg.Files {
+			if gofile.Replaced != nil && !kept[gofile] {
+				delete(pkg.Files, gofile.Name)
+			}
+		}
+	}
+	pkg.Builds = pkg.Builds[:from]
+}
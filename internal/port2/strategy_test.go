@@ -0,0 +1,69 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+type stubStrategy struct{}
+
+func (stubStrategy) Name() string {
+	return "stub"
+}
+
+func (stubStrategy) Port(handle *Handle, attempt *Attempt) (bool, error) {
+	return false, nil
+}
+
+func strategyNames(strategies []Strategy) []string {
+	names := make([]string, 0, len(strategies))
+	for _, strategy := range strategies {
+		names = append(names, strategy.Name())
+	}
+	return names
+}
+
+func TestStrategiesFor(t *testing.T) {
+	sess := testSession(t)
+	sess.Strategies = []string{"retag", "exports"}
+	sess.Modules["example.com/stubbed"] = &base.ModuleConfig{Strategies: []string{"stub", "retag"}}
+
+	ctx := NewContext(sess)
+	if err := ctx.CheckStrategies(); err == nil {
+		t.Fatalf("expected unregistered strategy to be reported")
+	}
+
+	ctx.AddStrategy(stubStrategy{})
+	if err := ctx.CheckStrategies(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		module string
+		want   []string
+	}{
+		{"example.com/other", []string{"retag", "exports"}},
+		{"example.com/stubbed", []string{"stub", "retag"}},
+	}
+	for _, test := range tests {
+		strategies, err := ctx.strategiesFor(&pkg2.Module{Path: test.module})
+		if err != nil {
+			t.Fatalf("%v: %v", test.module, err)
+		}
+		if got := strategyNames(strategies); len(got) != len(test.want) || got[0] != test.want[0] || got[1] != test.want[1] {
+			t.Errorf("%v: got strategies %v, want %v", test.module, got, test.want)
+		}
+	}
+
+	sess.Strategies = nil
+	strategies, _ := ctx.strategiesFor(nil)
+	if got := strategyNames(strategies); len(got) != 4 || got[0] != "borrow" || got[3] != "exports" {
+		t.Errorf("got default strategies %v", got)
+	}
+}
@@ -0,0 +1,268 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"bytes"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/tags"
+)
+
+// Most suggestions reported for a single missing symbol
+const maxSuggestions = 3
+
+// Symbols known to be spelled differently across platforms
+//
+// Each entry lists likely substitutes in order of preference
+var symbolAliases = map[string][]string{
+	"MAP_ANON":      {"MAP_ANONYMOUS"},
+	"MAP_ANONYMOUS": {"MAP_ANON"},
+	"EBADFD":        {"EBADF"},
+	"ENOTSUP":       {"EOPNOTSUPP"},
+	"EOPNOTSUPP":    {"ENOTSUP"},
+	"EWOULDBLOCK":   {"EAGAIN"},
+	"ENODATA":       {"ENOATTR"},
+	"ENOATTR":       {"ENODATA"},
+	"SIGIO":         {"SIGPOLL"},
+	"SIGPOLL":       {"SIGIO"},
+	"O_DSYNC":       {"O_SYNC"},
+	"O_RSYNC":       {"O_SYNC"},
+	"TCGETS":        {"TIOCGETA", "TCGETA"},
+	"TCSETS":        {"TIOCSETA", "TCSETA"},
+	"TIOCGETA":      {"TCGETS", "TCGETA"},
+	"TIOCSETA":      {"TCSETS", "TCSETA"},
+	"Fdatasync":     {"Fsync"},
+}
+
+// Record suggestions for every missing symbol of an exhausted import in the current config
+func (handle *Handle) suggest() {
+	pkg := handle.pkg
+	seen := make(map[string]bool)
+	for _, err := range handle.errs {
+		info, ok := err.Reason.(pkg2.TCBadImportName)
+		if !ok || info.Name.MemberOf != nil {
+			continue
+		}
+
+		ipkg := pkg.LookupImport(info.PkgName, err.Err.Fset.Position(err.Err.Pos).Filename)
+		if ipkg == nil {
+			continue
+		}
+
+		ih := handle.ctx.handles[ipkg]
+		if ih == nil || ih.types == nil || !ih.exhausted {
+			continue
+		}
+
+		key := ipkg.Meta.ImportPath + "." + info.Name.Name
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		// Directives already exist for this symbol, suggesting something else would be noise
+		if directives := handle.ctx.sess.Inlines[ipkg.Meta.ImportPath]; directives != nil && directives.Exports != nil {
+			if _, ok := directives.Exports[info.Name.Name]; ok {
+				continue
+			}
+		}
+
+		handle.ctx.suggestions = append(handle.ctx.suggestions, nearestSymbols(handle.ctx.sess, ipkg, ih.types, info.Name.Name)...)
+	}
+}
+
+// Search the export set of an imported package for likely substitutes of a missing symbol
+func nearestSymbols(sess *base.Session, ipkg *pkg2.Package, typed *types.Package, name string) []base.InlineSuggestion {
+	scores := make(map[string]float64)
+	reasons := make(map[string]string)
+	propose := func(candidate string, score float64, reason string) {
+		if candidate == name || score <= scores[candidate] {
+			return
+		}
+		obj := typed.Scope().Lookup(candidate)
+		if obj == nil || !obj.Exported() {
+			return
+		}
+		scores[candidate] = score
+		reasons[candidate] = reason
+	}
+
+	// Known aliases are the most reliable
+	for idx, alias := range symbolAliases[name] {
+		propose(alias, 0.9-0.1*float64(idx), "known alias")
+	}
+
+	// Constants that share the value the symbol has on other platforms
+	value := donorConstValue(sess, ipkg, name)
+	if value != nil {
+		matches := make([]string, 0, 1)
+		for _, sym := range typed.Scope().Names() {
+			if cnst, ok := typed.Scope().Lookup(sym).(*types.Const); ok && cnst.Exported() {
+				if cnst.Val().Kind() == value.Kind() && constant.Compare(cnst.Val(), token.EQL, value) {
+					matches = append(matches, sym)
+				}
+			}
+		}
+		// The more constants share the value, the more likely it is a coincidence
+		for _, sym := range matches {
+			propose(sym, 0.6/float64(len(matches)), "same value ("+value.ExactString()+")")
+		}
+	}
+
+	// Similarly spelled symbols (only other constants if we know the symbol is a constant)
+	limit := len(name) / 4
+	if limit < 1 {
+		limit = 1
+	}
+	for _, sym := range typed.Scope().Names() {
+		if _, ok := typed.Scope().Lookup(sym).(*types.Const); value != nil && !ok {
+			continue
+		}
+		if dist := editDistance(name, sym); dist <= limit {
+			propose(sym, 0.5*(1-float64(dist)/float64(len(name)+1)), "similar name")
+		}
+	}
+
+	candidates := make([]string, 0, len(scores))
+	for candidate := range scores {
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if scores[candidates[i]] != scores[candidates[j]] {
+			return scores[candidates[i]] > scores[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	if len(candidates) > maxSuggestions {
+		candidates = candidates[:maxSuggestions]
+	}
+
+	suggestions := make([]base.InlineSuggestion, 0, len(candidates))
+	for _, candidate := range candidates {
+		suggestions = append(suggestions, base.InlineSuggestion{
+			Package: ipkg.Meta.ImportPath,
+			Symbol:  name,
+			Directive: base.ExportInline{
+				Type:    base.InlineExportSym,
+				Replace: candidate,
+			},
+			Confidence: float64(int(scores[candidate]*100)) / 100,
+			Reason:     reasons[candidate],
+		})
+	}
+	return suggestions
+}
+
+// Find the value a constant has on the highest ranked platform that declares it
+func donorConstValue(sess *base.Session, ipkg *pkg2.Package, name string) constant.Value {
+	var best constant.Value
+	bestRank := len(tags.UNIX_PLATFORM_RANKING) + 1
+	for _, fname := range ipkg.Meta.IgnoredGoFiles {
+		src, err := os.ReadFile(filepath.Join(ipkg.Meta.Dir, fname))
+		if err != nil || !bytes.Contains(src, []byte(name)) {
+			continue
+		}
+
+		rank := len(tags.UNIX_PLATFORM_RANKING)
+		if cnstr, ok := tags.Parse(fname, src, sess.GOOS(), sess.BuildTags).(tags.Platforms); ok {
+			for pltf, on := range cnstr {
+				if on && rankOf(pltf) < rank {
+					rank = rankOf(pltf)
+				}
+			}
+		} else {
+			continue
+		}
+		if rank >= bestRank {
+			continue
+		}
+
+		// Use a private file set, we don't want these files to stick around
+		parsed, err := parser.ParseFile(token.NewFileSet(), fname, src, 0)
+		if err != nil {
+			continue
+		}
+
+		for _, decl := range parsed.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vspec := spec.(*ast.ValueSpec)
+				for idx, ident := range vspec.Names {
+					if ident.Name != name || idx >= len(vspec.Values) {
+						continue
+					}
+					if value := literalValue(vspec.Values[idx]); value != nil {
+						best, bestRank = value, rank
+					}
+				}
+			}
+		}
+	}
+	return best
+}
+
+// Evaluate simple constant expressions such as 0x4d, -1 or Errno(0x4d)
+func literalValue(expr ast.Expr) constant.Value {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		return constant.MakeFromLiteral(expr.Value, expr.Kind, 0)
+	case *ast.ParenExpr:
+		return literalValue(expr.X)
+	case *ast.UnaryExpr:
+		if value := literalValue(expr.X); value != nil && (expr.Op == token.SUB || expr.Op == token.XOR) {
+			return constant.UnaryOp(expr.Op, value, 0)
+		}
+	case *ast.CallExpr:
+		// Conversions to named types
+		if len(expr.Args) == 1 {
+			return literalValue(expr.Args[0])
+		}
+	}
+	return nil
+}
+
+// Levenshtein distance between two names
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,143 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+func TestSuggestExhaustedImport(t *testing.T) {
+	sess := testSession(t)
+	pkg := testPackage(t, sess, map[string]string{
+		"p.go": "package p\n\nimport \"example.com/unix\"\n\nvar Errs = []error{unix.EBADFD, unix.EBADFD}\n",
+	}, nil)
+	pkg.Meta.Module = &pkg2.Module{Path: "example.com/p"}
+	pkg.Files["p.go"].Imports = map[string]string{"unix": "example.com/unix"}
+
+	// The import declares EBADFD on linux only, the target has a few candidates to stand in for it
+	dir := t.TempDir()
+	donor := "package unix\n\nconst (\n\tEBADF  = Errno(0x9)\n\tEBADFD = Errno(0x4d)\n)\n"
+	if err := os.WriteFile(filepath.Join(dir, "zerrors_linux.go"), []byte(donor), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := parser.ParseFile(sess.FileSet, "zerrors_zos.go", `package unix
+
+type Errno uintptr
+
+func (e Errno) Error() string { return "" }
+
+const (
+	EBADF   = Errno(0x9)
+	EBADFE  = Errno(0x3)
+	EREMCHG = Errno(0x4d)
+	EBADMSG = Errno(0x4)
+)
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixtypes, err := (&types.Config{}).Check("example.com/unix", sess.FileSet, []*ast.File{src}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixpkg := &pkg2.Package{Meta: &pkg2.MetaPackage{
+		ImportPath:     "example.com/unix",
+		Name:           "unix",
+		Dir:            dir,
+		IgnoredGoFiles: []string{"zerrors_linux.go"},
+	}}
+	pkg.Imports = map[string]*pkg2.Package{"example.com/unix": unixpkg}
+
+	ctx := NewContext(sess)
+	ih := ctx.GetHandle(unixpkg)
+	ih.types, ih.exhausted = unixtypes, true
+	handle := ctx.GetHandle(pkg)
+	handle.types, handle.errs = handle.typeCheck(0, defaultTypeConfig())
+	if len(handle.errs) != 2 {
+		t.Fatalf("expected both uses of EBADFD to fail, got %v", handle.errs)
+	}
+
+	handle.suggest()
+
+	// One entry per symbol: the known alias, the constant with the linux value, then the closest spelling
+	want := []struct {
+		replace    string
+		confidence float64
+		reason     string
+	}{
+		{"EBADF", 0.9, "known alias"},
+		{"EREMCHG", 0.6, "same value (77)"},
+		{"EBADFE", 0.42, "similar name"},
+	}
+	got := ctx.CollectSuggestions()
+	if len(got) != len(want) {
+		t.Fatalf("got suggestions %+v", got)
+	}
+	for idx, sug := range got {
+		if sug.Package != "example.com/unix" || sug.Symbol != "EBADFD" || sug.Directive.Type != base.InlineExportSym ||
+			sug.Directive.Replace != want[idx].replace || sug.Confidence != want[idx].confidence || sug.Reason != want[idx].reason {
+			t.Errorf("suggestion %v is %+v, want %+v", idx, sug, want[idx])
+		}
+	}
+
+	yaml := "example.com/unix:\n  exports:\n    EBADFD:\n      type: EXPORT\n      replace: EBADF\n"
+	if got[0].YAML() != yaml {
+		t.Errorf("suggestion formatted as:\n%s\nwant:\n%s", got[0].YAML(), yaml)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"MAP_ANON", "MAP_ANON", 0},
+		{"MAP_ANON", "MAP_ANONYMOUS", 5},
+		{"EBADFD", "EBADF", 1},
+		{"Fdatasync", "Fsync", 4},
+		{"", "EAGAIN", 6},
+	}
+
+	for _, c := range cases {
+		if got := editDistance(c.a, c.b); got != c.want {
+			t.Errorf("editDistance(%q, %q) = %v, wanted %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestLiteralValue(t *testing.T) {
+	cases := map[string]constant.Value{
+		"0x4d":                 constant.MakeInt64(0x4d),
+		"Errno(0x4d)":          constant.MakeInt64(0x4d),
+		"syscall.Signal(0x1d)": constant.MakeInt64(0x1d),
+		"-(1)":                 constant.MakeInt64(-1),
+		"\"text\"":             constant.MakeString("text"),
+	}
+
+	for src, want := range cases {
+		expr, err := parser.ParseExpr(src)
+		if err != nil {
+			t.Fatalf("unable to parse %v: %v", src, err)
+		}
+		got := literalValue(expr)
+		if got == nil || got.ExactString() != want.ExactString() {
+			t.Errorf("literalValue(%v) = %v, wanted %v", src, got, want)
+		}
+	}
+
+	expr, _ := parser.ParseExpr("SIGIO + 1")
+	if got := literalValue(expr); got != nil {
+		t.Errorf("literalValue(SIGIO + 1) = %v, wanted nil", got)
+	}
+}
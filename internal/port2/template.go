@@ -0,0 +1,242 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/util"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Rewrite calls to symbols with template directives (keyed by "pkgName.Symbol")
+//
+// Calls are located on the AST so the source of every argument is kept exactly as written,
+// placeholders in the template ($0, $1, ...) are substituted by the argument in that position.
+// Only calls qualified by an identifier at one of the given offsets are rewritten (see packageQualifiers),
+// so variables that shadow the import name are left alone.
+// Returns the rewritten source and the import paths that were added to it
+func applyTemplates(name string, src []byte, templates map[string]base.ExportInline, qualifiers map[int]bool) ([]byte, []string, error) {
+	// Use a private file set, the rewritten source is parsed again by the caller
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+	tfile := fset.File(file.Pos())
+
+	imports := make(map[string]bool)
+	var rewrite func(node ast.Node) ([]byte, error)
+	rewrite = func(node ast.Node) ([]byte, error) {
+		var out bytes.Buffer
+		var err error
+		last := tfile.Offset(node.Pos())
+		ast.Inspect(node, func(n ast.Node) bool {
+			if err != nil {
+				return false
+			}
+
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			x, ok := sel.X.(*ast.Ident)
+			if !ok || !qualifiers[tfile.Offset(x.Pos())] {
+				return true
+			}
+			ed, ok := templates[x.Name+"."+sel.Sel.Name]
+			if !ok {
+				return true
+			}
+
+			if call.Ellipsis.IsValid() {
+				err = fmt.Errorf("cannot apply template for %v.%v to a variadic call", x.Name, sel.Sel.Name)
+				return false
+			}
+
+			// Arguments can contain calls that need rewriting too
+			args := make([][]byte, len(call.Args))
+			for idx, arg := range call.Args {
+				if args[idx], err = rewrite(arg); err != nil {
+					return false
+				}
+			}
+
+			var repl []byte
+			if repl, err = expandTemplate(ed.Replace, args); err != nil {
+				err = fmt.Errorf("unable to apply template for %v.%v: %w", x.Name, sel.Sel.Name, err)
+				return false
+			}
+
+			out.Write(src[last:tfile.Offset(call.Pos())])
+			out.Write(repl)
+			last = tfile.Offset(call.End())
+
+			if ed.Import != "" {
+				imports[ed.Import] = true
+			}
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		out.Write(src[last:tfile.Offset(node.End())])
+		return out.Bytes(), nil
+	}
+
+	body, err := rewrite(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := append(append(src[:tfile.Offset(file.Pos()):tfile.Offset(file.Pos())], body...), src[tfile.Offset(file.End()):]...)
+	if len(imports) == 0 {
+		return out, nil, nil
+	}
+
+	// Add the imports needed by the templates that were used
+	fset = token.NewFileSet()
+	file, err = parser.ParseFile(fset, name, out, parser.ParseComments)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse rewritten file: %w", err)
+	}
+
+	added := make([]string, 0, len(imports))
+	for ipath := range imports {
+		if astutil.AddImport(fset, file, ipath) {
+			added = append(added, ipath)
+		}
+	}
+
+	out, err = util.Format(file, fset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, added, nil
+}
+
+// Substitute the placeholders of a template with the source of call arguments
+func expandTemplate(tmpl string, args [][]byte) ([]byte, error) {
+	var out bytes.Buffer
+	for idx := 0; idx < len(tmpl); idx++ {
+		if tmpl[idx] != '$' {
+			out.WriteByte(tmpl[idx])
+			continue
+		}
+
+		end := idx + 1
+		for end < len(tmpl) && tmpl[end] >= '0' && tmpl[end] <= '9' {
+			end++
+		}
+		if end == idx+1 {
+			return nil, fmt.Errorf("expected argument index after '$' in %q", tmpl)
+		}
+
+		arg, _ := strconv.Atoi(tmpl[idx+1 : end])
+		if arg >= len(args) {
+			return nil, fmt.Errorf("template %q uses argument $%v but the call only has %v", tmpl, arg, len(args))
+		}
+		out.Write(operand(args[arg]))
+		idx = end - 1
+	}
+
+	// Keep the replacement a single operand wherever the call appeared
+	expr, err := parser.ParseExpr(out.String())
+	if err != nil {
+		return nil, fmt.Errorf("template does not produce an expression: %w", err)
+	}
+	if !isPrimary(expr) {
+		return append(append([]byte("("), out.Bytes()...), ')'), nil
+	}
+	return out.Bytes(), nil
+}
+
+// Source of an argument that keeps its meaning wherever the template places it
+func operand(arg []byte) []byte {
+	if expr, err := parser.ParseExpr(string(arg)); err == nil && isPrimary(expr) {
+		return arg
+	}
+	return append(append([]byte("("), arg...), ')')
+}
+
+// Expressions that bind tighter than any operator
+func isPrimary(expr ast.Expr) bool {
+	switch expr.(type) {
+	case *ast.Ident, *ast.BasicLit, *ast.CompositeLit, *ast.FuncLit, *ast.ParenExpr, *ast.SelectorExpr,
+		*ast.IndexExpr, *ast.SliceExpr, *ast.TypeAssertExpr, *ast.CallExpr:
+		return true
+	}
+	return false
+}
+
+// Offsets of the identifiers in the file that refer to an imported package (such as unix in unix.Pipe2)
+//
+// Identifiers are resolved with the uses recorded by type checking the file, the offsets are moved
+// by the member renames that are made to the source before templates are applied
+func packageQualifiers(fset *token.FileSet, syntax *ast.File, uses map[*ast.Ident]types.Object, members map[int]memberEdit) map[int]bool {
+	qualifiers := make(map[int]bool)
+	ast.Inspect(syntax, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		x, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if _, ok := uses[x].(*types.PkgName); !ok {
+			return true
+		}
+
+		offset := fset.Position(x.Pos()).Offset
+		shift := 0
+		for moffset, medit := range members {
+			if moffset < offset {
+				shift += len(medit.ed.Replace) - len(medit.member[strings.LastIndexByte(medit.member, '.')+1:])
+			}
+		}
+		qualifiers[offset+shift] = true
+		return true
+	})
+	return qualifiers
+}
+
+// Imports of a file after templates added the given import paths to it
+//
+// Packages templates may add are loaded and ordered before the package (see pkg2.Package.TemplateImports),
+// except for packages that depend on the package themselves. They become imports of the package here,
+// once a template that needs them is applied.
+func templateImports(gofile *pkg2.GoFile, pkg *pkg2.Package, added []string) (map[string]string, error) {
+	imports := make(map[string]string, len(gofile.Imports)+len(added))
+	for iname, ipath := range gofile.Imports {
+		imports[iname] = ipath
+	}
+	for _, ipath := range added {
+		ipkg := pkg.Imports[ipath]
+		if ipkg == nil {
+			if ipkg = pkg.TemplateImports[ipath]; ipkg == nil {
+				return nil, fmt.Errorf("%v cannot be imported by %v (it was not loaded or it depends on %v)", ipath, pkg.Meta.ImportPath, pkg.Meta.ImportPath)
+			}
+			pkg.Imports[ipath] = ipkg
+			ipkg.Parents = append(ipkg.Parents, pkg)
+		}
+		imports[ipkg.Meta.Name] = ipath
+	}
+	return imports, nil
+}
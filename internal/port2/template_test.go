@@ -0,0 +1,112 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	args := [][]byte{[]byte("p[:]"), []byte("flags|1")}
+
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"compat.Pipe2($0, $1)", "compat.Pipe2(p[:], (flags|1))"},
+		{"unix.Pipe($0)", "unix.Pipe(p[:])"},
+		{"$1 + 0", "((flags|1) + 0)"},
+		{"$1 * 2", "((flags|1) * 2)"},
+		{"$0[0]", "p[:][0]"},
+	}
+
+	for _, test := range tests {
+		got, err := expandTemplate(test.tmpl, args)
+		if err != nil {
+			t.Errorf("expandTemplate(%q) failed: %v", test.tmpl, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("expandTemplate(%q) = %q, want %q", test.tmpl, got, test.want)
+		}
+	}
+
+	for _, tmpl := range []string{"f($2)", "f($)", "f($0"} {
+		if _, err := expandTemplate(tmpl, args); err == nil {
+			t.Errorf("expandTemplate(%q) should have failed", tmpl)
+		}
+	}
+}
+
+func TestApplyTemplatesNested(t *testing.T) {
+	src := `package p
+
+import "golang.org/x/sys/unix"
+
+// Keep this comment
+func f(fd int) error {
+	return unix.Fdatasync(int(unix.Fdatasync( fd )))
+}
+
+func g(unix syncer) error {
+	return unix.Fdatasync(0)
+}
+`
+	templates := map[string]base.ExportInline{
+		"unix.Fdatasync": {Type: base.InlineTemplateSym, Replace: "unix.Fsync($0)"},
+	}
+
+	// Only the calls in f are qualified by the package, g's parameter shadows it
+	qualifiers := make(map[int]bool)
+	for offset, n := strings.Index(src, "unix.Fdatasync"), 0; n < 2; n++ {
+		qualifiers[offset] = true
+		offset += strings.Index(src[offset+1:], "unix.Fdatasync") + 1
+	}
+
+	out, added, err := applyTemplates("p.go", []byte(src), templates, qualifiers)
+	if err != nil {
+		t.Fatalf("applyTemplates failed: %v", err)
+	}
+	if len(added) > 0 {
+		t.Errorf("unexpected imports added: %v", added)
+	}
+
+	want := "return unix.Fsync(int(unix.Fsync(fd)))"
+	if !strings.Contains(string(out), want) {
+		t.Errorf("expected %q in:\n%s", want, out)
+	}
+	if !strings.Contains(string(out), "return unix.Fdatasync(0)") {
+		t.Errorf("call on a variable shadowing the import was rewritten:\n%s", out)
+	}
+	if !strings.Contains(string(out), "// Keep this comment") {
+		t.Errorf("comments were lost:\n%s", out)
+	}
+}
+
+func TestTemplateImports(t *testing.T) {
+	unix := &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: "golang.org/x/sys/unix", Name: "unix"}}
+	pkg := &pkg2.Package{
+		Meta:    &pkg2.MetaPackage{ImportPath: "example.com/p", Name: "p"},
+		Imports: map[string]*pkg2.Package{unix.Meta.ImportPath: unix},
+	}
+	gofile := &pkg2.GoFile{Name: "p.go", Imports: map[string]string{"os": "os"}}
+
+	imports, err := templateImports(gofile, pkg, []string{"golang.org/x/sys/unix"})
+	if err != nil {
+		t.Fatalf("templateImports failed: %v", err)
+	}
+	if imports["unix"] != "golang.org/x/sys/unix" || imports["os"] != "os" || len(gofile.Imports) != 1 {
+		t.Errorf("got imports %v (file imports %v)", imports, gofile.Imports)
+	}
+
+	// Packages that were not loaded as dependencies of the package cannot be imported
+	if _, err := templateImports(gofile, pkg, []string{"example.com/compat"}); err == nil {
+		t.Errorf("template import of a package that was not loaded was accepted")
+	}
+}
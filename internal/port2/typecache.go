@@ -0,0 +1,232 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"golang.org/x/tools/go/gcexportdata"
+)
+
+// Bump whenever the key or the stored format changes
+const typeCacheVersion = "wharf-types-1"
+
+// Entries not used for this long are removed from the type cache (like the go build cache does),
+// the cache is trimmed at most once per trimInterval and entries are only marked as used once per usedInterval
+const (
+	typeCacheMaxAge = 5 * 24 * time.Hour
+	trimInterval    = 24 * time.Hour
+	usedInterval    = time.Hour
+)
+
+// Key of the type data of a build in the persistent type cache
+//
+// The key covers the toolchain, the package directory, the contents of every file in the build
+// and the keys of its imports, so a package is only found again if nothing it depends on changed.
+// The metadata of the files (digests, constraints and imports) is cached next to it by pkg2,
+// only listing the packages (go list) happens on every run, that is how changes to the workspace
+// and the build list are noticed. Returns an empty key if the build can't be cached.
+func (handle *Handle) typesKey(build int, cfg *types.Config) string {
+	sess := handle.ctx.sess
+	if sess.TypeCache == "" {
+		return ""
+	}
+
+	pkg := handle.pkg
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\n%v %v\n", typeCacheVersion, sess.GoEnv("GOVERSION"), sess.GoEnv("GOROOT"))
+	fmt.Fprintf(h, "%v/%v\n", sess.GOOS(), sess.GOARCH())
+	fmt.Fprintf(h, "%v %v\n", pkg.Meta.ImportPath, pkg.Meta.Dir)
+	fmt.Fprintf(h, "bodies=%v\n", !cfg.IgnoreFuncBodies)
+
+	tags := make([]string, 0, len(sess.BuildTags))
+	for tag, set := range sess.BuildTags {
+		if set {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	fmt.Fprintf(h, "tags=%v\n", tags)
+
+	imports := make(map[string]bool)
+	for _, gofile := range pkg.Builds[build].Files {
+		digest, err := gofile.Digest()
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(h, "file %v %v\n", gofile.Name, digest)
+
+		for _, ipath := range gofile.Imports {
+			imports[ipath] = true
+		}
+	}
+
+	paths := make([]string, 0, len(imports))
+	for ipath := range imports {
+		if ipath != pkg2.UNSAFE_PACKAGE_NAME && ipath != pkg2.CGO_PACKAGE_NAME {
+			paths = append(paths, ipath)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, ipath := range paths {
+		ipkg := pkg.Imports[ipath]
+		if ipkg == nil {
+			return ""
+		}
+
+		// Imports whose types were changed after they were keyed can't be trusted
+		ih := handle.ctx.handleOf(ipkg)
+		if ih == nil || ih.cacheKey == "" || ih.types != ih.keyedTypes {
+			return ""
+		}
+		fmt.Fprintf(h, "import %v %v\n", ipath, ih.cacheKey)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Location of the type data stored under the key in the cache directory
+func typesPath(dir string, key string) string {
+	return filepath.Join(dir, key[:2], key)
+}
+
+// Load the type data stored under the key, returns nil if there isn't any (or it is unusable)
+func (handle *Handle) cachedTypes(key string) *types.Package {
+	if key == "" {
+		return nil
+	}
+
+	path := typesPath(handle.ctx.sess.TypeCache, key)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	// Objects from imported packages must resolve to the ones already loaded
+	imports := make(map[string]*types.Package)
+	var collect func(typed *types.Package)
+	collect = func(typed *types.Package) {
+		if imports[typed.Path()] != nil {
+			return
+		}
+		imports[typed.Path()] = typed
+		for _, itype := range typed.Imports() {
+			collect(itype)
+		}
+	}
+
+	pkg := handle.pkg
+	for _, ipkg := range pkg.Imports {
+		if ih := handle.ctx.handleOf(ipkg); ih != nil && ih.types != nil {
+			collect(ih.types)
+		}
+	}
+
+	typed, err := gcexportdata.Read(bufio.NewReader(file), handle.ctx.sess.FileSet, imports, pkg.Meta.ImportPath)
+	if err != nil || typed.Name() != pkg.Meta.Name {
+		return nil
+	}
+
+	// Keep entries that are still in use from being trimmed
+	if info, err := file.Stat(); err == nil && time.Since(info.ModTime()) > usedInterval {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return typed
+}
+
+// Store type data under the key, failures only mean the package is type checked again next time
+func (handle *Handle) storeTypes(key string, typed *types.Package) {
+	if key == "" {
+		return
+	}
+
+	dst := typesPath(handle.ctx.sess.TypeCache, key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+
+	// Write to a temporary file first so concurrent runs never see partial data
+	tmp, err := os.CreateTemp(filepath.Dir(dst), key+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	out := bufio.NewWriter(tmp)
+	err = gcexportdata.Write(out, handle.ctx.sess.FileSet, typed)
+	if err == nil {
+		err = out.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+
+	os.Rename(tmp.Name(), dst)
+}
+
+// Remove the entries of the type cache in dir that were not used for typeCacheMaxAge
+//
+// The time of the last trim is kept in dir/trim.txt so the cache is walked at most once per trimInterval.
+// Entries are shared between concurrent runs, one that is removed while in use is simply stored again.
+func TrimTypeCache(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	now := time.Now()
+	marker := filepath.Join(dir, "trim.txt")
+	if data, err := os.ReadFile(marker); err == nil {
+		if last, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && now.Sub(time.Unix(last, 0)) < trimInterval {
+			return nil
+		}
+	}
+
+	subdirs, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to trim type cache: %w", err)
+	}
+
+	cutoff := now.Add(-typeCacheMaxAge)
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() || len(subdir.Name()) != 2 {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(dir, subdir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			// Temporary files left behind by runs that died are trimmed the same way
+			if info, err := entry.Info(); err == nil && info.Mode().IsRegular() && info.ModTime().Before(cutoff) {
+				os.Remove(filepath.Join(dir, subdir.Name(), entry.Name()))
+			}
+		}
+	}
+
+	if err := os.WriteFile(marker, []byte(fmt.Sprintf("%v\n", now.Unix())), 0644); err != nil {
+		return fmt.Errorf("unable to trim type cache: %w", err)
+	}
+	return nil
+}
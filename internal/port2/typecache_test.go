@@ -0,0 +1,155 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package port2
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+)
+
+func TestTypeCacheRoundTrip(t *testing.T) {
+	sess := testSession(t)
+	sess.TypeCache = t.TempDir()
+
+	src := `package p
+
+type Fd int
+
+func Open(name string) (Fd, error) { return 0, nil }
+`
+	syntax, err := parser.ParseFile(sess.FileSet, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.Config{}
+	typed, err := conf.Check("example.com/p", sess.FileSet, []*ast.File{syntax}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle := &Handle{
+		pkg: &pkg2.Package{Meta: &pkg2.MetaPackage{ImportPath: "example.com/p", Name: "p"}},
+		ctx: NewContext(sess),
+	}
+
+	key := strings.Repeat("ab", 32)
+	if handle.cachedTypes(key) != nil {
+		t.Fatal("found types before they were stored")
+	}
+
+	handle.storeTypes(key, typed)
+
+	// Using an entry keeps it from being trimmed
+	path := typesPath(sess.TypeCache, key)
+	old := time.Now().Add(-typeCacheMaxAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := handle.cachedTypes(key)
+	if cached == nil {
+		t.Fatal("stored types were not found")
+	}
+	if info, err := os.Stat(path); err != nil || time.Since(info.ModTime()) > usedInterval {
+		t.Errorf("entry was not marked as used")
+	}
+
+	open, ok := cached.Scope().Lookup("Open").(*types.Func)
+	if !ok {
+		t.Fatal("Open missing from cached types")
+	}
+	if got, want := open.Type().String(), "func(name string) (example.com/p.Fd, error)"; got != want {
+		t.Errorf("Open has type %v, want %v", got, want)
+	}
+}
+
+func TestTrimTypeCache(t *testing.T) {
+	dir := t.TempDir()
+	write := func(key string, age time.Duration) string {
+		path := typesPath(dir, key)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("types"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	stale := write(strings.Repeat("ab", 32), typeCacheMaxAge+time.Hour)
+	fresh := write(strings.Repeat("ac", 32), time.Hour)
+
+	if err := TrimTypeCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("unused entry was kept")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("entry in use was removed: %v", err)
+	}
+
+	// The cache is only walked once per interval
+	stale = write(strings.Repeat("cd", 32), typeCacheMaxAge+time.Hour)
+	if err := TrimTypeCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("cache was trimmed again right away")
+	}
+
+	if err := TrimTypeCache(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("trimming a cache that doesn't exist failed: %v", err)
+	}
+}
+
+func TestRefreshUsesTypeCache(t *testing.T) {
+	cache := t.TempDir()
+	files := map[string]string{
+		"p.go":       "package p\n\nfunc G() int { return F() }\n",
+		"f_linux.go": "package p\n\nfunc F() int { return 1 }\n",
+	}
+
+	var dir string
+	for run := 0; run < 2; run++ {
+		// Every run starts with a fresh session, like a new invocation of wharf
+		sess := testSession(t)
+		sess.TypeCache = cache
+
+		pkg := testPackage(t, sess, files, []string{"f_linux.go"})
+		if dir == "" {
+			dir = pkg.Meta.Dir
+		}
+		pkg.Meta.Dir = dir
+		pkg.Dirty = true
+
+		handle := NewContext(sess).GetHandle(pkg)
+		handle.Refresh()
+		if handle.types == nil || handle.types.Scope().Lookup("G") == nil || len(handle.errs) != 0 {
+			t.Fatalf("run %v: got types %v with errors %v", run, handle.types, handle.errs)
+		}
+
+		// Type checking from source parses the files, loading from the cache doesn't
+		parsed := pkg.Builds[0].Syntax != nil
+		if run == 0 && !parsed {
+			t.Errorf("first run did not type check the package")
+		}
+		if run == 1 && parsed {
+			t.Errorf("second run type checked the package instead of using the cache")
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 )
@@ -37,32 +38,41 @@ func GitDiff(target string, output string) error {
 	return run(cmd)
 }
 
+// Where go commands run
+type Env struct {
+	// Working directory, the go.work (or go.mod) of the workspace is looked up from it (empty for the one of the process)
+	Dir string
+
+	// Environment variables (KEY=value) set on top of the process environment
+	Vars []string
+}
+
 // Run go env and return all it's contents
-func GoEnv() (map[string]string, error) {
-	cmd := exec.Command("go", "env", "-json")
+func GoEnv(env Env) (map[string]string, error) {
+	cmd := goCommand(env, "env", "-json")
 	out, err := runout(cmd)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%v\n %w", out, err)
 	}
 
-	var env map[string]string
-	if err := json.Unmarshal([]byte(out), &env); err != nil {
+	var goenv map[string]string
+	if err := json.Unmarshal([]byte(out), &goenv); err != nil {
 		return nil, err
 	}
 
-	return env, nil
+	return goenv, nil
 }
 
 // Run go build on the command line
-func GoBuild(paths []string) (string, error) {
+func GoBuild(env Env, paths []string) (string, error) {
 	// TODO: pass in additional build flags
-	cmd := exec.Command("go", append([]string{"build", "-mod=readonly"}, paths...)...)
+	cmd := goCommand(env, append([]string{"build", "-mod=readonly"}, paths...)...)
 	return runout(cmd)
 }
 
 // Run tests on a package
-func GoTest(paths []string) (string, error) {
-	cmd := exec.Command("go", append([]string{"test"}, paths...)...)
+func GoTest(env Env, paths []string) (string, error) {
+	cmd := goCommand(env, append([]string{"test"}, paths...)...)
 	return runout(cmd)
 }
 
@@ -70,22 +80,28 @@ func GoTest(paths []string) (string, error) {
 // WORKSPACE COMMANDS //
 ////////////////////////
 
-func GoWorkUse(path string) error {
-	cmd := exec.Command("go", "work", "use", path)
+func GoWorkUse(env Env, path string) error {
+	cmd := goCommand(env, "work", "use", path)
+	return run(cmd)
+}
+
+// Add a use entry to go.work (the path is written as given, relative paths are relative to the go.work directory)
+func GoWorkEditUse(env Env, path string) error {
+	cmd := goCommand(env, "work", "edit", "-use="+path)
 	return run(cmd)
 }
 
 // Replace entry in go.mod
-func GoWorkEditReplaceVersion(path string, version string) error {
-	cmd := exec.Command("go", "work", "edit", "-replace",
+func GoWorkEditReplaceVersion(env Env, path string, version string) error {
+	cmd := goCommand(env, "work", "edit", "-replace",
 		path+"="+path+"@"+version,
 	)
 	return run(cmd)
 }
 
 // Drop replace entry in go.mod
-func GoWorkEditDropReplace(path string) error {
-	cmd := exec.Command("go", "work", "edit", "-dropreplace", path)
+func GoWorkEditDropReplace(env Env, path string) error {
+	cmd := goCommand(env, "work", "edit", "-dropreplace", path)
 	return run(cmd)
 }
 
@@ -94,39 +110,106 @@ func GoWorkEditDropReplace(path string) error {
 /////////////////////////////////
 
 // Tidy go.mod
-func GoModTidy() error {
-	cmd := exec.Command("go", "mod", "tidy")
+func GoModTidy(env Env) error {
+	cmd := goCommand(env, "mod", "tidy")
 	return run(cmd)
 }
 
 // Init go.mod
-func GoModInit(dir string, path string) error {
-	cmd := exec.Command("go", "mod", "init", path)
+func GoModInit(env Env, dir string, path string) error {
+	cmd := goCommand(env, "mod", "init", path)
 	cmd.Dir = dir
 	return run(cmd)
 }
 
 // Run go list -m -u
-func GoListModUpdate(mod string) (string, error) {
-	cmd := exec.Command("go", "list", "-f", "{{if .Update}}{{.Update.Version}}{{else}}{{.Version}}{{end}}", "-m", "-u", "-mod=readonly", mod)
+func GoListModUpdate(env Env, mod string) (string, error) {
+	cmd := goCommand(env, "list", "-f", "{{if .Update}}{{.Update.Version}}{{else}}{{.Version}}{{end}}", "-m", "-u", "-mod=readonly", mod)
 	return runout(cmd)
 }
 
+// Run go list -m -versions and return the known versions of the module (ascending)
+func GoListModVersions(env Env, mod string) ([]string, error) {
+	cmd := goCommand(env, "list", "-f", "{{range .Versions}}{{.}} {{end}}", "-m", "-versions", "-mod=readonly", mod)
+	out, err := runout(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// Run go list -m and return the go directive of each version of the module (keyed by version)
+func GoListModGoVersions(env Env, mod string, versions []string) (map[string]string, error) {
+	queries := make([]string, 0, len(versions))
+	for _, version := range versions {
+		queries = append(queries, mod+"@"+version)
+	}
+	cmd := goCommand(env, append([]string{"list", "-f", "{{.Version}} {{.GoVersion}}", "-m", "-mod=readonly"}, queries...)...)
+	out, err := runout(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	goVersions := make(map[string]string, len(versions))
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			goVersions[fields[0]] = fields[1]
+		}
+	}
+	return goVersions, nil
+}
+
+// Run go list -m all and return the version of every module in the build list (keyed by path)
+//
+// Main modules are left out, modules replaced by a directory get the path of the directory.
+func GoListModAll(env Env) (map[string]string, error) {
+	cmd := goCommand(env, "list", "-f", "{{if not .Main}}{{.Path}} {{with .Replace}}{{or .Version .Path}}{{else}}{{.Version}}{{end}}{{end}}", "-m", "-mod=readonly", "all")
+	out, err := runout(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if path, version, ok := strings.Cut(strings.TrimSpace(line), " "); ok {
+			versions[path] = version
+		}
+	}
+	return versions, nil
+}
+
 // Run go list -m and return the directory of the active version
-func GoListModDir(mod string) (string, error) {
-	cmd := exec.Command("go", "list", "-f", "{{if .Replace}}{{.Replace.Dir}}{{else}}{{.Dir}}{{end}}", "-m", "-mod=readonly", mod)
+func GoListModDir(env Env, mod string) (string, error) {
+	cmd := goCommand(env, "list", "-f", "{{if .Replace}}{{.Replace.Dir}}{{else}}{{.Dir}}{{end}}", "-m", "-mod=readonly", mod)
 	return runout(cmd)
 }
 
 // Run go list
-func GoList(pkgs []string) (string, error) {
-	cmd := exec.Command("go", append([]string{"list", "-json", "-e", "-deps", "-mod=readonly"}, pkgs...)...)
+func GoList(env Env, pkgs []string) (string, error) {
+	cmd := goCommand(env, append([]string{"list", "-json", "-e", "-deps", "-mod=readonly"}, pkgs...)...)
 	return runout(cmd)
 }
 
+// Run go list -export and return the export data file of each package (empty if it failed to compile)
+func GoListExport(env Env, pkgs []string) (map[string]string, error) {
+	cmd := goCommand(env, append([]string{"list", "-e", "-export", "-f", "{{.ImportPath}}\t{{.Export}}", "-mod=readonly"}, pkgs...)...)
+	out, err := runout(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	exports := make(map[string]string, len(pkgs))
+	for _, line := range strings.Split(out, "\n") {
+		if path, file, ok := strings.Cut(line, "\t"); ok {
+			exports[path] = file
+		}
+	}
+	return exports, nil
+}
+
 // Run go list -find
-func GoListPkgDir(pkg string) (string, error) {
-	cmd := exec.Command("go", "list", "-f", "{{.Dir}}", "-find", "-e", "-mod=readonly", pkg)
+func GoListPkgDir(env Env, pkg string) (string, error) {
+	cmd := goCommand(env, "list", "-f", "{{.Dir}}", "-find", "-e", "-mod=readonly", pkg)
 	out, err := runout(cmd)
 	if err != nil {
 		return "", fmt.Errorf("%v\n %w", out, err)
@@ -134,8 +217,18 @@ func GoListPkgDir(pkg string) (string, error) {
 	return out, err
 }
 
-func GoListModMain(mod string) error {
-	cmd := exec.Command("go", "list", "-m", "-f", "{{.Main}}", "-mod=readonly", mod)
+// Run go list -m and return the go.mod file of every main module
+func GoListMainGoMods(env Env) ([]string, error) {
+	cmd := goCommand(env, "list", "-m", "-f", "{{.GoMod}}", "-mod=readonly")
+	out, err := runout(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+func GoListModMain(env Env, mod string) error {
+	cmd := goCommand(env, "list", "-m", "-f", "{{.Main}}", "-mod=readonly", mod)
 	out, err := runout(cmd)
 	if err != nil {
 		return err
@@ -146,6 +239,16 @@ func GoListModMain(mod string) error {
 	return nil
 }
 
+// Create a go command running in the directory of env, its variables are added to the environment of the process
+func goCommand(env Env, args ...string) *exec.Cmd {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = env.Dir
+	if len(env.Vars) > 0 {
+		cmd.Env = append(os.Environ(), env.Vars...)
+	}
+	return cmd
+}
+
 // Run a command, return stdout
 func runout(cmd *exec.Cmd) (string, error) {
 	var stdout bytes.Buffer
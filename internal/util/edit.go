@@ -10,6 +10,8 @@ import (
 	"go/format"
 	"go/token"
 	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
 )
 
 func Format(src *ast.File, fset *token.FileSet) ([]byte, error) {
@@ -59,3 +61,102 @@ func AppendTagString(src []byte, tag string, op string, notice string) ([]byte,
 
 	return src, nil
 }
+
+// Removes an import from a file (name is only needed if the import is renamed)
+func RemoveImport(fset *token.FileSet, file *ast.File, name string, path string) bool {
+	return astutil.DeleteNamedImport(fset, file, name, path)
+}
+
+// Marks the variable declared at the given position as used by adding a blank assignment
+// (type switch bindings are dropped instead)
+func UseVariable(fset *token.FileSet, file *ast.File, name string, line int, column int) bool {
+	tfile := fset.File(file.Pos())
+	if tfile == nil || line < 1 || line > tfile.LineCount() {
+		return false
+	}
+	pos := tfile.LineStart(line) + token.Pos(column-1)
+
+	path, _ := astutil.PathEnclosingInterval(file, pos, pos)
+	if len(path) == 0 {
+		return false
+	}
+	if ident, ok := path[0].(*ast.Ident); !ok || ident.Name != name {
+		return false
+	}
+
+	use := func() ast.Stmt {
+		return &ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent("_")},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{ast.NewIdent(name)},
+		}
+	}
+	prepend := func(list []ast.Stmt) []ast.Stmt {
+		return append([]ast.Stmt{use()}, list...)
+	}
+	within := func(node ast.Node) bool {
+		return node != nil && node.Pos() <= pos && pos < node.End()
+	}
+
+	for idx, node := range path[1:] {
+		// Declared in the header of a statement, so use it at the start of its body
+		switch stmt := node.(type) {
+		case *ast.TypeSwitchStmt:
+			if assign, ok := stmt.Assign.(*ast.AssignStmt); ok && within(assign) && len(assign.Rhs) == 1 {
+				stmt.Assign = &ast.ExprStmt{X: assign.Rhs[0]}
+				return true
+			}
+		case *ast.RangeStmt:
+			if within(stmt.Key) || within(stmt.Value) {
+				stmt.Body.List = prepend(stmt.Body.List)
+				return true
+			}
+		case *ast.ForStmt:
+			if within(stmt.Init) {
+				stmt.Body.List = prepend(stmt.Body.List)
+				return true
+			}
+		case *ast.IfStmt:
+			if within(stmt.Init) {
+				stmt.Body.List = prepend(stmt.Body.List)
+				return true
+			}
+		case *ast.CommClause:
+			if within(stmt.Comm) {
+				stmt.Body = prepend(stmt.Body)
+				return true
+			}
+		case *ast.SwitchStmt:
+			if within(stmt.Init) {
+				for _, clause := range stmt.Body.List {
+					clause := clause.(*ast.CaseClause)
+					clause.Body = prepend(clause.Body)
+				}
+				return true
+			}
+		}
+
+		// Otherwise use it right after the statement that declares it
+		var list *[]ast.Stmt
+		switch block := node.(type) {
+		case *ast.BlockStmt:
+			list = &block.List
+		case *ast.CaseClause:
+			list = &block.Body
+		case *ast.CommClause:
+			list = &block.Body
+		default:
+			continue
+		}
+
+		decl := path[idx]
+		for sidx, stmt := range *list {
+			if stmt == decl {
+				*list = append((*list)[:sidx+1], append([]ast.Stmt{use()}, (*list)[sidx+1:]...)...)
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
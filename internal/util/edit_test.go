@@ -0,0 +1,61 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+package util
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestUseVariable(t *testing.T) {
+	src := `package p
+
+func f(ch chan int) {
+	x := 1
+	for i := range []int{} {
+	}
+	switch v := any(1).(type) {
+	case int:
+	}
+	select {
+	case y := <-ch:
+	}
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := []struct {
+		name         string
+		line, column int
+	}{
+		{"x", 4, 2},
+		{"i", 5, 6},
+		{"v", 7, 9},
+		{"y", 11, 7},
+	}
+	for _, v := range vars {
+		if !UseVariable(fset, file, v.name, v.line, v.column) {
+			t.Errorf("unable to use variable %v", v.name)
+		}
+	}
+	if UseVariable(fset, file, "z", 4, 2) {
+		t.Errorf("used a variable that isn't declared at the given position")
+	}
+
+	out, err := Format(file, fset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"_ = x", "_ = i", "switch any(1).(type)", "_ = y"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+}
@@ -10,13 +10,15 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"golang.org/x/tools/go/vcs"
 )
 
 // Copies a module to the given path
-func CloneModuleFromCache(dstdir string, modpath string) error {
-	srcdir, err := GoListModDir(modpath)
+func CloneModuleFromCache(env Env, dstdir string, modpath string) error {
+	srcdir, err := GoListModDir(env, modpath)
 	if err != nil {
 		return err
 	}
@@ -26,12 +28,14 @@ func CloneModuleFromCache(dstdir string, modpath string) error {
 		return err
 	}
 
-	return generate(filepath.Join(dstdir, "go.mod"), goModTemplate(modpath))
+	return generateGoMod(env, dstdir, modpath)
 }
 
-// Copies a module to the given path
-func CloneModuleFromVCS(dstdir string, modpath string, version string) error {
-	repo, err := vcs.RepoRootForImportPath(modpath, false)
+// Clones a module at the given version to the given path
+//
+// The repository is looked up for from: the module itself, or the fork the workspace replaced it with.
+func CloneModuleFromVCS(env Env, dstdir string, modpath string, from string, version string) error {
+	repo, err := vcs.RepoRootForImportPath(from, false)
 	if err != nil {
 		return err
 	}
@@ -41,7 +45,7 @@ func CloneModuleFromVCS(dstdir string, modpath string, version string) error {
 		return err
 	}
 
-	return generate(filepath.Join(dstdir, "go.mod"), goModTemplate(modpath))
+	return generateGoMod(env, dstdir, modpath)
 }
 
 // Util copy function
@@ -111,17 +115,156 @@ func copyDir(dst, src string) error {
 	return nil
 }
 
-func goModTemplate(path string) string {
-	// TODO: figure out a way to make sure we keep the same versions for stuff
-	return "// Generated by IBM Wharf; DO NOT EDIT.\nmodule " + path + "\n"
-}
+// Go version assumed by the go command for modules without a go directive
+const defaultGoVersion = "1.16"
 
-func generate(file, content string) error {
-	if _, err := os.Stat(file); err == nil {
+// Make sure the go.mod of an imported module declares the module's path, write one if it has none
+//
+// A fork the module was replaced with keeps its requirements but takes the path of the module it replaces
+// (the copy is used in its place). Code that predates modules gets a go.mod with the requirements kept
+// as they were in the workspace before the import, so the module builds with the same versions of its dependencies.
+func generateGoMod(env Env, dstdir string, modpath string) error {
+	file := filepath.Join(dstdir, "go.mod")
+	if data, err := os.ReadFile(file); err == nil {
+		if content, changed := withModulePath(string(data), modpath); changed {
+			if err := os.WriteFile(file, []byte(content), 0666); err != nil {
+				return fmt.Errorf("could not update module path in %q: %w", file, err)
+			}
+		}
 		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	content, err := goModFile(env, modpath)
+	if err != nil {
+		return fmt.Errorf("could not generate %q: %w", file, err)
 	}
 	if err := os.WriteFile(file, []byte(content), 0666); err != nil {
 		return fmt.Errorf("could not generate %q: %w", file, err)
 	}
 	return nil
 }
+
+// Content of the go.mod of a module in the build list of the workspace (looked up by its own path)
+//
+// The .mod file of the module (or of its replacement) in the module cache is used if it has more than
+// the module path (the go command makes up one with only the module path for modules without a go.mod),
+// otherwise the requirements are the versions the build list selects for the modules the packages of the module import.
+func goModFile(env Env, modpath string) (string, error) {
+	out, err := runout(goCommand(env, "list", "-m", "-f", "{{with .Replace}}{{.GoMod}}{{else}}{{.GoMod}}{{end}}\t{{.GoVersion}}", "-mod=readonly", modpath))
+	if err != nil {
+		return "", err
+	}
+	gomod, goVersion, _ := strings.Cut(out, "\t")
+
+	if data, err := os.ReadFile(gomod); err == nil && hasRequirements(string(data)) {
+		content, _ := withModulePath(string(data), modpath)
+		return content, nil
+	}
+
+	if goVersion == "" {
+		goVersion = defaultGoVersion
+	}
+
+	// Packages the packages of the module import directly
+	out, err = runout(goCommand(env, "list", "-e", "-mod=readonly", "-f", "{{range .Imports}}{{.}} {{end}}", modpath+"/..."))
+	if err != nil {
+		return "", err
+	}
+	seen := make(map[string]bool)
+	imports := make([]string, 0, 8)
+	for _, ipath := range strings.Fields(out) {
+		if !seen[ipath] && ipath != "C" && ipath != modpath && !strings.HasPrefix(ipath, modpath+"/") {
+			seen[ipath] = true
+			imports = append(imports, ipath)
+		}
+	}
+
+	requires := make(map[string]string)
+	if len(imports) > 0 {
+		// Versions of the modules providing them (pins included)
+		out, err = runout(goCommand(env, append([]string{"list", "-e", "-mod=readonly",
+			"-f", "{{with .Module}}{{if not .Main}}{{.Path}} {{with .Replace}}{{if eq .Path $.Module.Path}}{{.Version}}{{end}}{{end}} {{.Version}}{{end}}{{end}}",
+		}, imports...)...))
+		if err != nil {
+			return "", err
+		}
+
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] == modpath {
+				continue
+			}
+			// The version pinned by a replace comes first
+			requires[fields[0]] = fields[1]
+		}
+	}
+
+	return goModContent(modpath, goVersion, requires), nil
+}
+
+// Path the module directive of a go.mod declares, empty if it has none
+func ModulePath(gomod string) string {
+	for _, line := range strings.Split(gomod, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`)
+		}
+	}
+	return ""
+}
+
+// Go.mod with the module directive changed to declare modpath, false if it already did (or has none)
+func withModulePath(gomod string, modpath string) (string, bool) {
+	lines := strings.Split(gomod, "\n")
+	for idx, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "module" {
+			continue
+		}
+		if strings.Trim(fields[1], `"`) == modpath {
+			return gomod, false
+		}
+		lines[idx] = strings.Replace(line, fields[1], modpath, 1)
+		return strings.Join(lines, "\n"), true
+	}
+	return gomod, false
+}
+
+const goModHeader = "// Generated by IBM Wharf; DO NOT EDIT.\n"
+
+func goModContent(modpath string, goVersion string, requires map[string]string) string {
+	var content strings.Builder
+	content.WriteString(goModHeader)
+	fmt.Fprintf(&content, "module %v\n\ngo %v\n", modpath, goVersion)
+
+	paths := make([]string, 0, len(requires))
+	for path := range requires {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	switch len(paths) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&content, "\nrequire %v %v\n", paths[0], requires[paths[0]])
+	default:
+		content.WriteString("\nrequire (\n")
+		for _, path := range paths {
+			fmt.Fprintf(&content, "\t%v %v\n", path, requires[path])
+		}
+		content.WriteString(")\n")
+	}
+	return content.String()
+}
+
+// Report whether a go.mod has anything besides the module path
+func hasRequirements(gomod string) bool {
+	for _, line := range strings.Split(gomod, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "go ") || strings.HasPrefix(line, "require") {
+			return true
+		}
+	}
+	return false
+}
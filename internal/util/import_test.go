@@ -0,0 +1,67 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGoModContent(t *testing.T) {
+	got := goModContent("example.com/old", "1.16", map[string]string{
+		"example.com/b": "v1.2.0",
+		"example.com/a": "v0.1.0",
+	})
+	want := goModHeader + `module example.com/old
+
+go 1.16
+
+require (
+	example.com/a v0.1.0
+	example.com/b v1.2.0
+)
+`
+	if got != want {
+		t.Errorf("got go.mod:\n%v\nwant:\n%v", got, want)
+	}
+
+	got = goModContent("example.com/old", "1.18", map[string]string{"example.com/a": "v0.1.0"})
+	if want := goModHeader + "module example.com/old\n\ngo 1.18\n\nrequire example.com/a v0.1.0\n"; got != want {
+		t.Errorf("got go.mod:\n%v\nwant:\n%v", got, want)
+	}
+
+	if hasRequirements("module example.com/old\n") || !hasRequirements("module example.com/old\n\ngo 1.18\n") {
+		t.Errorf("module cache .mod files are not told apart")
+	}
+}
+
+func TestGenerateGoModForFork(t *testing.T) {
+	// A fork the module was replaced with at a version declares its own path
+	dir := t.TempDir()
+	fork := "module example.com/fork // fork of example.com/orig\n\ngo 1.18\n\nrequire example.com/dep v1.0.0\n"
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(fork), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generateGoMod(Env{}, dir, "example.com/orig"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "module example.com/orig // fork of example.com/orig\n\ngo 1.18\n\nrequire example.com/dep v1.0.0\n"
+	if string(data) != want {
+		t.Errorf("got go.mod:\n%v\nwant:\n%v", string(data), want)
+	}
+	if got := ModulePath(string(data)); got != "example.com/orig" {
+		t.Errorf("go.mod declares %v", got)
+	}
+
+	// Go.mod files that already declare the module are left alone
+	if _, changed := withModulePath(want, "example.com/orig"); changed {
+		t.Errorf("module path of the copy changed again")
+	}
+}
@@ -0,0 +1,93 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+package util
+
+import (
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Compare two module versions following semantic versioning (build metadata is ignored)
+//
+// Invalid versions are lower than every valid one and equal to each other.
+func CompareVersions(x, y string) int {
+	return semver.Compare(x, y)
+}
+
+// Report whether the string is a module version (rather than a directory a module is replaced by)
+func IsVersion(v string) bool {
+	return semver.IsValid(v)
+}
+
+// Report whether the version is a prerelease (pseudo-versions included)
+func IsPrerelease(v string) bool {
+	return semver.Prerelease(v) != ""
+}
+
+// Report whether both versions have the same major version (and the same minor version if minor is set)
+func SameRelease(x, y string, minor bool) bool {
+	if !semver.IsValid(x) || !semver.IsValid(y) {
+		return false
+	}
+	if minor {
+		return semver.MajorMinor(x) == semver.MajorMinor(y)
+	}
+	return semver.Major(x) == semver.Major(y)
+}
+
+// Compare numbers of any length given as decimal strings
+func compareNumbers(x, y string) int {
+	x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+	if len(x) != len(y) {
+		if len(x) < len(y) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(x, y)
+}
+
+// Compare two Go versions as used by go directives (1.21, 1.21.0, 1.21rc1)
+//
+// Release candidates and betas are lower than the release of the same version.
+func CompareGoVersions(x, y string) int {
+	xs, ys := strings.Split(x, "."), strings.Split(y, ".")
+	for i := 0; i < len(xs) || i < len(ys); i++ {
+		xnum, xpre := splitGoVersionPart(xs, i)
+		ynum, ypre := splitGoVersionPart(ys, i)
+		if c := compareNumbers(xnum, ynum); c != 0 {
+			return c
+		}
+		if xpre != ypre {
+			switch {
+			case xpre == "":
+				return 1
+			case ypre == "":
+				return -1
+			}
+			return strings.Compare(xpre, ypre)
+		}
+	}
+	return 0
+}
+
+// Number and prerelease suffix (rc1, beta2) of a part of a Go version, missing parts are 0
+func splitGoVersionPart(parts []string, i int) (string, string) {
+	if i >= len(parts) {
+		return "0", ""
+	}
+	part := parts[i]
+	end := 0
+	for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+		end++
+	}
+	return part[:end], part[end:]
+}
+
+// Report whether the version is a pseudo-version (refers to a commit rather than a release)
+func IsPseudoVersion(v string) bool {
+	return module.IsPseudoVersion(v)
+}
@@ -0,0 +1,72 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+package util
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	// Ascending order
+	versions := []string{
+		"bad",
+		"v0.0.0-20230101000000-abcdefabcdef",
+		"v0.0.0",
+		"v0.1.0",
+		"v0.9.0",
+		"v0.10.0",
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-alpha.beta",
+		"v1.0.0-beta.2",
+		"v1.0.0-beta.11",
+		"v1.0.0-rc.1",
+		"v1.0.0",
+		"v1.2.3",
+		"v1.2.4-0.20230101000000-abcdefabcdef",
+		"v1.2.4",
+		"v2.0.0+incompatible",
+	}
+
+	for i, x := range versions {
+		for j, y := range versions {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := CompareVersions(x, y); got != want {
+				t.Errorf("CompareVersions(%v, %v) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	if !IsPrerelease("v1.2.4-0.20230101000000-abcdefabcdef") || IsPrerelease("v2.0.0+incompatible") {
+		t.Errorf("prereleases are not recognized")
+	}
+	if !IsPseudoVersion("v0.0.0-20230101000000-abcdefabcdef") || !IsPseudoVersion("v1.2.4-0.20230101000000-abcdefabcdef") || IsPseudoVersion("v1.0.0-rc.1") {
+		t.Errorf("pseudo-versions are not recognized")
+	}
+}
+
+func TestCompareGoVersions(t *testing.T) {
+	// Ascending order
+	versions := []string{"1.18", "1.20rc1", "1.20", "1.20.1", "1.21beta1", "1.21.0", "1.22"}
+	for i, x := range versions {
+		for j, y := range versions {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := CompareGoVersions(x, y); got != want {
+				t.Errorf("CompareGoVersions(%v, %v) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	if !SameRelease("v1.2.0", "v1.2.5", true) || SameRelease("v1.2.0", "v1.3.0", true) || !SameRelease("v1.2.0", "v1.3.0", false) || SameRelease("v1.2.0", "v2.0.0", false) {
+		t.Errorf("releases are not compared by major and minor version")
+	}
+}
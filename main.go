@@ -5,20 +5,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"strings"
 
 	"github.com/mattn/go-isatty"
-	"github.com/zosopentools/wharf/internal/base"
-	"github.com/zosopentools/wharf/internal/pkg2"
-	"github.com/zosopentools/wharf/internal/tags"
 	"github.com/zosopentools/wharf/internal/util"
+	"github.com/zosopentools/wharf/wharf"
 )
 
 const shaLen = 7
@@ -44,9 +45,18 @@ func main() {
 	vcsFlag := flag.Bool("q", false, "Clone the package from VCS")
 	configFlag := flag.String("config", "", "Config for additional code edits")
 	patchesFlag := flag.Bool("p", false, "Saves patch files to filesystem path")
-	iDirFlag := flag.String("d", "", "Path to store imported modules") // TODO: Enable
+	iDirFlag := flag.String("d", "", "Path to store imported modules, each under its module path (default: wharf_port next to go.work)")
 	forceFlag := flag.Bool("f", false, "Force operation even if imported module path exists")
 	versionFlag := flag.Bool("version", false, "Display version information")
+	jobsFlag := flag.Int("j", runtime.NumCPU(), "Number of packages to type check in parallel")
+	noCacheFlag := flag.Bool("nocache", false, "Don't reuse or store type data and file metadata between runs")
+	memFlag := flag.Uint64("mem", 0, "Memory budget in MiB, syntax trees are parsed again instead of kept past it")
+	borrowFlag := flag.Int("borrow", 2, "Most missing names declarations are borrowed for instead of retagging files")
+	strategiesFlag := flag.String("strategies", "", "Porting strategies to try in order")
+	pinFlag := flag.String("pin", "", "How the version of a module that needs porting is picked (update, minimal)")
+	golangXFlag := flag.Bool("golangx", false, "Port golang.org/x modules like any other dependency")
+	jsonFlag := flag.Bool("json", false, "Print the planned changes as JSON (progress goes to stderr)")
+	targetFlag := flag.String("target", "", "Platform to port to as GOOS/GOARCH (default: the Go environment)")
 	flag.Parse()
 
 	// Turn off log flags
@@ -80,33 +90,57 @@ func main() {
 		log.Fatal("no package paths provided; see 'wharf --help' for usage")
 	}
 
-	// Handle config file argument
-	if *configFlag != "" {
-		if err := base.LoadInlines(*configFlag); err != nil {
-			log.Fatal("unable to load inlines file", err)
-		}
-	}
-
 	if *patchesFlag && !*vcsFlag {
 		log.Fatal("cannot use -p flag without enabling vcs cloning")
 	}
 
+	opts := wharf.Options{
+		Paths:       flag.Args(),
+		Target:      *targetFlag,
+		Config:      *configFlag,
+		DryRun:      *dryRunFlag,
+		ImportDir:   *iDirFlag,
+		VCS:         *vcsFlag,
+		Jobs:        *jobsFlag,
+		NoCache:     *noCacheFlag,
+		BorrowLimit: *borrowFlag,
+		PinSearch:   *pinFlag,
+		PortGolangX: *golangXFlag,
+		Log:         os.Stdout,
+		Planned:     printResult,
+	}
+
+	// Keep stdout for the JSON document
+	var report io.Writer = os.Stdout
+	if *jsonFlag {
+		report = os.Stderr
+		opts.Log = report
+		opts.Planned = printJSON
+	}
+
 	if len(*tagsFlag) > 0 {
-		for _, tag := range strings.Split(*tagsFlag, ",") {
-			base.BuildTags[tag] = true
-		}
+		opts.Tags = strings.Split(*tagsFlag, ",")
 	}
 
-	if len(*iDirFlag) > 0 {
-		base.ImportDir = *iDirFlag
+	if *memFlag > 0 {
+		opts.MemoryLimit = *memFlag << 20
+	}
+
+	if len(*strategiesFlag) > 0 {
+		opts.Strategies = strings.Split(*strategiesFlag, ",")
+	}
+
+	importDir, err := wharf.ImportDir(opts)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
 	// Bypass if set to force operations (this is intended for scripts to be able to use if necessary)
 	if !*forceFlag {
-		_, dstErr := os.Lstat(base.ImportDir)
+		_, dstErr := os.Lstat(importDir)
 		if dstErr == nil {
 			if isatty.IsTerminal(os.Stdin.Fd()) {
-				fmt.Printf("warning: import destination already exists: %v\n", base.ImportDir)
+				fmt.Printf("warning: import destination already exists: %v\n", importDir)
 				fmt.Println("warning: running Wharf may cause some data to get overridden")
 				fmt.Print("continue? [y/N]: ")
 				var confirm string
@@ -115,138 +149,119 @@ func main() {
 					os.Exit(0)
 				}
 			} else {
-				log.Fatalf("error: import destination already exists: %v\n", base.ImportDir)
+				log.Fatalf("error: import destination already exists: %v\n", importDir)
 			}
 		}
 	}
 
 	if *verboseFlag {
-		fmt.Println("importing modules to:", base.ImportDir)
+		fmt.Fprintln(report, "importing modules to:", importDir)
 	}
 
-	paths := flag.Args()
-
-	if base.GOWORK() == "" {
-		log.Fatalln("no workspace found; please initialize one using `go work init` and add modules")
-	}
+	out, err := wharf.Port(context.Background(), opts)
 
-	// Setup a private go.work file to make changes to as we work - while keeping the original safe
-	wfWork := filepath.Join(filepath.Dir(base.GOWORK()), ".wharf.work")
-	if err := util.CopyFile(wfWork, base.GOWORK()); err != nil {
-		log.Fatalf("unable to create temporary workspace: %v\n", err)
-	}
-	defer func() {
-		if err := os.Remove(wfWork + ".sum"); err != nil && !errors.Is(err, os.ErrNotExist) {
-			log.Printf("unable to remove: %v: %v\n", wfWork+".sum", err)
+	var applyErr *wharf.ApplyError
+	if errors.As(err, &applyErr) {
+		for _, err := range applyErr.Errors {
+			log.Printf("ERROR: %v\n", err)
 		}
-	}()
-
-	if err := os.MkdirAll(base.Cache, 0755); err != nil {
-		log.Fatalf("unable to create cache at %v: %v\n", base.Cache, err)
-	}
-
-	if err := os.Setenv("GOWORK", wfWork); err != nil {
-		log.Fatalf("unable to set GOWORK: %v\n", err)
-	}
-
-	out, err := main2(paths, false)
-
-	if err != nil {
+		log.Fatalln("\nAn error occurred while applying changes.\nPlease apply missing patches manually.")
+	} else if err != nil {
 		log.Println(err.Error())
+		if out != nil {
+			if *jsonFlag {
+				out.Errors = err.Error()
+				printJSON(out)
+			} else {
+				printSuggestions(out.Suggestions)
+			}
+		}
 		log.Fatalln("porting failed due to errors mentioned above")
 	}
 
-	fmt.Println("porting successful!")
-	fmt.Println("\n--- MODULE CHANGES ---")
-	for _, pin := range out.Modules {
-		printPin(pin)
-	}
-	fmt.Println("\n--- PACKAGE CHANGES ---")
-	for _, patch := range out.Packages {
-		printPatch(patch)
-	}
-
 	// Don't apply next steps (patches)
 	if *dryRunFlag {
 		os.Exit(0)
 	}
 
-	failed := false
-	madeImportDir := false
-	for _, pin := range out.Modules {
-		if pin.Imported {
-			if !madeImportDir {
-				if err := os.Mkdir(base.ImportDir, 0755); err != nil {
-					log.Printf("ERROR: unable to create folder for importing modules: %v: %v", base.ImportDir, err)
-					failed = true
-					break
-				}
-			}
-			pin.Dir, _ = pkg2.ImportPathToAssumedName(pin.Path)
-			pin.Dir = filepath.Join(base.ImportDir, pin.Dir)
-			if err := importModule(pin, *vcsFlag); err != nil {
-				failed = true
-				log.Printf("ERROR: unable to import module %v@%v: %v\n", pin.Path, pin.Pinned, err)
-			}
-		}
-	}
-
-	if failed {
-		log.Fatalln("\nAn error occurred while importing modules.\nPatches will need to be applied manually.")
-	}
+	fmt.Fprintln(report, "backed up workspace to", out.GoWorkBackup)
+	fmt.Fprintln(report, "patches applied successfully!")
 
-	for _, patch := range out.Packages {
-		if err := applyPatch(patch); err != nil {
-			failed = true
-			log.Printf("unable to apply patch for %v: %v\n", patch.Path, err)
+	// TODO: remove
+	if *testFlag {
+		// Run tests
+		fmt.Fprintln(report, "\nRunning tests...")
+		if output, err := wharf.Test(opts); err != nil {
+			fmt.Fprintln(report, "Tests failed:\n"+output)
+		} else {
+			fmt.Fprintln(report, "Tests passed!")
 		}
 	}
+}
 
-	if failed {
-		log.Fatalln("\nAn error occurred while applying patches.\nPlease apply missing patches manually.")
+func printResult(out *wharf.Result) {
+	fmt.Println("porting successful!")
+	for _, warning := range out.Warnings {
+		fmt.Println("\nWARNING:", warning)
 	}
-
-	backup := base.GOWORK() + ".backup"
-	if err = util.CopyFile(backup, base.GOWORK()); err != nil {
-		log.Printf("unable to backup workspace to %v: %v\n", backup, err)
-	} else if err = util.CopyFile(base.GOWORK(), wfWork); err != nil {
-		log.Printf("unable to update workspace: %v\n", wfWork)
-	} else {
-		fmt.Println("backed up workspace to", backup)
+	fmt.Println("\n--- MODULE CHANGES ---")
+	for _, pin := range out.Modules {
+		printPin(pin)
 	}
+	printBuildList(out.BuildList)
+	fmt.Println("\n--- PACKAGE CHANGES ---")
+	for _, patch := range out.Packages {
+		printPatch(out.GOOS, patch)
+	}
+	printSuggestions(out.Suggestions)
+}
 
+func printJSON(out *wharf.Result) {
+	data, err := json.MarshalIndent(out, "", "  ")
 	if err != nil {
-		log.Println("An error occurred:")
-		log.Println("\tUnable to replace the current GOWORK file with our copy.")
-		log.Println("\tTherefore, some patches might not be applied.")
-		log.Println("\tOur copy is located here:", wfWork)
-	} else {
-		if err := os.Remove(wfWork); err != nil {
-			log.Printf("unable to remove: %v: %v\n", wfWork, err)
-		}
+		log.Fatalf("unable to encode result: %v\n", err)
 	}
+	fmt.Println(string(data))
+}
 
-	if err := os.RemoveAll(base.Cache); err != nil {
-		log.Printf("unable to remove cache: %v: %v\n", base.Cache, err)
+func printBuildList(changes []wharf.BuildChange) {
+	if len(changes) == 0 {
+		return
 	}
 
-	fmt.Println("patches applied successfully!")
-
-	// TODO: remove
-	if *testFlag {
-		// Run tests
-		fmt.Println("\nRunning tests...")
-		if output, err := util.GoTest(paths); err != nil {
-			fmt.Println("Tests failed:\n" + output)
-		} else {
-			fmt.Println("Tests passed!")
+	fmt.Println("\n--- BUILD LIST CHANGES ---")
+	for _, change := range changes {
+		fmt.Printf("# %v: ", change.Path)
+		switch {
+		case change.Before == "":
+			fmt.Print("ADDED ", change.After)
+		case change.After == "":
+			fmt.Print("REMOVED ", change.Before)
+		case !util.IsVersion(change.Before) || !util.IsVersion(change.After):
+			fmt.Print("REPLACED ", change.Before, " => ", change.After)
+		case util.CompareVersions(change.After, change.Before) < 0:
+			fmt.Print("DOWNGRADED ", change.Before, " => ", change.After)
+		default:
+			fmt.Print("UPGRADED ", change.Before, " => ", change.After)
 		}
+		if change.Pinned {
+			fmt.Print(" (pinned)")
+		}
+		fmt.Println()
 	}
 }
 
-func printPin(pin base.ModulePin) {
+func printPin(pin wharf.ModulePin) {
 	fmt.Printf("# %v (%v): ", pin.Path, pin.Version)
-	if pin.Imported {
+	if pin.Local {
+		fmt.Printf("REPLACED BY %v (ported in place)\n", pin.Replace)
+	} else if pin.Replace != "" {
+		fmt.Printf("REPLACED BY %v@%v", pin.Replace, pin.Pinned)
+		if pin.Imported {
+			fmt.Print(", IMPORTED")
+		}
+		fmt.Println()
+	} else if pin.Imported {
 		fmt.Println("IMPORTED")
 	} else if pin.Pinned != pin.Version {
 		fmt.Println("UPDATED TO", pin.Pinned)
@@ -255,7 +270,20 @@ func printPin(pin base.ModulePin) {
 	}
 }
 
-func printPatch(patch base.PackagePatch) {
+func printSuggestions(suggestions []wharf.Suggestion) {
+	if len(suggestions) == 0 {
+		return
+	}
+
+	fmt.Println("\n--- SUGGESTIONS ---")
+	fmt.Println("# the following entries can be added to a config file (see -config)")
+	for _, sug := range suggestions {
+		fmt.Printf("\n# %v.%v: %v (confidence %.2f)\n", sug.Package, sug.Symbol, sug.Reason, sug.Confidence)
+		fmt.Print(sug.YAML())
+	}
+}
+
+func printPatch(goos string, patch wharf.PackagePatch) {
 	fmt.Println("#", patch.Path)
 
 	if len(patch.Tags) == 0 {
@@ -276,10 +304,12 @@ func printPatch(patch base.PackagePatch) {
 		fmt.Printf("- %v:\n", file.Name)
 		if file.BaseFile == "" {
 			if !file.Build {
-				fmt.Printf("\tadded tag '!%v'\n", base.GOOS())
+				fmt.Printf("\tadded tag '!%v'\n", goos)
 			} else {
-				fmt.Printf("\tadded tag '%v'\n", base.GOOS())
+				fmt.Printf("\tadded tag '%v'\n", goos)
 			}
+		} else if len(file.Borrowed) > 0 {
+			fmt.Printf("\tborrowed %v from %v\n", strings.Join(file.Borrowed, ", "), file.BaseFile)
 		} else {
 			fmt.Printf("\tcopied to %v\n", file.BaseFile)
 
@@ -287,128 +317,26 @@ func printPatch(patch base.PackagePatch) {
 				fmt.Printf("\treplaced %v with %v\n", symbol.Original, symbol.New)
 			}
 		}
-	}
-}
-
-func importModule(pin base.ModulePin, useVCS bool) error {
-	if !pin.Imported {
-		return nil
-	}
-
-	if useVCS {
-		if err := util.CloneModuleFromVCS(
-			pin.Dir,
-			pin.Path,
-			strings.TrimSuffix(pin.Pinned, "+incompatible"),
-		); err != nil {
-			return err
-		}
-	} else {
-		if err := util.CloneModuleFromCache(pin.Dir, pin.Path); err != nil {
-			return err
-		}
-	}
 
-	if err := util.GoWorkEditDropReplace(pin.Path); err != nil {
-		return err
-	}
-
-	rel, _ := filepath.Rel(filepath.Dir(base.GOWORK()), pin.Dir)
-	// TODO: Go work use fails silently on a missing go.mod file, rerun 'go list' to verify it is now a main module position has changed
-	if err := util.GoWorkUse(rel); err != nil {
-		return err
-	}
-
-	err := util.GoListModMain(pin.Path)
-	if err != nil && !pkg2.IsExcludeGoListError(err.Error()) {
-		return err
-	}
-
-	return nil
-}
-
-func applyPatch(patch base.PackagePatch) error {
-	patch.Dir, _ = util.GoListPkgDir(patch.Path)
-
-	resolveFilePath := func(file string) string {
-		return filepath.Join(patch.Dir, file)
-	}
-
-	if patch.Template {
-		for _, file := range patch.Files {
-			if file.BaseFile != "" {
-				if err := util.CopyFile(resolveFilePath(file.Name), file.Cached); err != nil {
-					return err
-				}
+		for _, cleanup := range file.Cleanups {
+			switch cleanup.Kind {
+			case wharf.CleanupImport:
+				fmt.Printf("\tremoved unused import %q\n", cleanup.Path)
+			case wharf.CleanupVariable:
+				fmt.Printf("\tmarked unused variable %v as used (line %v)\n", cleanup.Name, cleanup.Line)
 			}
 		}
-		return nil
-	}
-
-	// Apply changes to files that were changed
-	for _, file := range patch.Files {
-		if file.BaseFile != "" {
-			// Copy the file from the cache
-			if err := util.CopyFile(resolveFilePath(file.Name), file.Cached); err != nil {
-				return err
-			}
-
-			// Add the file tag
-			src, err := util.Format(file.Syntax, pkg2.FileSet)
-			if err != nil {
-				return err
-			}
-
-			src, err = util.AppendTagString(src, base.GOOS(), "", fmt.Sprintf(base.FILE_NOTICE, file.BaseFile))
-			if err != nil {
-				return err
-			}
-
-			err = os.WriteFile(resolveFilePath(file.Name), src, 0744)
-			if err != nil {
-				return err
-			}
-		} else if file.Build {
-			// Append zos tag
-			src, err := util.Format(file.Syntax, pkg2.FileSet)
-			if err != nil {
-				return err
-			}
-
-			src, err = util.AppendTagString(src, base.GOOS(), "||", fmt.Sprintf(base.TAG_NOTICE, base.GOOS()))
-			if err != nil {
-				return err
-			}
-
-			name := file.Name
-			cnstr, _ := tags.ParseFileName(name)
-			if cnstr != nil {
-				name = strings.TrimSuffix(name, ".go") + "_" + base.GOOS() + ".go"
-			}
-
-			err = os.WriteFile(resolveFilePath(name), src, 0744)
-			if err != nil {
-				return err
-			}
-		} else {
-			// Append !zos tag
-			src, err := util.Format(file.Syntax, pkg2.FileSet)
-			if err != nil {
-				return err
-			}
-
-			src, err = util.AppendTagString(src, "!"+base.GOOS(), "&&", fmt.Sprintf(base.TAG_NOTICE, "!"+base.GOOS()))
-			if err != nil {
-				return err
-			}
-
-			err = os.WriteFile(resolveFilePath(file.Name), src, 0744)
-			if err != nil {
-				return err
-			}
-		}
-
 	}
+}
 
+func generatePatchFiles(path string) error {
+	// outdir, _ := filepath.Abs(base.GOWORK())
+	// outdir = filepath.Dir(outdir)
+	// for path := range diffs {
+	// 	out := filepath.Join(outdir, filepath.Base(path)+".patch")
+	// 	if err := util.GitDiff(path, out); err != nil {
+	// 		fmt.Fprintf(os.Stderr, "Unable to produce patch file for repo located at %v: %v", path, err.Error())
+	// 	}
+	// }
 	return nil
 }
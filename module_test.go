@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -21,14 +22,14 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/wharf"
 	"golang.org/x/tools/go/vcs"
 	"gopkg.in/yaml.v3"
 )
 
 type jsonOut struct {
-	Modules  []base.ModulePin
-	Packages []base.PackagePatch
+	Modules  []wharf.ModulePin
+	Packages []wharf.PackagePatch
 }
 
 const WHARF_TEST_RUN = "WHARF_TEST_RUN"
@@ -112,7 +113,7 @@ func TestMain(m *testing.M) {
 	flag.Parse()
 
 	if _, ranAsWharf := os.LookupEnv(WHARF_TEST_RUN); ranAsWharf {
-		if out, err := main2(os.Args[1:], true); err == nil {
+		if out, err := wharf.Port(context.Background(), wharf.Options{Paths: os.Args[1:], DryRun: true}); err == nil {
 			printJson(out)
 		} else {
 			fmt.Printf("unable to port: %v", err)
@@ -248,10 +249,6 @@ func TestModules(t *testing.T) {
 						t.Fatalf("go.work not created: unable to stat go.work: %v", err)
 					}
 
-					if err := os.MkdirAll(base.Cache, 0755); err != nil {
-						t.Fatalf("unable to create cache at %v: %v\n", base.Cache, err)
-					}
-
 					cmd = exec.Command(testBin, test.Paths...)
 					cmd.Dir = testRoot
 					cmd.Env = append(os.Environ(), "WHARF_TEST_RUN=1")
@@ -274,7 +271,7 @@ func TestModules(t *testing.T) {
 					if len(expect.Modules) != len(out.Modules) {
 						t.FailNow()
 					}
-					moduleSet := make(map[string]*base.ModulePin, len(expect.Modules))
+					moduleSet := make(map[string]*wharf.ModulePin, len(expect.Modules))
 					for i := range expect.Modules {
 						mod := &expect.Modules[i]
 						moduleSet[mod.Path] = mod
@@ -290,7 +287,7 @@ func TestModules(t *testing.T) {
 					if len(expect.Packages) != len(out.Packages) {
 						t.FailNow()
 					}
-					packageSet := make(map[string]*base.PackagePatch, len(expect.Packages))
+					packageSet := make(map[string]*wharf.PackagePatch, len(expect.Packages))
 					for i := range expect.Packages {
 						pkg := &expect.Packages[i]
 						packageSet[pkg.Path] = pkg
@@ -308,7 +305,7 @@ func TestModules(t *testing.T) {
 	}
 }
 
-func compareModules(a *base.ModulePin, b *base.ModulePin) bool {
+func compareModules(a *wharf.ModulePin, b *wharf.ModulePin) bool {
 	if a.Path != b.Path || a.Version != b.Version {
 		return false
 	}
@@ -327,7 +324,7 @@ func compareModules(a *base.ModulePin, b *base.ModulePin) bool {
 	return true
 }
 
-func comparePackages(a *base.PackagePatch, b *base.PackagePatch) bool {
+func comparePackages(a *wharf.PackagePatch, b *wharf.PackagePatch) bool {
 	if a.Path != b.Path || a.Module != b.Module {
 		return false
 	}
@@ -349,7 +346,7 @@ func comparePackages(a *base.PackagePatch, b *base.PackagePatch) bool {
 	if len(a.Files) != len(b.Files) {
 		return false
 	}
-	files := make(map[string]*base.FilePatch, len(a.Files))
+	files := make(map[string]*wharf.FilePatch, len(a.Files))
 	for i := range a.Files {
 		aFile := &a.Files[i]
 		files[aFile.Name] = aFile
@@ -365,7 +362,7 @@ func comparePackages(a *base.PackagePatch, b *base.PackagePatch) bool {
 		if len(aFile.Symbols) != len(bFile.Symbols) {
 			return false
 		}
-		symbols := make(map[string]*base.SymbolRepl, len(aFile.Symbols))
+		symbols := make(map[string]*wharf.SymbolRepl, len(aFile.Symbols))
 		for i := range aFile.Symbols {
 			aSymbol := &aFile.Symbols[i]
 			symbols[aSymbol.Original] = aSymbol
@@ -382,7 +379,7 @@ func comparePackages(a *base.PackagePatch, b *base.PackagePatch) bool {
 	return true
 }
 
-func printJson(out *base.Output) {
+func printJson(out *wharf.Result) {
 	if outstrm, err := json.MarshalIndent(out, "", "\t"); err == nil {
 		fmt.Println(string(outstrm))
 	} else {
@@ -0,0 +1,306 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package wharf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/tags"
+	"github.com/zosopentools/wharf/internal/util"
+	"golang.org/x/mod/modfile"
+)
+
+// Changes that could not be applied
+//
+// Modules are imported before any patch is applied, if any of them failed no patches were applied.
+type ApplyError struct {
+	Errors []error
+}
+
+func (err *ApplyError) Error() string {
+	msgs := make([]string, 0, len(err.Errors))
+	for _, e := range err.Errors {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Import the modules that need porting into the workspace and apply the patches to their packages
+func apply(sess *base.Session, out *base.Output, useVCS bool) error {
+	var errs []error
+	for i := range out.Modules {
+		if pin := &out.Modules[i]; pin.Imported {
+			pin.Dir = importDirFor(sess.ImportDir, pin.Path)
+		}
+	}
+	if err := checkImportDirs(out.Modules); err != nil {
+		return &ApplyError{Errors: []error{err}}
+	}
+
+	for _, pin := range out.Modules {
+		if pin.Imported {
+			if err := importModule(sess, pin, useVCS); err != nil {
+				errs = append(errs, fmt.Errorf("unable to import module %v@%v: %w", pin.Path, pin.Pinned, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ApplyError{Errors: errs}
+	}
+
+	for _, patch := range out.Packages {
+		if err := applyPatch(sess, patch); err != nil {
+			errs = append(errs, fmt.Errorf("unable to apply patch for %v: %w", patch.Path, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ApplyError{Errors: errs}
+	}
+	return nil
+}
+
+// Directory a module is imported to: its module path under the import dir (major version suffix included)
+func importDirFor(importDir string, modpath string) string {
+	return filepath.Join(importDir, filepath.FromSlash(modpath))
+}
+
+// Verify the imported modules don't overwrite each other or modules imported before
+//
+// Module paths that only differ in case end up in the same directory on case insensitive file systems.
+func checkImportDirs(pins []base.ModulePin) error {
+	seen := make(map[string]string)
+	for _, pin := range pins {
+		if !pin.Imported {
+			continue
+		}
+
+		key := strings.ToLower(pin.Dir)
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("modules %v and %v would both be imported to %v", other, pin.Path, pin.Dir)
+		}
+		seen[key] = pin.Path
+
+		if modpath := importedModulePath(pin.Dir); modpath != "" && modpath != pin.Path {
+			return fmt.Errorf("unable to import module %v: %v already holds module %v", pin.Path, pin.Dir, modpath)
+		}
+	}
+	return nil
+}
+
+// Path of the module in the directory (from its go.mod), empty if there is none
+func importedModulePath(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	return util.ModulePath(string(data))
+}
+
+// Remove the unused imports and variables that would stop the file from compiling
+func applyCleanups(sess *base.Session, file base.FilePatch) error {
+	for _, cleanup := range file.Cleanups {
+		ok := false
+		switch cleanup.Kind {
+		case base.CleanupImport:
+			ok = util.RemoveImport(sess.FileSet, file.Syntax, cleanup.Name, cleanup.Path)
+		case base.CleanupVariable:
+			ok = util.UseVariable(sess.FileSet, file.Syntax, cleanup.Name, cleanup.Line, cleanup.Column)
+		}
+		if !ok {
+			return fmt.Errorf("unable to clean up unused %v in %v (line %v)", cleanup.Kind, file.Name, cleanup.Line)
+		}
+	}
+	return nil
+}
+
+func importModule(sess *base.Session, pin base.ModulePin, useVCS bool) error {
+	if !pin.Imported {
+		return nil
+	}
+
+	// Replacements in go.mod files are not ours to drop, they would conflict with the copy
+	if replaces, err := goModReplaces(sess, pin); err != nil {
+		return err
+	} else if len(replaces) > 0 {
+		return fmt.Errorf("the module is replaced by %v; remove the replace directive "+
+			"(or move it to go.work, the copy is then made from the replacement) and run wharf again", strings.Join(replaces, ", "))
+	}
+
+	if useVCS {
+		// A module the workspace replaced with another one is cloned from the replacement
+		from := pin.Path
+		if pin.Replace != "" {
+			from = pin.Replace
+		}
+		if err := util.CloneModuleFromVCS(
+			sess.Env,
+			pin.Dir,
+			pin.Path,
+			from,
+			strings.TrimSuffix(pin.Pinned, "+incompatible"),
+		); err != nil {
+			return err
+		}
+	} else {
+		if err := util.CloneModuleFromCache(sess.Env, pin.Dir, pin.Path); err != nil {
+			return err
+		}
+	}
+
+	if err := util.GoWorkEditDropReplace(sess.Env, pin.Path); err != nil {
+		return err
+	}
+	// So is a replacement of the version the workspace had (such as a fork), the copy takes its place
+	if pin.Replace != "" {
+		if err := util.GoWorkEditDropReplace(sess.Env, pin.Path+"@"+pin.Version); err != nil {
+			return err
+		}
+	}
+
+	// Relative use entries keep the workspace valid wherever it is checked out
+	rel, err := filepath.Rel(filepath.Dir(sess.GOWORK()), pin.Dir)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(rel, "..") {
+		rel = "." + string(filepath.Separator) + rel
+	}
+	// The entry is only written, verify with 'go list' that the module is now a main module
+	if err := util.GoWorkEditUse(sess.Env, filepath.ToSlash(rel)); err != nil {
+		return err
+	}
+
+	err = util.GoListModMain(sess.Env, pin.Path)
+	if err != nil && !pkg2.IsExcludeGoListError(err.Error()) {
+		return err
+	}
+
+	return nil
+}
+
+// Replace directives of the go.mod files of main modules that are in effect for the module
+func goModReplaces(sess *base.Session, pin base.ModulePin) ([]string, error) {
+	gomods, err := util.GoListMainGoMods(sess.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	var replaces []string
+	for _, gomod := range gomods {
+		data, err := os.ReadFile(gomod)
+		if err != nil {
+			return nil, err
+		}
+		file, err := modfile.Parse(gomod, data, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, repl := range file.Replace {
+			if repl.Old.Path == pin.Path && (repl.Old.Version == "" || repl.Old.Version == pin.Version) {
+				replaces = append(replaces, fmt.Sprintf("%v (%v:%v)", repl.New, gomod, repl.Syntax.Start.Line))
+			}
+		}
+	}
+	return replaces, nil
+}
+
+func applyPatch(sess *base.Session, patch base.PackagePatch) error {
+	patch.Dir, _ = util.GoListPkgDir(sess.Env, patch.Path)
+
+	resolveFilePath := func(file string) string {
+		return filepath.Join(patch.Dir, file)
+	}
+
+	if patch.Template {
+		for _, file := range patch.Files {
+			if file.BaseFile != "" {
+				if err := util.CopyFile(resolveFilePath(file.Name), file.Cached); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	// Apply changes to files that were changed
+	for _, file := range patch.Files {
+		if file.BaseFile != "" {
+			// Copy the file from the cache
+			if err := util.CopyFile(resolveFilePath(file.Name), file.Cached); err != nil {
+				return err
+			}
+
+			// Add the file tag
+			if err := applyCleanups(sess, file); err != nil {
+				return err
+			}
+			src, err := util.Format(file.Syntax, sess.FileSet)
+			if err != nil {
+				return err
+			}
+
+			src, err = util.AppendTagString(src, sess.GOOS(), "", fmt.Sprintf(base.FILE_NOTICE, file.BaseFile))
+			if err != nil {
+				return err
+			}
+
+			err = os.WriteFile(resolveFilePath(file.Name), src, 0744)
+			if err != nil {
+				return err
+			}
+		} else if file.Build {
+			// Append zos tag
+			if err := applyCleanups(sess, file); err != nil {
+				return err
+			}
+			src, err := util.Format(file.Syntax, sess.FileSet)
+			if err != nil {
+				return err
+			}
+
+			src, err = util.AppendTagString(src, sess.GOOS(), "||", fmt.Sprintf(base.TAG_NOTICE, sess.GOOS()))
+			if err != nil {
+				return err
+			}
+
+			name := file.Name
+			cnstr, _ := tags.ParseFileName(name)
+			if cnstr != nil {
+				name = strings.TrimSuffix(name, ".go") + "_" + sess.GOOS() + ".go"
+			}
+
+			err = os.WriteFile(resolveFilePath(name), src, 0744)
+			if err != nil {
+				return err
+			}
+		} else {
+			// Append !zos tag
+			src, err := util.Format(file.Syntax, sess.FileSet)
+			if err != nil {
+				return err
+			}
+
+			src, err = util.AppendTagString(src, "!"+sess.GOOS(), "&&", fmt.Sprintf(base.TAG_NOTICE, "!"+sess.GOOS()))
+			if err != nil {
+				return err
+			}
+
+			err = os.WriteFile(resolveFilePath(file.Name), src, 0744)
+			if err != nil {
+				return err
+			}
+		}
+
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package wharf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/util"
+)
+
+func TestImportDirs(t *testing.T) {
+	root := t.TempDir()
+	pins := []base.ModulePin{
+		{Path: "github.com/a/log", Imported: true},
+		{Path: "github.com/b/log", Imported: true},
+		{Path: "github.com/a/log/v2", Imported: true},
+		{Path: "github.com/c/local", Local: true, Dir: "/work/local"},
+	}
+	for i := range pins {
+		if pins[i].Imported {
+			pins[i].Dir = importDirFor(root, pins[i].Path)
+		}
+	}
+
+	if want := filepath.Join(root, "github.com", "a", "log", "v2"); pins[2].Dir != want {
+		t.Errorf("got dir %v, want %v", pins[2].Dir, want)
+	}
+	if err := checkImportDirs(pins); err != nil {
+		t.Fatalf("distinct modules collide: %v", err)
+	}
+
+	// Module paths that only differ in case
+	upper := append(pins, base.ModulePin{Path: "github.com/A/log", Imported: true, Dir: importDirFor(root, "github.com/A/log")})
+	if err := checkImportDirs(upper); err == nil {
+		t.Errorf("modules differing in case don't collide")
+	}
+
+	// Directory already holding another module
+	if err := os.MkdirAll(pins[1].Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pins[1].Dir, "go.mod"), []byte("module github.com/other/log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkImportDirs(pins); err == nil {
+		t.Errorf("module imported over another module")
+	}
+	if err := os.WriteFile(filepath.Join(pins[1].Dir, "go.mod"), []byte("module github.com/b/log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkImportDirs(pins); err != nil {
+		t.Errorf("module imported again collides with itself: %v", err)
+	}
+}
+
+func TestImportModuleReplacedInGoMod(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.work":  "go 1.18\n\nuse ./m\n",
+		"m/go.mod": "module example.com/m\n\ngo 1.18\n\nrequire example.com/fork v1.0.0\n\nreplace example.com/fork => ../fork\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sess, err := base.NewSession(util.Env{Dir: dir, Vars: []string{"GOWORK=" + filepath.Join(dir, "go.work")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := base.ModulePin{Path: "example.com/fork", Version: "v1.0.0", Pinned: "v1.0.0", Imported: true, Dir: filepath.Join(dir, "wharf_port", "fork")}
+
+	// Nothing is copied, the replacement has to be dealt with first
+	err = importModule(sess, pin, false)
+	if err == nil || !strings.Contains(err.Error(), "../fork") || !strings.Contains(err.Error(), filepath.Join(dir, "m", "go.mod")+":7") {
+		t.Fatalf("got error %v", err)
+	}
+	if _, err := os.Stat(pin.Dir); !os.IsNotExist(err) {
+		t.Errorf("module was imported anyway")
+	}
+
+	// A replacement of another version is not in effect
+	pin.Version, pin.Pinned = "v1.1.0", "v1.1.0"
+	gomod := files["m/go.mod"] + "\nreplace example.com/fork v1.0.0 => ../old\n"
+	gomod = strings.Replace(gomod, "replace example.com/fork => ../fork\n", "", 1)
+	if err := os.WriteFile(filepath.Join(dir, "m", "go.mod"), []byte(gomod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if replaces, err := goModReplaces(sess, pin); err != nil || len(replaces) != 0 {
+		t.Errorf("got replaces %v (error %v)", replaces, err)
+	}
+}
@@ -0,0 +1,210 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package wharf
+
+import (
+	"github.com/zosopentools/wharf/internal/base"
+)
+
+// Changes made (or suggested in dry mode) to port the packages
+type Result struct {
+	Modules     []ModulePin
+	Packages    []PackagePatch
+	Suggestions []Suggestion `json:",omitempty"`
+
+	// Changes that need attention before they are used (such as golang.org/x modules that were ported)
+	Warnings []string `json:",omitempty"`
+
+	// Modules of the build list whose version changed because of the pins (sorted by path)
+	BuildList []BuildChange `json:",omitempty"`
+
+	// Error the port failed with (only set by callers reporting a failed port)
+	Errors string `json:",omitempty"`
+
+	// Platform the packages were ported to
+	GOOS string `json:",omitempty"`
+
+	// Copy of the go.work the port replaced
+	GoWorkBackup string `json:",omitempty"`
+
+	// Directory modules were imported to
+	ImportDir string `json:",omitempty"`
+}
+
+// Version change of a module (or import of it into the workspace)
+type ModulePin struct {
+	Path     string
+	Version  string
+	Pinned   string
+	Imported bool   `json:",omitempty"`
+	Dir      string `json:",omitempty"`
+
+	// Module path or local directory the workspace already replaced the module with (Pinned is its version)
+	Replace string `json:",omitempty"`
+
+	// The replacement is a local directory (Dir), packages are patched in place instead of being imported
+	Local bool `json:",omitempty"`
+}
+
+// Version change of a module in the build list caused by the pins (including side effects)
+type BuildChange struct {
+	Path string
+
+	// Empty if the module was not in the build list before (a new requirement)
+	Before string `json:",omitempty"`
+
+	// Empty if the module dropped out of the build list
+	After string `json:",omitempty"`
+
+	// The module was pinned by Wharf rather than moved as a side effect
+	Pinned bool `json:",omitempty"`
+}
+
+// Changes made to the files of a package
+type PackagePatch struct {
+	Path       string
+	Dir        string
+	Module     string
+	Template   bool        `json:",omitempty"`
+	Tags       []string    `json:",omitempty"`
+	Files      []FilePatch `json:",omitempty"`
+	TypeErrors []string
+	Error      string `json:",omitempty"`
+}
+
+// Changes made to a single file
+type FilePatch struct {
+	Name     string
+	Build    bool
+	BaseFile string       `json:",omitempty"`
+	Symbols  []SymbolRepl `json:",omitempty"`
+	Borrowed []string     `json:",omitempty"`
+	Cleanups []Cleanup    `json:",omitempty"`
+	Lines    []LineDiff   `json:",omitempty"`
+}
+
+const (
+	// Kinds of cleanups made to files
+	CleanupImport   = base.CleanupImport
+	CleanupVariable = base.CleanupVariable
+)
+
+// Unused import or variable that has to be dealt with for the file to compile
+type Cleanup struct {
+	Kind   string
+	Name   string
+	Path   string `json:",omitempty"`
+	Line   int
+	Column int
+}
+
+// Symbol replaced in a copy of a file
+type SymbolRepl struct {
+	Original string
+	New      string
+}
+
+// Line changed in a copy of a file
+type LineDiff struct {
+	Line     uint
+	Original string
+	New      string
+}
+
+// Config entry that could fix a symbol which couldn't be ported
+type Suggestion struct {
+	Package    string
+	Symbol     string
+	Directive  Directive
+	Confidence float64
+	Reason     string
+}
+
+// Export directive of a config file (see -config)
+type Directive struct {
+	Type    string
+	Replace string
+
+	// Import path required by a template (added to files the template is applied to)
+	Import string
+}
+
+// Format the suggestion as a config entry that can be pasted into a config file
+func (sug Suggestion) YAML() string {
+	return base.InlineSuggestion{
+		Package: sug.Package,
+		Symbol:  sug.Symbol,
+		Directive: base.ExportInline{
+			Type:    sug.Directive.Type,
+			Replace: sug.Directive.Replace,
+			Import:  sug.Directive.Import,
+		},
+		Confidence: sug.Confidence,
+		Reason:     sug.Reason,
+	}.YAML()
+}
+
+// Copy of the output of a port, nil stays nil
+func newResult(out *base.Output) *Result {
+	if out == nil {
+		return nil
+	}
+
+	res := &Result{
+		Warnings:     out.Warnings,
+		Errors:       out.Errors,
+		GOOS:         out.GOOS,
+		GoWorkBackup: out.GoWorkBackup,
+		ImportDir:    out.ImportDir,
+	}
+
+	for _, pin := range out.Modules {
+		res.Modules = append(res.Modules, ModulePin(pin))
+	}
+	for _, change := range out.BuildList {
+		res.BuildList = append(res.BuildList, BuildChange(change))
+	}
+	for _, sug := range out.Suggestions {
+		res.Suggestions = append(res.Suggestions, Suggestion{
+			Package:    sug.Package,
+			Symbol:     sug.Symbol,
+			Directive:  Directive(sug.Directive),
+			Confidence: sug.Confidence,
+			Reason:     sug.Reason,
+		})
+	}
+
+	for _, patch := range out.Packages {
+		pp := PackagePatch{
+			Path:       patch.Path,
+			Dir:        patch.Dir,
+			Module:     patch.Module,
+			Template:   patch.Template,
+			Tags:       patch.Tags,
+			TypeErrors: patch.TypeErrors,
+			Error:      patch.Error,
+		}
+		for _, file := range patch.Files {
+			fp := FilePatch{
+				Name:     file.Name,
+				Build:    file.Build,
+				BaseFile: file.BaseFile,
+				Borrowed: file.Borrowed,
+			}
+			for _, symbol := range file.Symbols {
+				fp.Symbols = append(fp.Symbols, SymbolRepl(symbol))
+			}
+			for _, cleanup := range file.Cleanups {
+				fp.Cleanups = append(fp.Cleanups, Cleanup(cleanup))
+			}
+			for _, line := range file.Lines {
+				fp.Lines = append(fp.Lines, LineDiff(line))
+			}
+			pp.Files = append(pp.Files, fp)
+		}
+		res.Packages = append(res.Packages, pp)
+	}
+	return res
+}
@@ -0,0 +1,219 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package wharf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/port2"
+)
+
+// Work out the changes needed to port the packages, progress is reported to log
+func plan(cctx context.Context, sess *base.Session, paths []string, classifiers []pkg2.Classifier, strategies []port2.Strategy, log io.Writer) (*base.Output, error) {
+	ctx := port2.NewContext(sess)
+	ctx.SetLog(log)
+	for _, cl := range classifiers {
+		ctx.AddClassifier(cl)
+	}
+	for _, strategy := range strategies {
+		ctx.AddStrategy(strategy)
+	}
+	if err := ctx.CheckStrategies(); err != nil {
+		return &base.Output{}, err
+	}
+
+	// Stale type data only wastes disk space, a port doesn't fail if it cannot be removed
+	if err := port2.TrimTypeCache(sess.TypeCache); err != nil {
+		fmt.Fprintf(log, "%v\n", err)
+	}
+
+	// The build list is only reported, a port doesn't fail if it cannot be listed
+	buildList, err := ctx.BuildList()
+	if err != nil {
+		fmt.Fprintf(log, "unable to load the build list (go list -m all), changes to it will not be reported: %v\n", err)
+	}
+
+	if err := run(cctx, sess, paths, ctx, buildList, log); err != nil {
+		// Suggestions are still useful for fixing the port manually
+		return &base.Output{Suggestions: ctx.CollectSuggestions()}, err
+	}
+
+	out := &base.Output{
+		Modules:     ctx.CollectPins(),
+		Packages:    ctx.CollectPatches(),
+		Suggestions: ctx.CollectSuggestions(),
+	}
+
+	// golang.org/x modules are only ported on request, changes to them must stand out
+	for _, pin := range out.Modules {
+		if strings.HasPrefix(pin.Path, pkg2.GOLANGX_PATH_PREFIX) && (pin.Imported || pin.Local) {
+			out.Warnings = append(out.Warnings, fmt.Sprintf(
+				"%v was ported like any other dependency: it is part of the Go project, "+
+					"the changes are not supported upstream and may break on updates (consider contributing them instead)",
+				pin.Path,
+			))
+		}
+	}
+	sort.Strings(out.Warnings)
+
+	if buildList != nil {
+		if out.BuildList, err = ctx.CollectBuildChanges(buildList); err != nil {
+			fmt.Fprintf(log, "unable to load the build list (go list -m all), changes to it will not be reported: %v\n", err)
+		}
+	}
+
+	return out, nil
+}
+
+// Port the packages, buildList is the build list of the workspace they were listed with (nil if unknown)
+func run(cctx context.Context, sess *base.Session, paths []string, ctx *port2.Context, buildList map[string]string, log io.Writer) error {
+	firstPass := true
+	tree, err := pkg2.List(sess, paths)
+	if err != nil {
+		return err
+	}
+
+	// Modules whose version changed since the last load
+	var pinned []string
+load:
+	if len(pinned) > 0 {
+		// Pins can move other modules too (through MVS), their packages are reloaded with the pinned ones
+		after, err := ctx.BuildList()
+		if err == nil && buildList != nil {
+			err = tree.Reload(movedModules(buildList, after, pinned))
+		} else {
+			err = tree.ReloadAll()
+		}
+		if err != nil {
+			return err
+		}
+		buildList = after
+		pinned = nil
+	}
+
+	err = tree.Resolve()
+	if err != nil {
+		return err
+	}
+
+	tree.LoadExports()
+
+	groups := tree.Groups()
+
+	for _, group := range groups {
+		if err := cctx.Err(); err != nil {
+			return err
+		}
+
+		handles := make([]*port2.Handle, 0, len(group))
+		for _, pkg := range group {
+			// Sanity checks to make sure stdlib packages aren't altered by us
+			if !pkg.FirstLoad && (pkg.Meta.Goroot || pkg.Meta.Standard) && (pkg.Dirty || pkg.DepDirty) {
+				panic(fmt.Sprintf("GOROOT package %v changed after first load", pkg))
+			}
+
+			handles = append(handles, ctx.GetHandle(pkg))
+		}
+
+		// Packages of a layer only depend on earlier layers
+		ctx.RefreshAll(handles, sess.Jobs)
+
+		for idx, pkg := range group {
+			handle := handles[idx]
+
+			// Mark frozen (GOROOT and pinned golang.org/x/...) packages as exhausted
+			if pkg2.IsFrozenPkg(pkg) {
+				handle.MarkExhausted()
+				// Their types never change, so their syntax is no longer needed
+				pkg.ReleaseSyntax()
+			}
+
+			if firstPass && handle.HasTypeErrors() {
+				fmt.Fprintf(log, "%v: needs inspecting\n", handle.GetPackage().Meta.ImportPath)
+			}
+		}
+
+		ctx.TrimSyntax(sess.MemoryLimit)
+	}
+
+	firstPass = false
+
+	for i := range groups {
+		if err := cctx.Err(); err != nil {
+			return err
+		}
+
+		packages := groups[len(groups)-(i+1)]
+		changed := make(map[string]bool)
+
+		for _, pkg := range packages {
+			// Once a module is pinned the rest of the layer is only pinned too (so they share a reload),
+			// unless it depends on a module that is about to change
+			if len(pinned) > 0 {
+				if (pkg.Meta.Module != nil && changed[pkg.Meta.Module.Path]) || pkg.DependsOn(changed) {
+					continue
+				}
+				if ok, err := ctx.Pin(pkg); err != nil {
+					fmt.Fprintf(log, "package require manual porting: %v\n\t%v\n", pkg.Meta.ImportPath, err.Error())
+					return err
+				} else if ok {
+					pinned = append(pinned, pkg.Meta.Module.Path)
+					changed[pkg.Meta.Module.Path] = true
+				}
+				continue
+			}
+
+			result, err := ctx.Port(pkg)
+			if result == port2.RESULT_ERROR || err != nil {
+				fmt.Fprintf(log, "package require manual porting: %v\n\t%v\n", pkg.Meta.ImportPath, err.Error())
+				return err
+			}
+
+			if result == port2.RESULT_RELOAD {
+				pinned = append(pinned, pkg.Meta.Module.Path)
+				changed[pkg.Meta.Module.Path] = true
+			}
+		}
+
+		if len(pinned) > 0 {
+			goto load
+		}
+
+		ctx.TrimSyntax(sess.MemoryLimit)
+	}
+
+	return nil
+}
+
+// Modules to reload after the pins: the pinned ones and every module whose version changed in the build list
+func movedModules(before, after map[string]string, pinned []string) []string {
+	moved := make(map[string]bool, len(pinned))
+	for _, path := range pinned {
+		moved[path] = true
+	}
+	for path, version := range after {
+		if before[path] != version {
+			moved[path] = true
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			moved[path] = true
+		}
+	}
+
+	modules := make([]string, 0, len(moved))
+	for path := range moved {
+		modules = append(modules, path)
+	}
+	sort.Strings(modules)
+	return modules
+}
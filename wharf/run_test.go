@@ -0,0 +1,31 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package wharf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMovedModules(t *testing.T) {
+	before := map[string]string{
+		"example.com/pinned":  "v1.0.0",
+		"example.com/moved":   "v1.1.0",
+		"example.com/same":    "v1.0.0",
+		"example.com/dropped": "v0.1.0",
+	}
+	after := map[string]string{
+		"example.com/pinned": "v1.3.0",
+		"example.com/moved":  "v1.2.0",
+		"example.com/same":   "v1.0.0",
+		"example.com/added":  "v0.2.0",
+	}
+
+	got := strings.Join(movedModules(before, after, []string{"example.com/pinned"}), " ")
+	want := "example.com/added example.com/dropped example.com/moved example.com/pinned"
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
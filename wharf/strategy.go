@@ -0,0 +1,247 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package wharf
+
+import (
+	"fmt"
+	"go/types"
+	"regexp"
+
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/port2"
+)
+
+// Approach to porting a package, selected by name like the built in ones (see Options.CustomStrategies)
+type Strategy interface {
+	// Name the strategy is selected by in the strategies option (of a run or a module)
+	Name() string
+
+	// Try to fix what the attempt describes, returns false if the strategy does not apply
+	//
+	// On success the selected config of the handle must be the fixed one (see Handle.Select), and the attempt
+	// must list the imports that are still broken. On failure any change of the selected config is undone.
+	Port(handle *Handle, attempt *Attempt) (bool, error)
+}
+
+// What a strategy is asked to fix
+type Attempt struct {
+	// Declarations the package needs are missing from its own files
+	Missing bool
+
+	// Import paths of the imports that are missing declarations the package needs
+	Imports map[string]bool
+
+	// The fix may leave imports broken, they are ported before the package is tried again
+	KeepImports bool
+
+	// Errors of kinds recognized by the classifiers (see Options.Classifiers), a fix has to get rid of all of them
+	//
+	// Of the built in strategies only retag acts on them (it looks for a platform config without them),
+	// fixing them is up to custom strategies
+	Errors []TypeError
+}
+
+// Type error of a config
+type TypeError struct {
+	Err types.Error
+
+	// Kind a classifier recognized the error as, and the details it extracted (empty for other errors)
+	Kind  string
+	Match []string
+}
+
+// Files a package is built from
+type BuildConfig struct {
+	Platforms []string
+	Files     []*GoFile
+}
+
+// Source file of a package
+type GoFile struct {
+	Name string
+	Path string
+
+	file *pkg2.GoFile
+}
+
+// Package a strategy is porting: its selected config and type errors, and the means to select another config
+type Handle struct {
+	handle *port2.Handle
+
+	// Files handed out so far, the same file is always the same *GoFile
+	files map[*pkg2.GoFile]*GoFile
+
+	// Packages an import path of Attempt.Imports may name
+	imports map[string]*pkg2.Package
+}
+
+func newHandle(handle *port2.Handle) *Handle {
+	h := &Handle{
+		handle:  handle,
+		files:   make(map[*pkg2.GoFile]*GoFile),
+		imports: make(map[string]*pkg2.Package),
+	}
+	for path, ipkg := range handle.GetPackage().Imports {
+		h.imports[path] = ipkg
+	}
+	return h
+}
+
+// Import path of the package
+func (h *Handle) Path() string {
+	return h.handle.GetPackage().Meta.ImportPath
+}
+
+// Config that is currently selected for the package
+func (h *Handle) Config() BuildConfig {
+	cfg := h.handle.Config()
+	files := make([]*GoFile, 0, len(cfg.Files))
+	for _, gofile := range cfg.Files {
+		files = append(files, h.file(gofile))
+	}
+	return BuildConfig{Platforms: cfg.Platforms, Files: files}
+}
+
+// Type errors of the selected config
+func (h *Handle) Errors() []TypeError {
+	return typeErrors(h.handle.Errors())
+}
+
+// Generate a copy of the file with the given source, built for the target platform only
+//
+// The copy takes the place of the file in the configs it is selected into (see Select), it can only
+// import packages the package already imports. Once the package is patched it is written next to the file.
+func (h *Handle) ReplaceFile(gofile *GoFile, src []byte) (*GoFile, error) {
+	if gofile == nil || gofile.file == nil {
+		return nil, fmt.Errorf("replaced file is not a file of %v", h.Path())
+	}
+	repl, err := h.handle.ReplaceFile(gofile.file, src)
+	if err != nil {
+		return nil, err
+	}
+	return h.file(repl), nil
+}
+
+// Select a config made up of the given files if it type checks and doesn't break the packages importing it
+//
+// Imports that are missing declarations are only accepted if keepImports is set, their import paths are returned.
+func (h *Handle) Select(files []*GoFile, keepImports bool) (map[string]bool, bool) {
+	selected := make([]*pkg2.GoFile, 0, len(files))
+	for _, gofile := range files {
+		if gofile == nil || gofile.file == nil {
+			return nil, false
+		}
+		selected = append(selected, gofile.file)
+	}
+
+	imports, ok := h.handle.Select(selected, keepImports)
+	if !ok {
+		return nil, false
+	}
+	return h.importPaths(imports), true
+}
+
+func (h *Handle) file(gofile *pkg2.GoFile) *GoFile {
+	if h.files[gofile] == nil {
+		h.files[gofile] = &GoFile{Name: gofile.Name, Path: gofile.Path, file: gofile}
+	}
+	return h.files[gofile]
+}
+
+func (h *Handle) importPaths(imports map[*pkg2.Package]bool) map[string]bool {
+	paths := make(map[string]bool, len(imports))
+	for ipkg, broken := range imports {
+		h.imports[ipkg.Meta.ImportPath] = ipkg
+		paths[ipkg.Meta.ImportPath] = broken
+	}
+	return paths
+}
+
+func typeErrors(errs []pkg2.TypeError) []TypeError {
+	converted := make([]TypeError, 0, len(errs))
+	for _, err := range errs {
+		te := TypeError{Err: err.Err}
+		if reason, ok := err.Reason.(pkg2.ClassifiedId); ok {
+			classified := reason.Classified()
+			te.Kind, te.Match = classified.Kind, classified.Match
+		}
+		converted = append(converted, te)
+	}
+	return converted
+}
+
+// Runs a strategy of the API as one of port2
+type apiStrategy struct {
+	strategy Strategy
+}
+
+func (s apiStrategy) Name() string {
+	return s.strategy.Name()
+}
+
+func (s apiStrategy) Port(handle *port2.Handle, attempt *port2.Attempt) (bool, error) {
+	h := newHandle(handle)
+	pub := &Attempt{
+		Missing:     attempt.Missing,
+		Imports:     h.importPaths(attempt.Imports),
+		KeepImports: attempt.KeepImports,
+		Errors:      typeErrors(attempt.Errors),
+	}
+
+	ok, err := s.strategy.Port(h, pub)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	imports := make(map[*pkg2.Package]bool, len(pub.Imports))
+	for path, broken := range pub.Imports {
+		ipkg := h.imports[path]
+		if ipkg == nil {
+			return false, fmt.Errorf("strategy %v: %v is not imported by %v", s.Name(), path, h.Path())
+		}
+		imports[ipkg] = broken
+	}
+	attempt.Imports = imports
+	return true, nil
+}
+
+// Recognizes an additional kind of type errors
+type Classifier interface {
+	// Returns false if the error is not of the classifier's kind
+	Classify(err types.Error) (ClassifiedError, bool)
+}
+
+// Kind (and details) of a type error a classifier recognized
+type ClassifiedError struct {
+	Kind  string
+	Match []string // Details the classifier extracted from the error (such as the submatches of its pattern)
+}
+
+// Classifier matching the message of type errors against a pattern
+type PatternClassifier struct {
+	Kind    string
+	Pattern *regexp.Regexp
+}
+
+func (cl PatternClassifier) Classify(err types.Error) (ClassifiedError, bool) {
+	match := cl.Pattern.FindStringSubmatch(err.Msg)
+	if match == nil {
+		return ClassifiedError{}, false
+	}
+	return ClassifiedError{Kind: cl.Kind, Match: match[1:]}, true
+}
+
+// Runs a classifier of the API as one of pkg2
+type apiClassifier struct {
+	classifier Classifier
+}
+
+func (cl apiClassifier) Classify(err types.Error) (pkg2.ClassifiedId, bool) {
+	reason, ok := cl.classifier.Classify(err)
+	if !ok {
+		return nil, false
+	}
+	return pkg2.TCClassified(reason), true
+}
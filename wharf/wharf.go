@@ -0,0 +1,285 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+// Package wharf ports Go packages (and the modules they depend on) to z/OS
+//
+// It is the engine behind the wharf command, so build tooling can run it in-process:
+//
+//	res, err := wharf.Port(ctx, wharf.Options{Paths: []string{"./..."}, DryRun: true})
+package wharf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zosopentools/wharf/internal/base"
+	"github.com/zosopentools/wharf/internal/pkg2"
+	"github.com/zosopentools/wharf/internal/port2"
+	"github.com/zosopentools/wharf/internal/util"
+)
+
+type Options struct {
+	// Package patterns to port (as passed to go list)
+	Paths []string
+
+	// Directory of the workspace to port, the go.work it belongs to is used (defaults to the working directory).
+	// Relative paths in the options (config, import dir) are relative to it
+	Dir string
+
+	// Platform to port to as GOOS/GOARCH, e.g. zos/s390x (defaults to the Go environment)
+	Target string
+
+	// Additional build tags
+	Tags []string
+
+	// Config file with additional code edits (see -config)
+	Config string
+
+	// Work out the changes without applying them
+	DryRun bool
+
+	// Where modules that need patches are imported to (defaults to wharf_port next to go.work),
+	// each module goes to the directory its module path names under it (e.g. wharf_port/github.com/a/log/v2)
+	ImportDir string
+
+	// Clone imported modules from VCS instead of copying them from the module cache
+	VCS bool
+
+	// Number of packages to type check in parallel (defaults to the number of CPUs)
+	Jobs int
+
+	// Don't reuse or store type data and file metadata between runs
+	NoCache bool
+
+	// Heap size in bytes past which syntax trees are parsed again instead of kept (0 for no limit),
+	// only syntax trees are released (the line tables of parsed files and type data are kept)
+	MemoryLimit uint64
+
+	// Most names a package can be missing for declarations to be borrowed instead of retagging
+	// whole files (defaults to 2)
+	BorrowLimit int
+
+	// Porting strategies to try in order (defaults to borrow, assemble, retag, exports)
+	Strategies []string
+
+	// Additional porting strategies, they are only tried once selected by name (in Strategies or in the
+	// strategies of a module in the config). A strategy replaces the built in one with the same name
+	CustomStrategies []Strategy
+
+	// How the version of a module that needs porting is picked: "update" tries the latest version (default),
+	// "minimal" bisects for the lowest version after the one MVS selected that type checks
+	PinSearch string
+
+	// Port golang.org/x modules like any other dependency instead of only pinning them
+	// (the result warns about every one of them that was changed)
+	PortGolangX bool
+
+	// Recognize type errors that would otherwise stop a package from being ported,
+	// the strategies get to fix them (retag looks for a config without them)
+	Classifiers []Classifier
+
+	// Progress and messages about packages that need attention (discarded if nil)
+	Log io.Writer
+
+	// Called with the planned changes before they are applied
+	Planned func(*Result)
+}
+
+// Port the packages in the current workspace
+//
+// The workspace (go.work) is backed up before it gets replaced, see Result.GoWorkBackup.
+// If the changes could not be applied an *ApplyError is returned together with the planned changes.
+// Every port works on its own state (and runs go commands in opts.Dir), ports of different workspaces
+// can run at the same time.
+func Port(cctx context.Context, opts Options) (*Result, error) {
+	out, err := port(cctx, opts)
+	return newResult(out), err
+}
+
+func port(cctx context.Context, opts Options) (*base.Output, error) {
+	sess, err := newSession(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	log := opts.Log
+	if log == nil {
+		log = io.Discard
+	}
+
+	gowork := sess.GOWORK()
+	if gowork == "" {
+		return nil, errors.New("no workspace found; please initialize one using `go work init` and add modules")
+	}
+
+	// Setup a private go.work file to make changes to as we work - while keeping the original safe
+	wfWork := filepath.Join(filepath.Dir(gowork), ".wharf.work")
+	if err := util.CopyFile(wfWork, gowork); err != nil {
+		return nil, fmt.Errorf("unable to create temporary workspace: %w", err)
+	}
+	defer func() {
+		if err := os.Remove(wfWork + ".sum"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(log, "unable to remove: %v: %v\n", wfWork+".sum", err)
+		}
+	}()
+	sess.Env.Vars = append(sess.Env.Vars, "GOWORK="+wfWork)
+
+	if err := os.MkdirAll(sess.Cache, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create cache at %v: %w", sess.Cache, err)
+	}
+	defer func() {
+		if err := os.RemoveAll(sess.Cache); err != nil {
+			fmt.Fprintf(log, "unable to remove cache: %v: %v\n", sess.Cache, err)
+		}
+	}()
+
+	classifiers := make([]pkg2.Classifier, 0, len(opts.Classifiers))
+	for _, cl := range opts.Classifiers {
+		classifiers = append(classifiers, apiClassifier{cl})
+	}
+	strategies := make([]port2.Strategy, 0, len(opts.CustomStrategies))
+	for _, strategy := range opts.CustomStrategies {
+		strategies = append(strategies, apiStrategy{strategy})
+	}
+
+	out, err := plan(cctx, sess, opts.Paths, classifiers, strategies, log)
+	if err != nil {
+		os.Remove(wfWork)
+		return out, err
+	}
+	out.GOOS = sess.GOOS()
+
+	if opts.Planned != nil {
+		opts.Planned(newResult(out))
+	}
+
+	if opts.DryRun {
+		os.Remove(wfWork)
+		return out, nil
+	}
+
+	if err := apply(sess, out, opts.VCS); err != nil {
+		// Our copy of the workspace is kept, it may be needed to apply the missing changes manually
+		return out, err
+	}
+	out.ImportDir = sess.ImportDir
+
+	backup := gowork + ".backup"
+	if err := util.CopyFile(backup, gowork); err != nil {
+		return out, fmt.Errorf("unable to backup workspace to %v (our copy is located here: %v): %w", backup, wfWork, err)
+	}
+	if err := util.CopyFile(gowork, wfWork); err != nil {
+		return out, fmt.Errorf("unable to update workspace (our copy is located here: %v): %w", wfWork, err)
+	}
+	out.GoWorkBackup = backup
+
+	if err := os.Remove(wfWork); err != nil {
+		fmt.Fprintf(log, "unable to remove: %v: %v\n", wfWork, err)
+	}
+
+	return out, nil
+}
+
+// Start a session with the options applied on top of the defaults
+func newSession(opts Options) (*base.Session, error) {
+	env, err := sessionEnv(opts)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := base.NewSession(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Config != "" {
+		if err := sess.LoadInlines(resolvePath(env.Dir, opts.Config)); err != nil {
+			return nil, fmt.Errorf("unable to load config %v: %w", opts.Config, err)
+		}
+	}
+
+	for _, tag := range opts.Tags {
+		sess.BuildTags[tag] = true
+	}
+
+	if opts.ImportDir != "" {
+		sess.ImportDir = resolvePath(env.Dir, opts.ImportDir)
+	}
+
+	if opts.Jobs > 0 {
+		sess.Jobs = opts.Jobs
+	}
+
+	if opts.NoCache {
+		sess.TypeCache = ""
+	}
+
+	if opts.BorrowLimit > 0 {
+		sess.BorrowLimit = opts.BorrowLimit
+	}
+
+	sess.MemoryLimit = opts.MemoryLimit
+	sess.Strategies = opts.Strategies
+	sess.PinSearch = opts.PinSearch
+	sess.PortGolangX = opts.PortGolangX
+
+	return sess, nil
+}
+
+// Directory and variables the go commands of a port run with
+func sessionEnv(opts Options) (util.Env, error) {
+	var env util.Env
+
+	dir := opts.Dir
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return env, fmt.Errorf("unable to resolve workspace dir %v: %w", opts.Dir, err)
+	}
+	env.Dir = dir
+
+	if opts.Target != "" {
+		goos, goarch, _ := strings.Cut(opts.Target, "/")
+		if goos == "" || strings.Contains(goarch, "/") {
+			return env, fmt.Errorf("invalid target %q (expected GOOS/GOARCH, e.g. zos/s390x)", opts.Target)
+		}
+		env.Vars = append(env.Vars, "GOOS="+goos)
+		if goarch != "" {
+			env.Vars = append(env.Vars, "GOARCH="+goarch)
+		}
+	}
+	return env, nil
+}
+
+// Path relative to dir unless it is absolute
+func resolvePath(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Run the tests of the packages with the workspace and target of the options, returns the output of go test
+func Test(opts Options) (string, error) {
+	env, err := sessionEnv(opts)
+	if err != nil {
+		return "", err
+	}
+	return util.GoTest(env, opts.Paths)
+}
+
+// Directory modules are imported to with the options (the default one if no import dir is set)
+func ImportDir(opts Options) (string, error) {
+	sess, err := newSession(opts)
+	if err != nil {
+		return "", err
+	}
+	return sess.ImportDir, nil
+}
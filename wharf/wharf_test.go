@@ -0,0 +1,211 @@
+// Licensed Materials - Property of IBM
+// Copyright IBM Corp. 2023.
+// US Government Users Restricted Rights - Use, duplication or disclosure restricted by GSA ADP Schedule Contract with IBM Corp.
+
+package wharf
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/zosopentools/wharf/internal/base"
+)
+
+// Workspace with a module whose package only builds on linux and freebsd
+func writeWorkspace(t *testing.T, modpath string) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.work":          "go 1.18\n\nuse ./m\n",
+		"m/go.mod":         "module " + modpath + "\n\ngo 1.18\n",
+		"m/p/p.go":         "package p\n\nfunc G() int { return F() }\n",
+		"m/p/f_linux.go":   "package p\n\nfunc F() int { return 1 }\n",
+		"m/p/f_freebsd.go": "package p\n\nfunc F() int { return 2 }\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPortWorkspacesConcurrently(t *testing.T) {
+	tests := []struct {
+		modpath string
+		target  string
+		patched bool
+	}{
+		{"example.com/darwin", "darwin/arm64", true},
+		{"example.com/linux", "linux/amd64", false},
+	}
+
+	results := make([]*Result, len(tests))
+	errs := make([]error, len(tests))
+	var wg sync.WaitGroup
+	for i, test := range tests {
+		wg.Add(1)
+		go func(i int, dir string, target string) {
+			defer wg.Done()
+			results[i], errs[i] = Port(context.Background(), Options{
+				Paths:   []string{"./m/..."},
+				Dir:     dir,
+				Target:  target,
+				DryRun:  true,
+				NoCache: true,
+			})
+		}(i, writeWorkspace(t, test.modpath), test.target)
+	}
+	wg.Wait()
+
+	for i, test := range tests {
+		if errs[i] != nil {
+			t.Fatalf("%v: %v", test.target, errs[i])
+		}
+		res := results[i]
+		if goos := filepath.Dir(test.target); res.GOOS != goos {
+			t.Errorf("%v: ported to %v", test.target, res.GOOS)
+		}
+		if test.patched != (len(res.Packages) == 1) {
+			t.Fatalf("%v: got patches %+v", test.target, res.Packages)
+		}
+		if test.patched && res.Packages[0].Path != test.modpath+"/p" {
+			t.Errorf("%v: patched %v, want the package of its own workspace", test.target, res.Packages[0].Path)
+		}
+	}
+}
+
+// Defines the declarations the package is missing in a copy of p.go
+type stubStrategy struct{}
+
+func (stubStrategy) Name() string {
+	return "stub"
+}
+
+func (stubStrategy) Port(handle *Handle, attempt *Attempt) (bool, error) {
+	if !attempt.Missing {
+		return false, nil
+	}
+
+	files := append([]*GoFile(nil), handle.Config().Files...)
+	for idx, gofile := range files {
+		if gofile.Name != "p.go" {
+			continue
+		}
+		src, err := os.ReadFile(gofile.Path)
+		if err != nil {
+			return false, err
+		}
+		if files[idx], err = handle.ReplaceFile(gofile, append(src, "\nfunc F() int { return 0 }\n"...)); err != nil {
+			return false, err
+		}
+	}
+
+	imports, ok := handle.Select(files, attempt.KeepImports)
+	if ok {
+		attempt.Imports = imports
+	}
+	return ok, nil
+}
+
+func TestCustomStrategy(t *testing.T) {
+	res, err := Port(context.Background(), Options{
+		Paths:            []string{"./m/..."},
+		Dir:              writeWorkspace(t, "example.com/stub"),
+		Target:           "darwin/arm64",
+		DryRun:           true,
+		NoCache:          true,
+		Strategies:       []string{"stub"},
+		CustomStrategies: []Strategy{stubStrategy{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Packages) != 1 || res.Packages[0].Path != "example.com/stub/p" {
+		t.Fatalf("got patches %+v", res.Packages)
+	}
+
+	var names []string
+	for _, file := range res.Packages[0].Files {
+		if file.Build && file.BaseFile == "p.go" {
+			return
+		}
+		names = append(names, file.Name)
+	}
+	t.Errorf("p.go was not replaced by the strategy, patched files: %v", names)
+}
+
+func TestSessionEnv(t *testing.T) {
+	env, err := sessionEnv(Options{Dir: "ws", Target: "darwin/arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(env.Dir) || filepath.Base(env.Dir) != "ws" {
+		t.Errorf("got dir %v", env.Dir)
+	}
+	if len(env.Vars) != 2 || env.Vars[0] != "GOOS=darwin" || env.Vars[1] != "GOARCH=arm64" {
+		t.Errorf("got vars %v", env.Vars)
+	}
+
+	if _, err := sessionEnv(Options{Target: "/arm64"}); err == nil {
+		t.Errorf("target without GOOS accepted")
+	}
+}
+
+func TestResultJSON(t *testing.T) {
+	out := &base.Output{
+		Modules: []base.ModulePin{{Path: "example.com/m", Version: "v1.0.0", Pinned: "v1.1.0", Imported: true}},
+		Packages: []base.PackagePatch{{
+			Path: "example.com/m/p",
+			Tags: []string{"zos"},
+			Files: []base.FilePatch{{
+				Name:     "p_zos.go",
+				Cached:   "/cache/p_zos.go",
+				Build:    true,
+				BaseFile: "p_linux.go",
+				Symbols:  []base.SymbolRepl{{Original: "unix.A", New: "unix.B"}},
+				Cleanups: []base.Cleanup{{Kind: base.CleanupImport, Path: "os", Line: 3, Column: 2}},
+				Lines:    []base.LineDiff{{Line: 5, Original: "a", New: "b"}},
+			}},
+			TypeErrors: []string{"p.go:3:2: undefined: F"},
+		}},
+		Suggestions: []base.InlineSuggestion{{
+			Package:    "example.com/unix",
+			Symbol:     "EBADF",
+			Directive:  base.ExportInline{Type: "CONST", Replace: "EBADFE"},
+			Confidence: 0.9,
+			Reason:     "known alias",
+		}},
+		BuildList: []base.BuildChange{{Path: "example.com/m", Before: "v1.0.0", After: "v1.1.0", Pinned: true}},
+		Warnings:  []string{"warning"},
+		GOOS:      "zos",
+	}
+
+	// The JSON report of the command is made from the result, it has to stay the same
+	want, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := newResult(out)
+	got, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	if got, want := res.Suggestions[0].YAML(), out.Suggestions[0].YAML(); got != want {
+		t.Errorf("suggestion formatted as %q, want %q", got, want)
+	}
+	if newResult(nil) != nil {
+		t.Errorf("no output made a result")
+	}
+}